@@ -0,0 +1,772 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gdal_constrast_stretch/stretch"
+
+	"github.com/lukeroth/gdal"
+)
+
+var outputTypes = map[string]gdal.DataType{
+	"byte":    gdal.Byte,
+	"uint16":  gdal.UInt16,
+	"int16":   gdal.Int16,
+	"uint32":  gdal.UInt32,
+	"int32":   gdal.Int32,
+	"float32": gdal.Float32,
+	"float64": gdal.Float64,
+}
+
+func usage() {
+	print(
+		"Usage: gdal_contrast_stretch\n",
+		"    [-ndv <val>] [-valid-range <min>..<max>]\n",
+		"    [-b <band_id> -b <band_id> ...]\n",
+		"    [-of <format>] [-co <NAME=VALUE>]... [-outndv <out_ndv> | -alpha | -mask]\n",
+		"    [-ot Byte|UInt16|Int16|UInt32|Int32|Float32|Float64] [-outrange <levels>]\n",
+		"    { -linear-stretch <target_avg> <target_stddev> |\n",
+		"      -percentile-range <from> <to> |\n",
+		"      -minmax |\n",
+		"      -histeq <target_stddev> [-histeq-avg <target_avg>] [-histeq-target <dist>] |\n",
+		"      -match <reference.tif> |\n",
+		"      -clahe [-clahe-tile <pixels>] [-clahe-clip <limit>] |\n",
+		"      -decorrelation <target_avg> <target_stddev> |\n",
+		"      -apply <params.json> |\n",
+		"      -mode <name> [-mode-opt <KEY=VALUE>]... |\n",
+		"      -dump-histogram [-dump-format csv|json] [-dump-empty] [-dump-bins <n>] }\n",
+		"    [-workers <n>] [-float-bins linear|log] [-histogram-memory <MiB>]\n",
+		"    [-approx] [-sample-step <n>]\n",
+		"    [-histogram-cache <file.json>] [-pam] [-stats-from <files>]...\n",
+		"    [-transfer gamma|log|sqrt|sigmoid [-gamma <g>] [-gain <k>] [-midpoint <m>]]\n",
+		"    [-stats histogram|tdigest] [-tdigest-compression <n>]\n",
+		"    [-link all|luminance [-luma-weights '<w1> <w2> ...']]\n",
+		"    [-save-params <params.json>]\n",
+		"    <src.tif> [<dst.tif>]\n",
+		"  or, to stretch many sources alike:\n",
+		"    gdal_contrast_stretch [options] -batch <template> [-jobs <n>] [-skip-existing]\n",
+		"    [-continue-on-error] [-report <report.json>] <dir|glob|@list>...\n",
+		"\n",
+		"No-data values:\n",
+		"  -ndv val                                  Set a no-data value\n",
+		"  -ndv 'val1 val2 val3 ...'                 Set a no-data value using all input bands\n",
+		"  -ndv 'min1..max1 min2..max2 ...'          Set a range of no-data values\n",
+		"                                            (-Inf and Inf are allowed)\n",
+		"  -valid-range 'min1..max1 min2..max2 ...'  Set a range of valid data values\n",
+		"  -outndv <val>                             Output value of nodata pixels, set as the\n",
+		"                                            band NoData value (default 0)\n",
+		"  -alpha                                    Mark nodata with an alpha band instead\n",
+		"  -mask                                     Mark nodata with an internal mask instead\n",
+		"\n",
+		"Output:\n",
+		"  -co <NAME=VALUE>  Creation option passed to the output driver (repeatable)\n",
+		"  -ot <type>        Output data type (default Byte)\n",
+		"  -outrange <n>     Number of output levels, e.g. 4096 for 12-bit data\n",
+		"                    (default 256 for Byte, 32768 for Int16 and 65536\n",
+		"                    for the other types; Float32/Float64 output is\n",
+		"                    normalised to 0..1)\n",
+		"\n",
+		"Histograms of bands other than 8/16-bit integers:\n",
+		"  -float-bins linear    Bins between the band min and max (default); needs an\n",
+		"                        extra pass, cut values accurate to half a bin width\n",
+		"  -float-bins log       Log-scale bins over all values in a single pass, cut\n",
+		"                        values accurate relative to their magnitude\n",
+		"  -histogram-memory <n> Memory for the bin counts in MiB per worker, shared by\n",
+		"                        the bands binned as above (default 8)\n",
+		"\n",
+		"Approximate statistics, for large scenes:\n",
+		"  -sample-step <n>      Read every n-th row and column only\n",
+		"  -approx               Read the coarsest overview whose pixels are no more\n",
+		"                        than -sample-step apart (default: about 4 million\n",
+		"                        pixels), and every n-th of its rows and columns for\n",
+		"                        the rest of the step\n",
+		"  The output is written from all pixels; the number sampled is logged.\n",
+		"\n",
+		"Histogram reuse, to skip reading the pixels when only the stretch changes:\n",
+		"  -histogram-cache <f>  Read the histograms from the JSON file f, or compute\n",
+		"                        and write them there if it is missing or stale\n",
+		"  -pam                  The same with the default histograms and statistics\n",
+		"                        of the source, kept by GDAL in its .aux.xml file\n",
+		"                        (not for -float-bins log)\n",
+		"  Histograms are stale once the size or modification time of the source,\n",
+		"  the bands, the no-data settings or the histogram options change.\n",
+		"\n",
+		"Mosaics, to stretch every tile alike so no seams show:\n",
+		"  -stats-from <files>   Compute the stretch from the histograms of these\n",
+		"                        files merged instead of the source: a file name,\n",
+		"                        a directory for its .tif/.tiff files, a quoted\n",
+		"                        glob such as 'tiles/*.tif', or @list for\n",
+		"                        the files in list, one per line (repeatable).  The\n",
+		"                        bins line up across files and data types.  Not for\n",
+		"                        -clahe, -decorrelation, -stats tdigest or\n",
+		"                        -link luminance\n",
+		"\n",
+		"Batch processing:\n",
+		"  -batch <template>     Stretch every source into the file named by template,\n",
+		"                        where {dir}, {name}, {stem} and {ext} stand for the\n",
+		"                        directory, file name, name without extension and\n",
+		"                        extension of the source.  Sources are directories\n",
+		"                        (their .tif/.tiff files), files, quoted globs or\n",
+		"                        @list files; outputs of the batch are not sources\n",
+		"  -jobs <n>             Sources stretched at once (default 1), each with\n",
+		"                        -workers block workers; progress lines then start\n",
+		"                        with the source\n",
+		"  -skip-existing        Leave sources whose output exists\n",
+		"  -continue-on-error    Go on after a failed source (default: start no more)\n",
+		"  -report <file>        Write the status of every source as JSON\n",
+		"  A summary is logged at the end and the exit status is 1 if any failed.\n",
+		"  -save-params and -histogram-cache are templates like the output, and\n",
+		"  -stats-from histograms are merged once for all sources.\n",
+		"\n",
+		"Transfer function applied after -linear-stretch, -decorrelation,\n",
+		"-percentile-range or -minmax, on the stretched values normalised to 0..1:\n",
+		"  -transfer gamma       x^(1/g) with -gamma <g>; g > 1 brightens\n",
+		"  -transfer log         log(1+k*x)/log(1+k) with -gain <k> (default 10)\n",
+		"  -transfer sqrt        sqrt(x)\n",
+		"  -transfer sigmoid     Logistic curve of slope -gain <k> (default 10)\n",
+		"                        centred on -midpoint <m> (default 0.5)\n",
+		"\n",
+		"Statistics for -percentile-range and -minmax:\n",
+		"  <from> and <to> are fractions of the valid pixels, one for all bands or\n",
+		"  'p1 p2 p3 ...' with one per selected band.  The cut values are\n",
+		"  interpolated within a histogram bin and logged.\n",
+		"  -stats histogram          Read the cuts from the histogram (default)\n",
+		"  -stats tdigest            Read the cuts from a t-digest sketch: single pass,\n",
+		"                            no value range needed, most accurate at the tails\n",
+		"  -tdigest-compression <n>  Sketch size, larger is more accurate (default 500)\n",
+		"\n",
+		"Linked stretch, one stretch shared by all bands to keep the colour balance:\n",
+		"  -link all             Use the merged histogram of all bands\n",
+		"  -link luminance       Use the histogram of the luminance\n",
+		"  -luma-weights '<w>..' Luminance weight per selected band (default\n",
+		"                        0.299 0.587 0.114 for 3 bands in R G B order,\n",
+		"                        equal weights otherwise)\n",
+		"\n",
+		"Target distribution of -histeq, in output levels:\n",
+		"  -histeq-target gaussian     Mean -histeq-avg (default mid-range), stddev from\n",
+		"                              -histeq, flat if 0 (default)\n",
+		"  -histeq-target uniform      Classic histogram equalization\n",
+		"  -histeq-target rayleigh     Mean -histeq-avg\n",
+		"  -histeq-target exponential  Mean -histeq-avg\n",
+		"  -histeq-target lognormal    Mean -histeq-avg, stddev from -histeq\n",
+		"  -histeq-target <file>       PDF from a .csv or .json file: one weight per\n",
+		"                              row/element spread evenly over the output range,\n",
+		"                              or level,weight rows / [level, weight] pairs\n",
+		"\n",
+		"-match maps every band onto the distribution of the same band of the\n",
+		"reference raster, whose values are read as output values (0..1 for float\n",
+		"output types).  A reference band with values outside the output range\n",
+		"has its distribution rescaled from its own min..max onto the output range.\n",
+		"\n",
+		"Stretch parameters, to stretch a time series or mosaic alike:\n",
+		"  -save-params <file>   Save the computed stretch of every band, with the\n",
+		"                        source statistics, as JSON (not for -clahe)\n",
+		"  -apply <file>         Apply a saved stretch without reading statistics;\n",
+		"                        output type, range, transfer function, mask and\n",
+		"                        no-data settings are taken from the file, as are\n",
+		"                        the bands unless -b is given\n",
+		"\n",
+		"-dump-histogram writes the histogram of every band to <dst> instead, or to\n",
+		"stdout if it is omitted or -:\n",
+		"  -dump-format csv      band,bin,value,lo,hi,count rows after one\n",
+		"                        '# band=... min=... max=... mean=...' line per band\n",
+		"                        (default)\n",
+		"  -dump-format json     {\"bands\": [...]}, the statistics of every band with\n",
+		"                        its bins as bin, value, lo, hi and count arrays\n",
+		"  -dump-empty           Also write the bins without pixels\n",
+		"  -dump-bins <n>        Merge the bins into n between the band min and max\n",
+		"\n",
+		"-decorrelation rotates the bands to their principal components, equalises\n",
+		"the component variances and rotates back, so the bands become uncorrelated;\n",
+		"each is then stretched to <target_avg> and <target_stddev> like\n",
+		"-linear-stretch.  Used on 3-band composites to exaggerate colour differences.\n",
+		"\n",
+		"-clahe equalizes every tile on its own and blends the neighbouring tiles:\n",
+		"  -clahe-tile <n>   Tile edge in pixels (default 256)\n",
+		"  -clahe-clip <c>   Clip the tile histograms at c times their mean bin\n",
+		"                    count, 1 for no enhancement (default 4)\n",
+		"\n",
+		"Georeferencing and metadata are copied from the source unless disabled:\n",
+		"  -nogt             Do not copy the geotransform\n",
+		"  -nosrs            Do not copy the projection\n",
+		"  -nogcp            Do not copy GCPs\n",
+		"  -norpc            Do not copy the RPC metadata domain\n",
+		"  -noimagery        Do not copy the IMAGERY metadata domain\n",
+		"  -nomd             Do not copy dataset metadata\n",
+		"  -nobandmd         Do not copy band metadata\n",
+		"  -nocolorinterp    Do not copy band colour interpretation\n",
+		"\n",
+		"Examples:\n",
+		"  gdal_contrast_stretch -percentile-range 0.02 0.98 input.tif output.tif\n",
+		"  gdal_contrast_stretch -linear-stretch 128 40 input.tif output.tif\n",
+		"  gdal_contrast_stretch -minmax -transfer gamma -gamma 2.2 input.tif output.tif\n",
+		"  gdal_contrast_stretch -percentile-range 0.02 0.98 -transfer sigmoid -gain 8 input.tif output.tif\n",
+		"  gdal_contrast_stretch -histeq 40 input.tif output.tif\n",
+		"  gdal_contrast_stretch -histeq 0 input.tif equalised.tif\n",
+		"  gdal_contrast_stretch -histeq 0 -histeq-avg 60 -histeq-target rayleigh input.tif output.tif\n",
+		"  gdal_contrast_stretch -histeq 0 -histeq-target look.csv input.tif output.tif\n",
+		"  gdal_contrast_stretch -ot UInt16 -outrange 4096 -percentile-range 0.02 0.98 input.tif hdr.tif\n",
+		"  gdal_contrast_stretch -ot Float32 -percentile-range 0.02 0.98 input.tif normalised.tif\n",
+		"  gdal_contrast_stretch -b 4 -b 3 -b 2 -percentile-range 0.02 0.98 s2.tif false_colour.tif\n",
+		"  gdal_contrast_stretch -b 3 -b 2 -b 1 -percentile-range '0.01 0.02 0.02' '0.995 0.98 0.98' s2.tif true_colour.tif\n",
+		"  gdal_contrast_stretch -b 3 -b 2 -b 1 -link all -percentile-range 0.02 0.98 s2.tif true_colour.tif\n",
+		"  gdal_contrast_stretch -co TILED=YES -co COMPRESS=DEFLATE -co BIGTIFF=IF_SAFER -percentile-range 0.02 0.98 input.tif output.tif\n",
+		"  gdal_contrast_stretch -of PNG -percentile-range 0.02 0.98 input.tif output.png\n",
+		"  gdal_contrast_stretch -match neighbour_stretched.tif input.tif output.tif\n",
+		"  gdal_contrast_stretch -percentile-range 0.02 0.98 -save-params look.json 2020.tif 2020_out.tif\n",
+		"  gdal_contrast_stretch -apply look.json 2021.tif 2021_out.tif\n",
+		"  gdal_contrast_stretch -b 7 -b 4 -b 2 -decorrelation 128 40 landsat.tif dstretch.tif\n",
+		"  gdal_contrast_stretch -clahe -clahe-tile 128 -clahe-clip 3 input.tif output.tif\n",
+		"  gdal_contrast_stretch -dump-histogram input.tif\n",
+		"  gdal_contrast_stretch -dump-histogram -dump-format json -dump-bins 256 input.tif histogram.json\n",
+		"  gdal_contrast_stretch -pam -percentile-range 0.01 0.99 input.tif output.tif\n",
+		"  gdal_contrast_stretch -approx -percentile-range 0.02 0.98 scene.tif output.tif\n",
+		"  gdal_contrast_stretch -stats-from 'tiles/*.tif' -percentile-range 0.02 0.98 -save-params mosaic.json tiles/a.tif out/a.tif\n",
+		"  gdal_contrast_stretch -apply mosaic.json -batch 'out/{stem}_8bit.tif' -jobs 4 -skip-existing -continue-on-error tiles/\n",
+		"\n",
+		"Modes available to -mode: ", strings.Join(stretch.Stretchers(), ", "), "\n",
+	)
+	os.Exit(1)
+}
+
+// parseRangeByBand parses the argument of -ndv and -valid-range.  Each
+// whitespace separated word applies to one band and is either a single
+// value or a min..max range.
+func parseRangeByBand(s string) ([][2]float64, error) {
+	var ranges [][2]float64
+	for _, word := range strings.Fields(s) {
+		var (
+			r   [2]float64
+			err error
+		)
+		if parts := strings.SplitN(word, "..", 2); len(parts) == 2 {
+			if r[0], err = strconv.ParseFloat(parts[0], 64); err != nil {
+				return nil, err
+			}
+			if r[1], err = strconv.ParseFloat(parts[1], 64); err != nil {
+				return nil, err
+			}
+		} else {
+			if r[0], err = strconv.ParseFloat(word, 64); err != nil {
+				return nil, err
+			}
+			r[1] = r[0]
+		}
+		if r[0] > r[1] {
+			return nil, fmt.Errorf("range %q is empty", word)
+		}
+		ranges = append(ranges, r)
+	}
+	if len(ranges) == 0 {
+		return nil, fmt.Errorf("empty range list")
+	}
+	return ranges, nil
+}
+
+// parseArgs parses the command line into the options and, with -batch,
+// into batch.
+func parseArgs(args []string, batch *stretch.BatchOptions) (*stretch.Options, error) {
+	opt := &stretch.Options{}
+	var positional []string
+
+	for argp := 0; argp < len(args); argp++ {
+		arg := args[argp]
+		// next returns the n-th parameter following the current flag.
+		next := func(n int) ([]string, error) {
+			if argp+n >= len(args) {
+				return nil, fmt.Errorf("%s requires %d argument(s)", arg, n)
+			}
+			params := args[argp+1 : argp+1+n]
+			argp += n
+			return params, nil
+		}
+		parseFloats := func(params []string) ([]float64, error) {
+			vals := make([]float64, len(params))
+			for i, p := range params {
+				v, err := strconv.ParseFloat(p, 64)
+				if err != nil {
+					return nil, fmt.Errorf("%s: %v", arg, err)
+				}
+				vals[i] = v
+			}
+			return vals, nil
+		}
+		// setMode selects the stretch mode, which only one flag may do.
+		setMode := func(mode string) error {
+			if len(opt.Mode) > 0 && opt.Mode != mode {
+				return fmt.Errorf("%s: mode %s already selected", arg, opt.Mode)
+			}
+			opt.Mode = mode
+			return nil
+		}
+
+		if len(arg) < 2 || arg[0] != '-' {
+			positional = append(positional, arg)
+			continue
+		}
+		switch arg {
+		case "-h", "-help", "--help":
+			usage()
+		case "-of":
+			params, err := next(1)
+			if err != nil {
+				return nil, err
+			}
+			opt.OutputFormat = params[0]
+		case "-batch", "-report":
+			params, err := next(1)
+			if err != nil {
+				return nil, err
+			}
+			if arg == "-batch" {
+				batch.Output = params[0]
+			} else {
+				batch.ReportFn = params[0]
+			}
+		case "-jobs":
+			params, err := next(1)
+			if err != nil {
+				return nil, err
+			}
+			batch.Jobs, err = strconv.Atoi(params[0])
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", arg, err)
+			}
+		case "-skip-existing":
+			batch.SkipExisting = true
+		case "-continue-on-error":
+			batch.ContinueOnError = true
+		case "-approx":
+			opt.Approx = true
+		case "-sample-step":
+			params, err := next(1)
+			if err != nil {
+				return nil, err
+			}
+			opt.SampleStep, err = strconv.Atoi(params[0])
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", arg, err)
+			}
+		case "-workers":
+			params, err := next(1)
+			if err != nil {
+				return nil, err
+			}
+			opt.Workers, err = strconv.Atoi(params[0])
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", arg, err)
+			}
+		case "-float-bins":
+			params, err := next(1)
+			if err != nil {
+				return nil, err
+			}
+			switch params[0] {
+			case "linear":
+				opt.FloatBinning = stretch.FloatBinsLinear
+			case "log":
+				opt.FloatBinning = stretch.FloatBinsLog
+			default:
+				return nil, fmt.Errorf("%s: expected linear or log, got %s", arg, params[0])
+			}
+		case "-stats":
+			params, err := next(1)
+			if err != nil {
+				return nil, err
+			}
+			switch params[0] {
+			case "histogram":
+				opt.Stats = stretch.StatsHistogram
+			case "tdigest":
+				opt.Stats = stretch.StatsTDigest
+			default:
+				return nil, fmt.Errorf("%s: expected histogram or tdigest, got %s", arg, params[0])
+			}
+		case "-tdigest-compression":
+			params, err := next(1)
+			if err != nil {
+				return nil, err
+			}
+			opt.Compression, err = strconv.ParseFloat(params[0], 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", arg, err)
+			}
+		case "-link":
+			params, err := next(1)
+			if err != nil {
+				return nil, err
+			}
+			switch params[0] {
+			case "all":
+				opt.Link = stretch.LinkAll
+			case "luminance":
+				opt.Link = stretch.LinkLuminance
+			default:
+				return nil, fmt.Errorf("%s: expected all or luminance, got %s", arg, params[0])
+			}
+		case "-luma-weights":
+			params, err := next(1)
+			if err != nil {
+				return nil, err
+			}
+			opt.LumaWeights, err = parseFloats(strings.Fields(params[0]))
+			if err != nil {
+				return nil, err
+			}
+		case "-histogram-memory":
+			params, err := next(1)
+			if err != nil {
+				return nil, err
+			}
+			mib, err := strconv.Atoi(params[0])
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", arg, err)
+			}
+			opt.HistogramMemory = mib << 20
+		case "-stats-from":
+			params, err := next(1)
+			if err != nil {
+				return nil, err
+			}
+			opt.StatsFns = append(opt.StatsFns, params[0])
+		case "-co":
+			params, err := next(1)
+			if err != nil {
+				return nil, err
+			}
+			if !strings.Contains(params[0], "=") {
+				return nil, fmt.Errorf("%s: expected KEY=VALUE, got %s", arg, params[0])
+			}
+			opt.CreationOptions = append(opt.CreationOptions, params[0])
+		case "-mode":
+			params, err := next(1)
+			if err != nil {
+				return nil, err
+			}
+			if err := setMode(params[0]); err != nil {
+				return nil, err
+			}
+		case "-mode-opt":
+			params, err := next(1)
+			if err != nil {
+				return nil, err
+			}
+			if !strings.Contains(params[0], "=") {
+				return nil, fmt.Errorf("%s: expected KEY=VALUE, got %s", arg, params[0])
+			}
+			opt.ModeOptions = append(opt.ModeOptions, params[0])
+		case "-outndv":
+			params, err := next(1)
+			if err != nil {
+				return nil, err
+			}
+			opt.OutNdv, err = strconv.ParseFloat(params[0], 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", arg, err)
+			}
+		case "-ot":
+			params, err := next(1)
+			if err != nil {
+				return nil, err
+			}
+			dt, ok := outputTypes[strings.ToLower(params[0])]
+			if !ok {
+				return nil, fmt.Errorf("%s: unsupported output type %s", arg, params[0])
+			}
+			opt.OutputType = dt
+		case "-outrange":
+			params, err := next(1)
+			if err != nil {
+				return nil, err
+			}
+			opt.OutputRange, err = strconv.Atoi(params[0])
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", arg, err)
+			}
+		case "-b":
+			params, err := next(1)
+			if err != nil {
+				return nil, err
+			}
+			band_id, err := strconv.Atoi(params[0])
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", arg, err)
+			}
+			opt.Bands = append(opt.Bands, band_id)
+		case "-ndv", "-valid-range":
+			params, err := next(1)
+			if err != nil {
+				return nil, err
+			}
+			ranges, err := parseRangeByBand(params[0])
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", arg, err)
+			}
+			if arg == "-ndv" {
+				opt.Ndv = ranges
+			} else {
+				opt.ValidRange = ranges
+			}
+		case "-linear-stretch":
+			params, err := next(2)
+			if err != nil {
+				return nil, err
+			}
+			vals, err := parseFloats(params)
+			if err != nil {
+				return nil, err
+			}
+			if err := setMode("stddev"); err != nil {
+				return nil, err
+			}
+			opt.DstAvg = vals[0]
+			opt.DstStddev = vals[1]
+		case "-decorrelation":
+			params, err := next(2)
+			if err != nil {
+				return nil, err
+			}
+			vals, err := parseFloats(params)
+			if err != nil {
+				return nil, err
+			}
+			if err := setMode("decorrelation"); err != nil {
+				return nil, err
+			}
+			opt.DstAvg = vals[0]
+			opt.DstStddev = vals[1]
+		case "-percentile-range":
+			params, err := next(2)
+			if err != nil {
+				return nil, err
+			}
+			from, err := parseFloats(strings.Fields(params[0]))
+			if err != nil {
+				return nil, err
+			}
+			to, err := parseFloats(strings.Fields(params[1]))
+			if err != nil {
+				return nil, err
+			}
+			if err := setMode("percentile"); err != nil {
+				return nil, err
+			}
+			opt.FromPercentile = from
+			opt.ToPercentile = to
+		case "-histeq":
+			params, err := next(1)
+			if err != nil {
+				return nil, err
+			}
+			vals, err := parseFloats(params)
+			if err != nil {
+				return nil, err
+			}
+			if err := setMode("histeq"); err != nil {
+				return nil, err
+			}
+			opt.DstStddev = vals[0]
+		case "-histeq-avg":
+			params, err := next(1)
+			if err != nil {
+				return nil, err
+			}
+			vals, err := parseFloats(params)
+			if err != nil {
+				return nil, err
+			}
+			opt.DstAvg = vals[0]
+			opt.DstAvgSet = true
+		case "-histeq-target":
+			params, err := next(1)
+			if err != nil {
+				return nil, err
+			}
+			switch strings.ToLower(filepath.Ext(params[0])) {
+			case ".csv", ".json":
+				opt.Target = stretch.TargetFile
+				opt.TargetFn = params[0]
+			default:
+				opt.Target, err = stretch.ParseTargetShape(params[0])
+				if err != nil {
+					return nil, fmt.Errorf("%s: %v", arg, err)
+				}
+			}
+		case "-match":
+			params, err := next(1)
+			if err != nil {
+				return nil, err
+			}
+			if err := setMode("match"); err != nil {
+				return nil, err
+			}
+			opt.RefFn = params[0]
+		case "-minmax":
+			if err := setMode("minmax"); err != nil {
+				return nil, err
+			}
+		case "-clahe":
+			if err := setMode("clahe"); err != nil {
+				return nil, err
+			}
+		case "-pam":
+			opt.Pam = true
+		case "-histogram-cache":
+			params, err := next(1)
+			if err != nil {
+				return nil, err
+			}
+			opt.HistogramCache = params[0]
+		case "-apply", "-save-params":
+			params, err := next(1)
+			if err != nil {
+				return nil, err
+			}
+			switch arg {
+			case "-apply":
+				opt.ApplyFn = params[0]
+			case "-save-params":
+				opt.SaveParams = params[0]
+			}
+		case "-clahe-tile":
+			params, err := next(1)
+			if err != nil {
+				return nil, err
+			}
+			opt.ClaheTile, err = strconv.Atoi(params[0])
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", arg, err)
+			}
+		case "-clahe-clip":
+			params, err := next(1)
+			if err != nil {
+				return nil, err
+			}
+			vals, err := parseFloats(params)
+			if err != nil {
+				return nil, err
+			}
+			opt.ClaheClip = vals[0]
+		case "-transfer":
+			params, err := next(1)
+			if err != nil {
+				return nil, err
+			}
+			opt.Transfer, err = stretch.ParseTransferFunc(params[0])
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", arg, err)
+			}
+		case "-gamma", "-gain", "-midpoint":
+			params, err := next(1)
+			if err != nil {
+				return nil, err
+			}
+			vals, err := parseFloats(params)
+			if err != nil {
+				return nil, err
+			}
+			switch arg {
+			case "-gamma":
+				opt.Gamma = vals[0]
+			case "-gain":
+				opt.Gain = vals[0]
+			case "-midpoint":
+				opt.Midpoint = vals[0]
+				opt.MidpointSet = true
+			}
+		case "-dump-histogram":
+			opt.DumpHistogram = true
+		case "-dump-format":
+			params, err := next(1)
+			if err != nil {
+				return nil, err
+			}
+			switch params[0] {
+			case "csv":
+				opt.DumpFormat = stretch.DumpCSV
+			case "json":
+				opt.DumpFormat = stretch.DumpJSON
+			default:
+				return nil, fmt.Errorf("%s: expected csv or json, got %s", arg, params[0])
+			}
+		case "-dump-empty":
+			opt.DumpEmptyBins = true
+		case "-dump-bins":
+			params, err := next(1)
+			if err != nil {
+				return nil, err
+			}
+			opt.DumpBins, err = strconv.Atoi(params[0])
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", arg, err)
+			}
+		case "-alpha":
+			opt.Mask = stretch.MaskAlpha
+		case "-mask":
+			opt.Mask = stretch.MaskInternal
+		case "-nogt":
+			opt.NoGeoTransform = true
+		case "-nosrs":
+			opt.NoProjection = true
+		case "-nogcp":
+			opt.NoGCPs = true
+		case "-norpc":
+			opt.NoRPC = true
+		case "-noimagery":
+			opt.NoImagery = true
+		case "-nomd":
+			opt.NoMetadata = true
+		case "-nobandmd":
+			opt.NoBandMetadata = true
+		case "-nocolorinterp":
+			opt.NoColorInterp = true
+		default:
+			return nil, fmt.Errorf("unrecognized option: %s", arg)
+		}
+	}
+
+	if len(batch.Output) > 0 {
+		if len(positional) == 0 {
+			return nil, fmt.Errorf("expected <dir|glob|@list>...")
+		}
+		batch.Inputs = positional
+		return opt, nil
+	}
+	switch len(positional) {
+	case 2:
+		opt.DstFn = positional[1]
+		fallthrough
+	case 1:
+		opt.SrcFn = positional[0]
+	default:
+		return nil, fmt.Errorf("expected <src.tif> [<dst.tif>]")
+	}
+	return opt, nil
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	var batch stretch.BatchOptions
+	opt, err := parseArgs(os.Args[1:], &batch)
+	if err != nil {
+		log.Print(err)
+		usage()
+	}
+	if len(batch.Output) > 0 {
+		// every failure is logged and in the report, this only sets the exit status
+		if _, err := stretch.RunBatch(opt, &batch); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if err := stretch.Run(opt); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,290 @@
+package stretch
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BatchOptions describes the sources and outputs of RunBatch.
+type BatchOptions struct {
+	Inputs          []string //<dir|glob|@list>...; directories for their .tif/.tiff files, file names, globs or @lists
+	Output          string   //-batch; output name template, see batch_dst_fn
+	Jobs            int      //-jobs; sources stretched at once, 1 if unset
+	SkipExisting    bool     //-skip-existing; leave the sources whose output exists
+	ContinueOnError bool     //-continue-on-error; otherwise no source is started after a failure
+	ReportFn        string   //-report; JSON summary of every source, see BatchReport
+}
+
+// BatchResult is the outcome of one source of a batch.
+type BatchResult struct {
+	SrcFn, DstFn string
+	// Skipped is set if the output existed.
+	Skipped bool
+	// Err is nil if the source was stretched or skipped, ErrBatchStopped
+	// if it was not started after another source failed.
+	Err      error
+	Duration time.Duration
+}
+
+func (self *BatchResult) status() string {
+	switch {
+	case self.Skipped:
+		return "skipped"
+	case self.Err == ErrBatchStopped:
+		return "not run"
+	case self.Err != nil:
+		return "failed"
+	}
+	return "done"
+}
+
+// BatchReport is the JSON summary written to BatchOptions.ReportFn.
+type BatchReport struct {
+	Done    int                `json:"done"`
+	Skipped int                `json:"skipped"`
+	Failed  int                `json:"failed"`
+	NotRun  int                `json:"not_run"`
+	Files   []BatchReportEntry `json:"files"`
+}
+
+// BatchReportEntry is the BatchResult of one source.  Status is done,
+// skipped, failed or not run.
+type BatchReportEntry struct {
+	Src     string  `json:"src"`
+	Dst     string  `json:"dst"`
+	Status  string  `json:"status"`
+	Error   string  `json:"error,omitempty"`
+	Seconds float64 `json:"seconds"`
+}
+
+func new_batch_report(results []BatchResult) *BatchReport {
+	report := &BatchReport{Files: make([]BatchReportEntry, len(results))}
+	for i := range results {
+		res := &results[i]
+		entry := &report.Files[i]
+		*entry = BatchReportEntry{Src: res.SrcFn, Dst: res.DstFn, Status: res.status(), Seconds: res.Duration.Seconds()}
+		switch entry.Status {
+		case "done":
+			report.Done++
+		case "skipped":
+			report.Skipped++
+		case "not run":
+			report.NotRun++
+		case "failed":
+			report.Failed++
+			entry.Error = res.Err.Error()
+		}
+	}
+	return report
+}
+
+// batch_dst_fn fills in the output template for src_fn: {dir} is its
+// directory, {name} its file name, {stem} the name without extension and
+// {ext} the extension with its dot.
+func batch_dst_fn(template, src_fn string) string {
+	name := filepath.Base(src_fn)
+	ext := filepath.Ext(name)
+	return strings.NewReplacer(
+		"{dir}", filepath.Dir(src_fn),
+		"{name}", name,
+		"{stem}", strings.TrimSuffix(name, ext),
+		"{ext}", ext,
+	).Replace(template)
+}
+
+// batch_fns returns the sources of batch and their outputs.  Sources that
+// are the output of another source, e.g. of an earlier run writing next
+// to them, are left out.
+func batch_fns(batch *BatchOptions) (src_fns, dst_fns []string, err error) {
+	all, err := expand_fns(batch.Inputs)
+	if err != nil {
+		return nil, nil, err
+	}
+	outputs := map[string]string{}
+	for _, src_fn := range all {
+		dst_fn := batch_dst_fn(batch.Output, src_fn)
+		if filepath.Clean(dst_fn) == filepath.Clean(src_fn) {
+			return nil, nil, fmt.Errorf("%w: output template %s overwrites %s", ErrBadArgs, batch.Output, src_fn)
+		}
+		if other, ok := outputs[filepath.Clean(dst_fn)]; ok {
+			return nil, nil, fmt.Errorf("%w: %s and %s both write %s", ErrBadArgs, other, src_fn, dst_fn)
+		}
+		outputs[filepath.Clean(dst_fn)] = src_fn
+	}
+	for _, src_fn := range all {
+		if _, ok := outputs[filepath.Clean(src_fn)]; ok {
+			log.Printf("%s is an output of this batch, not a source\n", src_fn)
+			continue
+		}
+		src_fns = append(src_fns, src_fn)
+		dst_fns = append(dst_fns, batch_dst_fn(batch.Output, src_fn))
+	}
+	if len(src_fns) == 0 {
+		return nil, nil, fmt.Errorf("%w: no sources", ErrBadArgs)
+	}
+	return src_fns, dst_fns, nil
+}
+
+// RunBatch stretches every source of batch into the output named by
+// batch.Output, as described by opt apart from its SrcFn and DstFn.  Up to
+// batch.Jobs sources are stretched at once, each with opt.Workers block
+// workers.  It returns the result of every source in order, and an error
+// wrapping ErrBatchFailed if any failed.  opt is checked once beforehand;
+// errors in it fail the whole batch without results.  The histograms of
+// opt.StatsFns are merged once, before any source is started.
+func RunBatch(opt *Options, batch *BatchOptions) ([]BatchResult, error) {
+	if len(batch.Output) == 0 {
+		return nil, ErrMissingDstFn
+	}
+	if batch.Jobs < 0 {
+		return nil, fmt.Errorf("%w: negative -jobs", ErrBadArgs)
+	}
+	src_fns, dst_fns, err := batch_fns(batch)
+	if err != nil {
+		return nil, err
+	}
+	if opt.DumpHistogram {
+		return nil, fmt.Errorf("%w: -dump-histogram does not apply to a batch", ErrBadArgs)
+	}
+	for _, tmpl := range []struct{ flag, template string }{
+		{"-save-params", opt.SaveParams},
+		{"-histogram-cache", opt.HistogramCache},
+	} {
+		if err := check_batch_template(tmpl.flag, tmpl.template, src_fns); err != nil {
+			return nil, err
+		}
+	}
+	check := *opt
+	check.SrcFn, check.DstFn = src_fns[0], dst_fns[0]
+	if err := check.handle(); err != nil {
+		return nil, err
+	}
+	if len(opt.StatsFns) > 0 {
+		// merged once, then stretched with by every source
+		mosaic, err := new_mosaic_stats(&check)
+		if err != nil {
+			return nil, err
+		}
+		batch_opt := *opt
+		batch_opt.mosaic = mosaic
+		opt = &batch_opt
+	}
+
+	results := make([]BatchResult, len(src_fns))
+	for i := range results {
+		results[i] = BatchResult{SrcFn: src_fns[i], DstFn: dst_fns[i], Err: ErrBatchStopped}
+	}
+	workers := batch.Jobs
+	if workers < 1 {
+		workers = 1
+	}
+	jobs := make(chan int)
+	done := make(chan struct{})
+	var (
+		wg   sync.WaitGroup
+		once sync.Once
+	)
+	for worker := 0; worker < workers; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				select {
+				case <-done:
+					// handed out as another source failed
+					continue
+				default:
+				}
+				res := &results[i]
+				start := time.Now()
+				res.Err = run_batch_file(opt, batch, res)
+				res.Duration = time.Since(start)
+				log.Printf("[%d/%d] %s -> %s: %s %.1fs\n", i+1, len(results), res.SrcFn, res.DstFn, res.status(), res.Duration.Seconds())
+				if res.Err != nil {
+					log.Printf("%s: %v\n", res.SrcFn, res.Err)
+					if !batch.ContinueOnError {
+						once.Do(func() { close(done) })
+					}
+				}
+			}
+		}()
+	}
+
+feed:
+	for i := range results {
+		select {
+		case jobs <- i:
+		case <-done:
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	report := new_batch_report(results)
+	log.Printf("batch: %d done, %d skipped, %d failed, %d not run\n", report.Done, report.Skipped, report.Failed, report.NotRun)
+	if len(batch.ReportFn) > 0 {
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return results, err
+		}
+		if err := os.WriteFile(batch.ReportFn, append(data, '\n'), 0644); err != nil {
+			return results, err
+		}
+	}
+	if report.Failed > 0 {
+		return results, fmt.Errorf("%w: %d of %d sources", ErrBatchFailed, report.Failed, len(results))
+	}
+	return results, nil
+}
+
+// check_batch_template makes sure the file name template of flag, filled
+// in like the output template, names a file of its own for every source.
+func check_batch_template(flag, template string, src_fns []string) error {
+	if len(template) == 0 {
+		return nil
+	}
+	fns := map[string]string{}
+	for _, src_fn := range src_fns {
+		fn := filepath.Clean(batch_dst_fn(template, src_fn))
+		if other, ok := fns[fn]; ok {
+			return fmt.Errorf("%w: %s %s names %s for both %s and %s, use {stem}", ErrBadArgs, flag, template, fn, other, src_fn)
+		}
+		fns[fn] = src_fn
+	}
+	return nil
+}
+
+// run_batch_file stretches one source of a batch, creating the directory
+// of its output if needed.  SaveParams and HistogramCache are templates
+// like the output.  With several jobs the progress messages name the
+// source.
+func run_batch_file(opt *Options, batch *BatchOptions, res *BatchResult) error {
+	if batch.SkipExisting {
+		if _, err := os.Stat(res.DstFn); err == nil {
+			res.Skipped = true
+			return nil
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(res.DstFn), 0755); err != nil {
+		return err
+	}
+	file_opt := *opt
+	file_opt.SrcFn, file_opt.DstFn = res.SrcFn, res.DstFn
+	if len(opt.SaveParams) > 0 {
+		file_opt.SaveParams = batch_dst_fn(opt.SaveParams, res.SrcFn)
+	}
+	if len(opt.HistogramCache) > 0 {
+		file_opt.HistogramCache = batch_dst_fn(opt.HistogramCache, res.SrcFn)
+	}
+	if batch.Jobs > 1 {
+		file_opt.progress_prefix = res.SrcFn
+	}
+	return Run(&file_opt)
+}
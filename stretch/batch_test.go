@@ -0,0 +1,186 @@
+package stretch
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/lukeroth/gdal"
+)
+
+func TestBatchDstFn(t *testing.T) {
+	cases := []struct {
+		template, src_fn, want string
+	}{
+		{"{dir}/{stem}_8bit{ext}", "in/a.tif", "in/a_8bit.tif"},
+		{"out/{name}", "in/a.tif", "out/a.tif"},
+		{"out/{stem}.png", "/data/scene.1.tiff", "out/scene.1.png"},
+		{"out/fixed.tif", "in/a.tif", "out/fixed.tif"},
+	}
+	for _, tc := range cases {
+		if got := batch_dst_fn(tc.template, tc.src_fn); got != tc.want {
+			t.Errorf("%s for %s: got %s, want %s", tc.template, tc.src_fn, got, tc.want)
+		}
+	}
+}
+
+// batch_sources writes the rasters a, b, d and e into dir, with c.tif and
+// a_8bit.tif files that are not rasters.
+func batch_sources(t *testing.T, dir string) {
+	for i, name := range []string{"a", "b", "d", "e"} {
+		write_test_raster(t, filepath.Join(dir, name+".tif"), test_tiles, 60, 40, 1, gdal.UInt16, func(b, x, y int) float64 { return float64(x*y + i) })
+	}
+	for _, name := range []string{"c.tif", "a_8bit.tif", "notes.txt"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestBatch(t *testing.T) {
+	dir := t.TempDir()
+	batch_sources(t, dir)
+	opt := Options{Mode: "percentile", FromPercentile: []float64{0.02}, ToPercentile: []float64{0.98}}
+	report_fn := filepath.Join(dir, "report.json")
+	batch := BatchOptions{Inputs: []string{dir}, Output: "{dir}/{stem}_8bit{ext}", Jobs: 3, SkipExisting: true, ContinueOnError: true, ReportFn: report_fn}
+	results, err := RunBatch(&opt, &batch)
+	if !errors.Is(err, ErrBatchFailed) || len(results) != 5 {
+		t.Fatalf("got %d results and %v, want 5 and %v", len(results), err, ErrBatchFailed)
+	}
+	for _, res := range results {
+		name := filepath.Base(res.SrcFn)
+		if (res.Err != nil) != (name == "c.tif") || res.Skipped != (name == "a.tif") {
+			t.Errorf("%s: skipped %v, error %v", name, res.Skipped, res.Err)
+		}
+	}
+	data, err := os.ReadFile(report_fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report BatchReport
+	if err := json.Unmarshal(data, &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Done != 3 || report.Failed != 1 || report.Skipped != 1 || report.NotRun != 0 {
+		t.Errorf("report: %d done, %d failed, %d skipped, %d not run", report.Done, report.Failed, report.Skipped, report.NotRun)
+	}
+
+	// one job stops at the failure
+	batch = BatchOptions{Inputs: []string{filepath.Join(dir, "[a-e].tif")}, Output: filepath.Join(dir, "out", "{stem}.tif"), Jobs: 1}
+	results, err = RunBatch(&opt, &batch)
+	if !errors.Is(err, ErrBatchFailed) || results[1].Err != nil || !errors.Is(results[3].Err, ErrBatchStopped) {
+		t.Errorf("not stopped after c.tif: %v", err)
+	}
+}
+
+func TestBatchOptions(t *testing.T) {
+	dir := t.TempDir()
+	batch_sources(t, dir)
+	inputs := []string{filepath.Join(dir, "a.tif"), filepath.Join(dir, "b.tif")}
+	pct := Options{Mode: "percentile", FromPercentile: []float64{0.02}, ToPercentile: []float64{0.98}}
+	cases := []struct {
+		name   string
+		opt    func(opt *Options)
+		output string
+	}{
+		{"bad options", func(opt *Options) { opt.Mode = "" }, "out/{stem}.tif"},
+		{"overwriting the sources", func(opt *Options) {}, "{dir}/{name}"},
+		{"one parameter file", func(opt *Options) { opt.SaveParams = filepath.Join(dir, "params.json") }, "out/{stem}.tif"},
+		{"one histogram cache", func(opt *Options) { opt.HistogramCache = filepath.Join(dir, "cache.json") }, "out/{stem}.tif"},
+		{"dumping histograms", func(opt *Options) { opt.Mode, opt.DumpHistogram = "", true }, "out/{stem}.csv"},
+	}
+	for _, tc := range cases {
+		opt := pct
+		tc.opt(&opt)
+		batch := BatchOptions{Inputs: inputs, Output: filepath.Join(dir, tc.output)}
+		if tc.output == "{dir}/{name}" {
+			batch.Output = tc.output
+		}
+		if results, err := RunBatch(&opt, &batch); err == nil || results != nil {
+			t.Errorf("%s: accepted", tc.name)
+		}
+	}
+
+	// templates name one file per source
+	opt := pct
+	opt.SaveParams = filepath.Join(dir, "{stem}.json")
+	opt.HistogramCache = filepath.Join(dir, "{stem}.hist.json")
+	batch := BatchOptions{Inputs: inputs, Output: filepath.Join(dir, "out", "{stem}.tif")}
+	if _, err := RunBatch(&opt, &batch); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.json", "b.json", "a.hist.json", "b.hist.json"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestBatchStatsFrom(t *testing.T) {
+	dir := t.TempDir()
+	var inputs []string
+	for i, name := range []string{"low", "high"} {
+		fn := test_raster(t, name, 50, 20, 1, gdal.UInt16, func(b, x, y int) float64 { return float64(1000*i + 20*x + y) })
+		inputs = append(inputs, fn)
+	}
+	opt := Options{Mode: "minmax", StatsFns: inputs}
+	batch := BatchOptions{Inputs: inputs, Output: filepath.Join(dir, "{stem}.tif"), Jobs: 2}
+	if _, err := RunBatch(&opt, &batch); err != nil {
+		t.Fatal(err)
+	}
+	// both stretched over 0..1999, level 0 being kept for the output NoData
+	for i, name := range []string{"low", "high"} {
+		out := read_test_raster(t, filepath.Join(dir, name+".tif"))
+		min, max := out[0][0], out[0][0]
+		for _, v := range out[0] {
+			if v < min {
+				min = v
+			}
+			if v > max {
+				max = v
+			}
+		}
+		if (i == 0 && (min != 1 || max > 128)) || (i == 1 && (min < 127 || max != 255)) {
+			t.Errorf("%s: stretched to %g..%g", name, min, max)
+		}
+	}
+}
+
+func TestBatchProgress(t *testing.T) {
+	dir := t.TempDir()
+	batch_sources(t, dir)
+	inputs := []string{filepath.Join(dir, "a.tif"), filepath.Join(dir, "b.tif")}
+	stderr, err := os.Create(filepath.Join(dir, "stderr.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stderr.Close()
+	saved := os.Stderr
+	os.Stderr = stderr
+	opt := Options{Mode: "percentile", FromPercentile: []float64{0.02}, ToPercentile: []float64{0.98}}
+	batch := BatchOptions{Inputs: inputs, Output: filepath.Join(dir, "out", "{stem}.tif"), Jobs: 2}
+	_, err = RunBatch(&opt, &batch)
+	os.Stderr = saved
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(stderr.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// every progress line names its source
+	lines := map[string]int{}
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		src_fn := strings.SplitN(line, ": ", 2)[0]
+		if src_fn != inputs[0] && src_fn != inputs[1] {
+			t.Errorf("progress line without its source: %q", line)
+		}
+		lines[src_fn]++
+	}
+	if lines[inputs[0]] == 0 || lines[inputs[1]] == 0 {
+		t.Errorf("progress lines of the sources: %v", lines)
+	}
+}
@@ -0,0 +1,121 @@
+package stretch
+
+import (
+	"math"
+
+	"github.com/lukeroth/gdal"
+)
+
+// FloatBinningMode selects the histogram used for bands that are not
+// 8 or 16 bit integers.  Both keep the counts of all those bands within
+// Options.HistogramMemory bytes per worker.
+type FloatBinningMode int
+
+const (
+	// FloatBinsLinear spreads the bins evenly between the band minimum and
+	// maximum, found by an extra pass.  Cut values are accurate to half a
+	// bin width, (max-min)/(2*(nbins-1)).
+	FloatBinsLinear FloatBinningMode = iota
+	// FloatBinsLog needs no extra pass: the bins cover every float64,
+	// keyed on sign, exponent and the leading mantissa bits, so cut values
+	// are accurate relative to their magnitude (see Binning.RelativeError).
+	// Prefer it for data spanning several orders of magnitude.  Infinite
+	// values are left out of its statistics.
+	FloatBinsLog
+)
+
+const (
+	DefaultHistogramMemory = 8 << 20
+	// enough for the smallest log binning, LogBits = 1
+	min_histogram_memory = 8 << 13
+)
+
+// LinearBinning returns nbins bins evenly covering [min, max].
+func LinearBinning(min, max float64, nbins int) Binning {
+	binning := Binning{Nbins: nbins, Offset: min}
+	binning.Scale = (max - min) / float64(nbins-1)
+	if binning.Scale == 0 {
+		// constant band
+		binning.Scale = 1
+	}
+	return binning
+}
+
+// LogBinning returns the finest log-scale binning with at most max_nbins
+// bins.  The float64 bit pattern of a value, down to LogBits mantissa
+// bits, is its bin number, mirrored for negative values so the bins stay
+// ordered.
+func LogBinning(max_nbins int) Binning {
+	bits := 0
+	for 2<<(11+bits+1) <= max_nbins && bits < 51 {
+		bits++
+	}
+	return Binning{Nbins: 2 << (11 + bits), LogBits: bits}
+}
+
+// RelativeError is the largest error of FromBin(ToBin(v)) relative to v for
+// log-scale bins.
+func (self *Binning) RelativeError() float64 {
+	return math.Ldexp(1, -self.LogBits-1)
+}
+
+func (self *Binning) to_log_bin(v float64) (int, error) {
+	if math.IsNaN(v) {
+		return 0, ErrNanInToBin
+	}
+	half := self.Nbins / 2
+	key := int(math.Float64bits(math.Abs(v)) >> uint(52-self.LogBits))
+	if v < 0 {
+		return half - 1 - key, nil
+	}
+	return half + key, nil
+}
+
+func (self *Binning) from_log_bin(i int) float64 {
+	half := self.Nbins / 2
+	neg := i < half
+	key := i - half
+	if neg {
+		key = half - 1 - i
+	}
+	// middle of the bin
+	shift := uint(52 - self.LogBits)
+	bits := uint64(key)<<shift | 1<<(shift-1)
+	v := math.Float64frombits(bits)
+	if neg {
+		return -v
+	}
+	return v
+}
+
+// counts reports whether v is counted in histograms of this binning.
+// Log-scale binnings leave out infinite values: their end bins decode to
+// NaN, which would spread to the mean, stddev and cut values.  The values
+// still map to the end bins when stretched.
+func (self *Binning) counts(v float64) bool {
+	return self.LogBits == 0 || !math.IsInf(v, 0)
+}
+
+// bin_edges returns the range of values counted in bin i.
+func (self *Binning) bin_edges(i int) (lo, hi float64) {
+	v := self.FromBin(i)
+	half := self.Scale / 2
+	if self.LogBits > 0 {
+		half = math.Abs(v) * self.RelativeError()
+	}
+	return v - half, v + half
+}
+
+// type_binning returns the binning of one bin per value of the 8 and 16-bit
+// data types, or false for the others.
+func type_binning(dt gdal.DataType) (Binning, bool) {
+	switch dt {
+	case gdal.Byte:
+		return Binning{Nbins: 256, Offset: 0, Scale: 1}, true
+	case gdal.UInt16:
+		return Binning{Nbins: 65536, Offset: 0, Scale: 1}, true
+	case gdal.Int16:
+		return Binning{Nbins: 65536, Offset: -32768, Scale: 1}, true
+	}
+	return Binning{}, false
+}
@@ -0,0 +1,143 @@
+package stretch
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/lukeroth/gdal"
+)
+
+func TestLogBinning(t *testing.T) {
+	cases := []struct {
+		max_nbins, bits, nbins int
+	}{
+		{8192, 1, 8192},
+		{16383, 1, 8192},
+		{DefaultHistogramMemory / 8, 8, 1 << 20},
+		{1 << 30, 18, 1 << 30},
+	}
+	for _, tc := range cases {
+		binning := LogBinning(tc.max_nbins)
+		if binning.LogBits != tc.bits || binning.Nbins != tc.nbins {
+			t.Errorf("%d bins: got %d bins of %d bits, want %d of %d", tc.max_nbins, binning.Nbins, binning.LogBits, tc.nbins, tc.bits)
+		}
+		if want := math.Ldexp(1, -tc.bits-1); binning.RelativeError() != want {
+			t.Errorf("%d bins: relative error %g, want %g", tc.max_nbins, binning.RelativeError(), want)
+		}
+	}
+}
+
+func TestLogBinningRoundTrip(t *testing.T) {
+	values := []float64{-math.MaxFloat64, -2.5e10, -1, -1e-300, 0, 1e-300, 0.001, 1, math.Pi, 65535.5, 1e300, math.MaxFloat64}
+	for _, max_nbins := range []int{8192, DefaultHistogramMemory / 8} {
+		binning := LogBinning(max_nbins)
+		var bins []int
+		for _, v := range values {
+			bin, err := binning.ToBin(v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			bins = append(bins, bin)
+			// zero shares the bin of the subnormals, which are only
+			// accurate to the smallest normal value
+			tol := math.Max(binning.RelativeError()*math.Abs(v), 0x1p-1022)
+			got := binning.FromBin(bin)
+			if math.Abs(got-v) > tol {
+				t.Errorf("%d bits: %g comes back as %g", binning.LogBits, v, got)
+			}
+			if lo, hi := binning.bin_edges(bin); v < lo-tol || v > hi+tol {
+				t.Errorf("%d bits: %g outside its bin %g..%g", binning.LogBits, v, lo, hi)
+			}
+		}
+		if !sort.IntsAreSorted(bins) {
+			t.Errorf("%d bits: bins out of value order: %v", binning.LogBits, bins)
+		}
+		r := rand.New(rand.NewSource(2))
+		for i := 0; i < 100000; i++ {
+			v := r.NormFloat64() * math.Pow(10, float64(r.Intn(20)-10))
+			bin, err := binning.ToBin(v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := binning.FromBin(bin); math.Abs(got-v) > binning.RelativeError()*math.Abs(v) {
+				t.Fatalf("%d bits: %g comes back as %g", binning.LogBits, v, got)
+			}
+		}
+	}
+}
+
+func TestLogHistogramInf(t *testing.T) {
+	// every 10th pixel +Inf or -Inf, the others 1..100
+	value := func(b, x, y int) float64 {
+		switch {
+		case x%20 == 0:
+			return math.Inf(1)
+		case x%20 == 10:
+			return math.Inf(-1)
+		}
+		return float64(x%100 + 1)
+	}
+	fn := test_raster(t, "inf", 200, 50, 1, gdal.Float32, value)
+	ds, err := gdal.Open(fn, gdal.ReadOnly)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+	binnings := []Binning{LogBinning(DefaultHistogramMemory / 8)}
+	histograms, err := ComputeHistogram([]gdal.RasterBand{ds.RasterBand(1)}, &NdvDef{}, 200, 50, binnings, &ScanOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hg := &histograms[0]
+	if hg.DataCount != 9000 || hg.Min != 2 || hg.Max != 100 {
+		t.Errorf("got %d values within %g..%g, want the 9000 finite ones within 2..100", hg.DataCount, hg.Min, hg.Max)
+	}
+	if math.Abs(hg.Mean-51) > 0.2 || math.IsNaN(hg.Stddev) {
+		t.Errorf("got %g+/-%g, want a mean of 51", hg.Mean, hg.Stddev)
+	}
+	for _, q := range []float64{0, 0.5, 1} {
+		if v, err := hg.Quantile(q); err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+			t.Errorf("quantile %g: got %g, %v", q, v, err)
+		}
+	}
+
+	// the infinite pixels still stretch to the end levels
+	opt := Options{SrcFn: fn, DstFn: filepath.Join(t.TempDir(), "out.tif"), Mode: "stddev", DstAvg: 127, DstStddev: 40, FloatBinning: FloatBinsLog}
+	if err := Run(&opt); err != nil {
+		t.Fatal(err)
+	}
+	out := read_test_raster(t, opt.DstFn)
+	if out[0][0] != 255 || out[0][10] > 1 {
+		t.Errorf("+Inf and -Inf stretched to %g and %g", out[0][0], out[0][10])
+	}
+}
+
+func TestHistogramMemory(t *testing.T) {
+	dst_fn := filepath.Join(t.TempDir(), "out.tif")
+	cases := []struct {
+		nb     int
+		dt     gdal.DataType
+		memory int
+		want   error
+	}{
+		{2, gdal.Float32, 2 * min_histogram_memory, nil},
+		// shared by the bands
+		{3, gdal.Float32, 2 * min_histogram_memory, ErrBadArgs},
+		// one bin per value instead
+		{3, gdal.UInt16, min_histogram_memory, nil},
+		{1, gdal.Float64, min_histogram_memory - 1, ErrBadArgs},
+	}
+	for _, tc := range cases {
+		src_fn := test_raster(t, "mem", 64, 32, tc.nb, tc.dt, func(b, x, y int) float64 { return float64(x * y) })
+		for _, bins := range []FloatBinningMode{FloatBinsLinear, FloatBinsLog} {
+			opt := Options{SrcFn: src_fn, DstFn: dst_fn, Mode: "stddev", DstAvg: 127, DstStddev: 40, FloatBinning: bins, HistogramMemory: tc.memory}
+			if err := Run(&opt); !errors.Is(err, tc.want) {
+				t.Errorf("%d %s bands, %d bytes, bins %d: got %v, want %v", tc.nb, tc.dt.Name(), tc.memory, bins, err, tc.want)
+			}
+		}
+	}
+}
@@ -0,0 +1,427 @@
+package stretch
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sync"
+
+	"github.com/lukeroth/gdal"
+)
+
+// ScanOptions controls how the passes over the source raster are run.
+// Approx and SampleStep only apply to the statistics, not to the output.
+type ScanOptions struct {
+	Workers    int  //-workers; blocks processed concurrently, serial if <= 1 or if GDAL cannot reopen the source by name
+	Approx     bool //-approx; read the coarsest overview whose pixels are no more than SampleStep apart, of about 4M pixels if unset
+	SampleStep int  //-sample-step; read every SampleStep-th row and column only, all if <= 1
+}
+
+// approx_samples is the number of pixels Approx aims for without a
+// SampleStep.
+const approx_samples = 4 << 20
+
+// sampling is the part of the source a pass reads: the pixels of overview
+// level overview, or of the full resolution if it is -1, on the rows and
+// columns that are multiples of step.
+type sampling struct {
+	overview int
+	step     int
+}
+
+var full_sampling = sampling{overview: -1, step: 1}
+
+// scan_sampling returns the sampling of scan for src_bands of w x h pixels.
+// Approx falls back to the full resolution if no overview is fine enough
+// or the bands differ in their overviews.
+func scan_sampling(src_bands []gdal.RasterBand, w, h int, scan *ScanOptions) sampling {
+	smp := full_sampling
+	if scan == nil {
+		return smp
+	}
+	step := math.Max(1, float64(scan.SampleStep))
+	if scan.Approx {
+		if scan.SampleStep <= 1 {
+			step = math.Max(1, math.Sqrt(float64(w)*float64(h)/approx_samples))
+		}
+		factor := 1.0
+	levels:
+		for level := 0; level < src_bands[0].OverviewCount(); level++ {
+			ovr := src_bands[0].Overview(level)
+			f := float64(w) / float64(ovr.XSize())
+			// overview sizes are rounded up, e.g. 501 for 1001 / 2
+			if f <= factor || f > step*1.01 {
+				continue
+			}
+			for _, band := range src_bands[1:] {
+				if band.OverviewCount() <= level || band.Overview(level).XSize() != ovr.XSize() || band.Overview(level).YSize() != ovr.YSize() {
+					continue levels
+				}
+			}
+			smp.overview, factor = level, f
+		}
+		step /= factor
+	}
+	smp.step = int(math.Max(1, math.Round(step)))
+	return smp
+}
+
+// sample_bands returns the bands read with smp.
+func sample_bands(src_bands []gdal.RasterBand, smp sampling) []gdal.RasterBand {
+	if smp.overview < 0 {
+		return src_bands
+	}
+	bands := make([]gdal.RasterBand, len(src_bands))
+	for band_idx, band := range src_bands {
+		bands[band_idx] = band.Overview(smp.overview)
+	}
+	return bands
+}
+
+// block is a window of the raster aligned to the source block size.
+type block struct {
+	off_x, off_y   int
+	size_x, size_y int
+	// position in the pass, row by row
+	idx int
+}
+
+func make_blocks(w, h, blocksize_x, blocksize_y int) []block {
+	return make_blocks_in(w, 0, h, blocksize_x, blocksize_y)
+}
+
+// make_blocks_in returns the blocks of rows y0..y1-1, clipped to them.
+func make_blocks_in(w, y0, y1, blocksize_x, blocksize_y int) []block {
+	var blocks []block
+	for boff_y := y0; boff_y < y1; {
+		// up to the next block boundary
+		bsize_y := blocksize_y - boff_y%blocksize_y
+		if bsize_y+boff_y > y1 {
+			bsize_y = y1 - boff_y
+		}
+		for boff_x := 0; boff_x < w; boff_x += blocksize_x {
+			bsize_x := blocksize_x
+			if bsize_x+boff_x > w {
+				bsize_x = w - boff_x
+			}
+			blocks = append(blocks, block{boff_x, boff_y, bsize_x, bsize_y, len(blocks)})
+		}
+		boff_y += bsize_y
+	}
+	return blocks
+}
+
+// block_reader holds the pixels and the nodata mask of the last block read.
+// With a step the pixels are those of the sampled rows and columns, packed.
+type block_reader struct {
+	bands    []gdal.RasterBand
+	ndv_def  *NdvDef
+	buf_in   [][]float64
+	ndv_mask []uint8
+	n        int
+	step     int
+	row      []float64
+}
+
+func new_block_reader(bands []gdal.RasterBand, ndv_def *NdvDef, block_len int) *block_reader {
+	rd := &block_reader{bands: bands, ndv_def: ndv_def, step: 1}
+	rd.buf_in = make([][]float64, len(bands))
+	for band_idx := range bands {
+		rd.buf_in[band_idx] = make([]float64, block_len)
+	}
+	rd.ndv_mask = make([]uint8, block_len)
+	return rd
+}
+
+func (self *block_reader) read(blk block) error {
+	if self.step > 1 {
+		return self.read_sampled(blk)
+	}
+	self.n = blk.size_x * blk.size_y
+	for band_idx, band := range self.bands {
+		if err := band.IO(gdal.Read, blk.off_x, blk.off_y, blk.size_x, blk.size_y, self.buf_in[band_idx], blk.size_x, blk.size_y, 0, 0); err != nil {
+			return err
+		}
+	}
+	return self.ndv_def.GetNdvMaskC(self.buf_in, self.ndv_mask, self.n)
+}
+
+// read_sampled reads the rows of blk that are multiples of step one by one
+// and keeps the columns that are multiples of step.
+func (self *block_reader) read_sampled(blk block) error {
+	step := self.step
+	x0 := (blk.off_x + step - 1) / step * step
+	n_x := 0
+	if x0 < blk.off_x+blk.size_x {
+		n_x = (blk.off_x+blk.size_x-1-x0)/step + 1
+	}
+	if len(self.row) < blk.size_x {
+		self.row = make([]float64, blk.size_x)
+	}
+	row := self.row[:blk.size_x]
+	self.n = 0
+	for y := (blk.off_y + step - 1) / step * step; y < blk.off_y+blk.size_y && n_x > 0; y += step {
+		for band_idx, band := range self.bands {
+			if err := band.IO(gdal.Read, blk.off_x, y, blk.size_x, 1, row, blk.size_x, 1, 0, 0); err != nil {
+				return err
+			}
+			p := self.buf_in[band_idx][self.n:]
+			for j := 0; j < n_x; j++ {
+				p[j] = row[x0-blk.off_x+j*step]
+			}
+		}
+		self.n += n_x
+	}
+	return self.ndv_def.GetNdvMaskC(self.buf_in, self.ndv_mask, self.n)
+}
+
+// block_func is called once per block.  worker identifies the calling
+// goroutine (0..workers-1) so callers can keep per-worker state.
+type block_func func(worker int, blk block, rd *block_reader) error
+
+// in_block_order returns a block_func that calls fn for every block and
+// hands the results to merge one at a time, in block order whichever
+// worker finishes first.  Floating point partials merged this way give the
+// same result for any number of workers.
+func in_block_order(fn func(blk block, rd *block_reader) (interface{}, error), merge func(result interface{})) block_func {
+	var (
+		mu      sync.Mutex
+		pending = map[int]interface{}{}
+		next    int
+	)
+	return func(worker int, blk block, rd *block_reader) error {
+		result, err := fn(blk, rd)
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		pending[blk.idx] = result
+		for {
+			result, ok := pending[next]
+			if !ok {
+				return nil
+			}
+			delete(pending, next)
+			merge(result)
+			next++
+		}
+	}
+}
+
+func scan_workers(scan *ScanOptions) int {
+	if scan == nil || scan.Workers < 1 {
+		return 1
+	}
+	return scan.Workers
+}
+
+// for_each_block reads every block of src_bands and hands it to fn.  With
+// one worker the blocks are visited in order on the calling goroutine.
+// Otherwise every worker reopens the source dataset, since GDAL handles
+// must not be shared between threads, and fn is called concurrently.
+// Sources that cannot be reopened by name, such as MEM datasets, are read
+// serially.
+func for_each_block(src_bands []gdal.RasterBand, ndv_def *NdvDef, w, h, workers int, fn block_func) error {
+	return for_each_block_in(src_bands, ndv_def, w, 0, h, workers, fn)
+}
+
+// for_each_block_in is for_each_block restricted to rows y0..y1-1.
+func for_each_block_in(src_bands []gdal.RasterBand, ndv_def *NdvDef, w, y0, y1, workers int, fn block_func) error {
+	return sample_blocks_in(src_bands, ndv_def, w, y0, y1, workers, full_sampling, fn)
+}
+
+// scan_blocks is for_each_block over the pixels sampled as set by scan, see
+// ScanOptions, with the workers of scan.  The blocks are those of the
+// overview read, and with a step rd.n is the number of sampled pixels of
+// the block, so fn should not rely on the pixel positions.
+func scan_blocks(src_bands []gdal.RasterBand, ndv_def *NdvDef, w, h int, scan *ScanOptions, fn block_func) error {
+	smp := scan_sampling(src_bands, w, h, scan)
+	if smp == full_sampling {
+		return for_each_block(src_bands, ndv_def, w, h, scan_workers(scan), fn)
+	}
+	full_w, full_h := w, h
+	from := "full resolution"
+	if smp.overview >= 0 {
+		ovr := src_bands[0].Overview(smp.overview)
+		w, h = ovr.XSize(), ovr.YSize()
+		from = fmt.Sprintf("overview %d (%dx%d)", smp.overview+1, w, h)
+	}
+	sampled := ((w + smp.step - 1) / smp.step) * ((h + smp.step - 1) / smp.step)
+	log.Printf("statistics from %d of %d pixels: %s, step %d\n", sampled, full_w*full_h, from, smp.step)
+	return sample_blocks_in(src_bands, ndv_def, w, 0, h, scan_workers(scan), smp, fn)
+}
+
+// sample_blocks_in is for_each_block_in over the pixels sampled by smp.  w
+// and rows y0..y1-1 are those of the overview read.
+func sample_blocks_in(src_bands []gdal.RasterBand, ndv_def *NdvDef, w, y0, y1, workers int, smp sampling, fn block_func) error {
+	read_bands := sample_bands(src_bands, smp)
+	blocksize_x, blocksize_y := read_bands[0].BlockSize()
+	blocks := make_blocks_in(w, y0, y1, blocksize_x, blocksize_y)
+	block_len := blocksize_x * blocksize_y
+
+	src_ds := src_bands[0].GetDataset()
+	src_fn := dataset_description(&src_ds)
+	if workers > 1 {
+		ds, err := gdal.Open(src_fn, gdal.ReadOnly)
+		if err != nil {
+			log.Printf("%q cannot be reopened by the workers, reading it serially: %v\n", src_fn, err)
+			workers = 1
+		} else {
+			ds.Close()
+		}
+	}
+
+	if workers <= 1 {
+		rd := new_block_reader(read_bands, ndv_def, block_len)
+		rd.step = smp.step
+		for _, blk := range blocks {
+			if err := rd.read(blk); err != nil {
+				return err
+			}
+			if err := fn(0, blk, rd); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	bandlist := make([]int, len(src_bands))
+	for band_idx, band := range src_bands {
+		bandlist[band_idx] = band.BandNumber()
+	}
+
+	jobs := make(chan block)
+	done := make(chan struct{})
+	var (
+		wg        sync.WaitGroup
+		once      sync.Once
+		first_err error
+	)
+	fail := func(err error) {
+		once.Do(func() {
+			first_err = err
+			close(done)
+		})
+	}
+
+	for worker := 0; worker < workers; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			ds, err := gdal.Open(src_fn, gdal.ReadOnly)
+			if err != nil {
+				fail(err)
+				return
+			}
+			defer ds.Close()
+			bands := make([]gdal.RasterBand, len(bandlist))
+			for band_idx, v := range bandlist {
+				bands[band_idx] = ds.RasterBand(v)
+			}
+			rd := new_block_reader(sample_bands(bands, smp), ndv_def, block_len)
+			rd.step = smp.step
+			for blk := range jobs {
+				if err := rd.read(blk); err != nil {
+					fail(err)
+					return
+				}
+				if err := fn(worker, blk, rd); err != nil {
+					fail(err)
+					return
+				}
+			}
+		}(worker)
+	}
+
+feed:
+	for _, blk := range blocks {
+		select {
+		case jobs <- blk:
+		case <-done:
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	return first_err
+}
+
+// out_block carries the output pixels of one block to the writer.
+type out_block struct {
+	blk  block
+	bufs [][]float64
+	mask []float64
+}
+
+func new_out_block(band_count, block_len int, with_mask bool) *out_block {
+	ob := &out_block{bufs: make([][]float64, band_count)}
+	for band_idx := range ob.bufs {
+		ob.bufs[band_idx] = make([]float64, block_len)
+	}
+	if with_mask {
+		ob.mask = make([]float64, block_len)
+	}
+	return ob
+}
+
+// transform_blocks calls transform for every block of src_bands and hands
+// the result to write.  Blocks are transformed by the workers concurrently
+// but write is only ever called from one goroutine at a time, since the
+// output dataset must not be shared between threads.
+func transform_blocks(src_bands []gdal.RasterBand, ndv_def *NdvDef, w, h, workers, out_band_count int, with_mask bool,
+	transform func(rd *block_reader, ob *out_block) error, write func(ob *out_block) error) error {
+	return transform_blocks_in(src_bands, ndv_def, w, 0, h, workers, out_band_count, with_mask, transform, write)
+}
+
+// transform_blocks_in is transform_blocks restricted to rows y0..y1-1.
+func transform_blocks_in(src_bands []gdal.RasterBand, ndv_def *NdvDef, w, y0, y1, workers, out_band_count int, with_mask bool,
+	transform func(rd *block_reader, ob *out_block) error, write func(ob *out_block) error) error {
+	blocksize_x, blocksize_y := src_bands[0].BlockSize()
+	block_len := blocksize_x * blocksize_y
+
+	if workers <= 1 {
+		ob := new_out_block(out_band_count, block_len, with_mask)
+		return for_each_block_in(src_bands, ndv_def, w, y0, y1, 1, func(worker int, blk block, rd *block_reader) error {
+			ob.blk = blk
+			if err := transform(rd, ob); err != nil {
+				return err
+			}
+			return write(ob)
+		})
+	}
+
+	// a few spare buffers per worker so transforming can run ahead of writing
+	free := make(chan *out_block, 2*workers)
+	for i := 0; i < cap(free); i++ {
+		free <- new_out_block(out_band_count, block_len, with_mask)
+	}
+	results := make(chan *out_block, workers)
+	write_err := make(chan error, 1)
+	go func() {
+		var err error
+		for ob := range results {
+			if err == nil {
+				err = write(ob)
+			}
+			free <- ob
+		}
+		write_err <- err
+	}()
+
+	err := for_each_block_in(src_bands, ndv_def, w, y0, y1, workers, func(worker int, blk block, rd *block_reader) error {
+		ob := <-free
+		ob.blk = blk
+		if err := transform(rd, ob); err != nil {
+			free <- ob
+			return err
+		}
+		results <- ob
+		return nil
+	})
+	close(results)
+	if werr := <-write_err; err == nil {
+		err = werr
+	}
+	return err
+}
@@ -0,0 +1,280 @@
+package stretch
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"path/filepath"
+	"testing"
+
+	"github.com/lukeroth/gdal"
+)
+
+func TestMakeBlocks(t *testing.T) {
+	cases := []struct {
+		name         string
+		w, h, bx, by int
+		want         []block
+	}{
+		{"whole blocks", 64, 32, 32, 16, []block{{0, 0, 32, 16, 0}, {32, 0, 32, 16, 1}, {0, 16, 32, 16, 2}, {32, 16, 32, 16, 3}}},
+		{"partial blocks", 40, 20, 32, 16, []block{{0, 0, 32, 16, 0}, {32, 0, 8, 16, 1}, {0, 16, 32, 4, 2}, {32, 16, 8, 4, 3}}},
+	}
+	for _, tc := range cases {
+		got := make_blocks(tc.w, tc.h, tc.bx, tc.by)
+		if len(got) != len(tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tc.want[i] {
+				t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+				break
+			}
+		}
+	}
+}
+
+func TestParallelIdentical(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	sources := []string{
+		test_raster(t, "src16", 200, 130, 3, gdal.UInt16, func(b, x, y int) float64 { return float64(r.Intn(4000) + b*100) }),
+		test_raster(t, "srcf", 200, 130, 2, gdal.Float32, func(b, x, y int) float64 { return r.NormFloat64()*10 + 3 }),
+	}
+	dir := t.TempDir()
+	modes := []struct {
+		name string
+		set  func(opt *Options)
+	}{
+		{"percentile", func(opt *Options) {
+			opt.Mode, opt.FromPercentile, opt.ToPercentile = "percentile", []float64{0.02}, []float64{0.98}
+		}},
+		{"t-digest percentile", func(opt *Options) {
+			opt.Mode, opt.FromPercentile, opt.ToPercentile, opt.Stats = "percentile", []float64{0.02}, []float64{0.98}, StatsTDigest
+		}},
+		{"stddev", func(opt *Options) {
+			opt.Mode, opt.DstAvg, opt.DstStddev = "stddev", 128, 40
+		}},
+		// float output, so any rounding of the covariance shows
+		{"decorrelation", func(opt *Options) {
+			opt.Mode, opt.DstAvg, opt.DstStddev, opt.OutputType = "decorrelation", 30000, 5000, gdal.Float64
+		}},
+	}
+	for _, src_fn := range sources {
+		for _, mode := range modes {
+			var outs [][][]float64
+			for _, workers := range []int{1, 4} {
+				opt := Options{SrcFn: src_fn, DstFn: filepath.Join(dir, "out.tif")}
+				mode.set(&opt)
+				opt.Workers = workers
+				if err := Run(&opt); err != nil {
+					t.Fatal(err)
+				}
+				outs = append(outs, read_test_raster(t, opt.DstFn))
+			}
+			for b := range outs[0] {
+				for i := range outs[0][b] {
+					if outs[0][b][i] != outs[1][b][i] {
+						t.Fatalf("%s, %s, band %d pixel %d: %g with 1 worker, %g with 4",
+							filepath.Base(src_fn), mode.name, b+1, i, outs[0][b][i], outs[1][b][i])
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestUnnamedSource(t *testing.T) {
+	// a MEM dataset cannot be reopened by the workers
+	drv, err := gdal.GetDriverByName("MEM")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, h := 150, 70
+	ds := drv.Create("", w, h, 2, gdal.Float32, nil)
+	defer ds.Close()
+	r := rand.New(rand.NewSource(2))
+	buf := make([]float64, w*h)
+	for b := 1; b <= 2; b++ {
+		for i := range buf {
+			buf[i] = r.NormFloat64() * float64(b)
+		}
+		band := ds.RasterBand(b)
+		if err := band.IO(gdal.Write, 0, 0, w, h, buf, w, h, 0, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	src_bands := []gdal.RasterBand{ds.RasterBand(1), ds.RasterBand(2)}
+	var results [][][2]float64
+	for _, workers := range []int{1, 4} {
+		minmax, err := ComputeMinmax(src_bands, &NdvDef{}, w, h, &ScanOptions{Workers: workers})
+		if err != nil {
+			t.Fatalf("%d workers: %v", workers, err)
+		}
+		results = append(results, minmax)
+	}
+	for b := range results[0] {
+		if results[0][b] != results[1][b] || results[0][b][0] >= results[0][b][1] {
+			t.Errorf("band %d: %v with 1 worker, %v with 4", b+1, results[0][b], results[1][b])
+		}
+	}
+}
+
+// overview_raster writes a 1003 x 801 UInt16 raster of two bands with
+// overviews of factors 2, 4 and 8 and about every 10th pixel 0 in both
+// bands, and returns it with the pixels of its first band.
+func overview_raster(t *testing.T) (string, []float64) {
+	t.Helper()
+	r := rand.New(rand.NewSource(4))
+	fn := test_raster(t, "approx", 1003, 801, 2, gdal.UInt16, func(b, x, y int) float64 {
+		if (x*x+3*y)%10 == 0 {
+			return 0
+		}
+		return float64(r.Intn(5000) + 1 + b)
+	})
+	ds, err := gdal.Open(fn, gdal.Update)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+	progress := func(complete float64, message string, data interface{}) int { return 1 }
+	if err := ds.BuildOverviews("NEAREST", 3, []int{2, 4, 8}, 2, []int{1, 2}, progress, nil); err != nil {
+		t.Fatal(err)
+	}
+	return fn, read_test_raster(t, fn)[0]
+}
+
+// step_counts counts every step-th row and column of the w x h pixels of
+// data, the 0s apart.
+func step_counts(data []float64, w, h, step int) (counts []uint, ndv_count uint) {
+	counts = make([]uint, 65536)
+	for y := 0; y < h; y += step {
+		for x := 0; x < w; x += step {
+			if v := data[y*w+x]; v == 0 {
+				ndv_count++
+			} else {
+				counts[int(v)]++
+			}
+		}
+	}
+	return counts, ndv_count
+}
+
+func TestScanSampling(t *testing.T) {
+	fn, _ := overview_raster(t)
+	ds, err := gdal.Open(fn, gdal.ReadOnly)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+	bands := []gdal.RasterBand{ds.RasterBand(1), ds.RasterBand(2)}
+	cases := []struct {
+		scan *ScanOptions
+		want sampling
+	}{
+		{nil, full_sampling},
+		{&ScanOptions{SampleStep: 4}, sampling{-1, 4}},
+		// overviews of 502, 251 and 126 columns
+		{&ScanOptions{Approx: true, SampleStep: 8}, sampling{2, 1}},
+		{&ScanOptions{Approx: true, SampleStep: 16}, sampling{2, 2}},
+		{&ScanOptions{Approx: true, SampleStep: 3}, sampling{0, 2}},
+		{&ScanOptions{Approx: true, SampleStep: 1}, full_sampling},
+		// small enough to read in full
+		{&ScanOptions{Approx: true}, full_sampling},
+	}
+	for _, tc := range cases {
+		if got := scan_sampling(bands, 1003, 801, tc.scan); got != tc.want {
+			t.Errorf("%+v: got %+v, want %+v", tc.scan, got, tc.want)
+		}
+	}
+}
+
+func TestApprox(t *testing.T) {
+	fn, data := overview_raster(t)
+	w, h := 1003, 801
+	ds, err := gdal.Open(fn, gdal.ReadOnly)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+	bands := []gdal.RasterBand{ds.RasterBand(1), ds.RasterBand(2)}
+	opt := Options{Ndv: [][2]float64{{0, 0}}}
+	ndv_def, err := opt.ndv_def()
+	if err != nil {
+		t.Fatal(err)
+	}
+	binnings := []Binning{{Nbins: 65536, Scale: 1}, {Nbins: 65536, Scale: 1}}
+	check := func(name string, scan ScanOptions, want []uint, want_ndv uint) {
+		t.Helper()
+		histograms, err := ComputeHistogram(bands, &ndv_def, w, h, binnings, &scan)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hg := &histograms[0]
+		if hg.NdvCount != want_ndv {
+			t.Errorf("%s: %d NoData pixels, want %d", name, hg.NdvCount, want_ndv)
+		}
+		for i := range want {
+			if hg.Counts[i] != want[i] {
+				t.Errorf("%s: %d counts of %d, want %d", name, hg.Counts[i], i, want[i])
+				return
+			}
+		}
+	}
+	for _, step := range []int{1, 3, 8} {
+		want, want_ndv := step_counts(data, w, h, step)
+		for _, workers := range []int{1, 4} {
+			check(fmt.Sprintf("step %d, %d workers", step, workers), ScanOptions{Workers: workers, SampleStep: step}, want, want_ndv)
+		}
+	}
+
+	// the overview of factor 8, all of it and every other pixel
+	ovr := bands[0].Overview(2)
+	ovr_w, ovr_h := ovr.XSize(), ovr.YSize()
+	ovr_data := make([]float64, ovr_w*ovr_h)
+	if err := ovr.IO(gdal.Read, 0, 0, ovr_w, ovr_h, ovr_data, ovr_w, ovr_h, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	for _, step := range []int{1, 2} {
+		want, want_ndv := step_counts(ovr_data, ovr_w, ovr_h, step)
+		for _, workers := range []int{1, 4} {
+			check(fmt.Sprintf("overview step %d, %d workers", step, workers), ScanOptions{Workers: workers, Approx: true, SampleStep: 8 * step}, want, want_ndv)
+		}
+	}
+
+	// sampled blocks are still merged in block order
+	var covs [2]*Covariance
+	for i, workers := range []int{1, 4} {
+		if covs[i], err = ComputeCovariance(bands, &ndv_def, w, h, &ScanOptions{Workers: workers, SampleStep: 3}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if covs[0].Count != covs[1].Count || covs[0].Mean[0] != covs[1].Mean[0] || covs[0].Cov[0][1] != covs[1].Cov[0][1] {
+		t.Errorf("sampled covariance differs with 4 workers: %+v, %+v", covs[0], covs[1])
+	}
+
+	// the sampled range lies within the full one
+	full, err := ComputeMinmax(bands, &ndv_def, w, h, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	approx, err := ComputeMinmax(bands, &ndv_def, w, h, &ScanOptions{Approx: true, SampleStep: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for b := range full {
+		if approx[b][0] < full[b][0] || approx[b][1] > full[b][1] || approx[b][0] > approx[b][1] {
+			t.Errorf("band %d: %v sampled, %v in full", b+1, approx[b], full[b])
+		}
+	}
+
+	// stretched from the sample
+	run := Options{SrcFn: fn, DstFn: filepath.Join(t.TempDir(), "out.tif"), Ndv: [][2]float64{{0, 0}}, Mode: "percentile", FromPercentile: []float64{0.02}, ToPercentile: []float64{0.98}}
+	run.Approx, run.SampleStep = true, 4
+	if err := Run(&run); err != nil {
+		t.Fatal(err)
+	}
+	out := read_test_raster(t, run.DstFn)
+	if mean, _ := moments(out[0], 0); math.Abs(mean-127.5) > 5 {
+		t.Errorf("mean level %g", mean)
+	}
+}
@@ -0,0 +1,245 @@
+package stretch
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/lukeroth/gdal"
+)
+
+// pam_domain is the band metadata domain that ties the PAM histograms to
+// the source and the settings they were computed with.
+const pam_domain = "CONTRAST_STRETCH"
+
+type histogram_json struct {
+	Binning
+	Min       float64 `json:"min"`
+	Max       float64 `json:"max"`
+	Mean      float64 `json:"mean"`
+	Stddev    float64 `json:"stddev"`
+	DataCount uint    `json:"data_count"`
+	NdvCount  uint    `json:"ndv_count"`
+	Counts    []uint  `json:"counts"`
+}
+
+func (self Histogram) MarshalJSON() ([]byte, error) {
+	hj := histogram_json{self.Binning, self.Min, self.Max, self.Mean, self.Stddev, self.DataCount, self.NdvCount, self.Counts}
+	if self.DataCount == 0 {
+		// no NaN in JSON
+		hj.Mean, hj.Stddev = 0, 0
+	}
+	return json.Marshal(hj)
+}
+
+// UnmarshalJSON reads a histogram written by MarshalJSON.  DataCount,
+// Mean and Stddev are recomputed from the counts.
+func (self *Histogram) UnmarshalJSON(data []byte) error {
+	var hj histogram_json
+	if err := json.Unmarshal(data, &hj); err != nil {
+		return err
+	}
+	if hj.Nbins <= 0 || len(hj.Counts) != hj.Nbins {
+		return fmt.Errorf("%w: histogram has %d counts for %d bins", ErrBinningMismatch, len(hj.Counts), hj.Nbins)
+	}
+	*self = Histogram{Binning: hj.Binning, Min: hj.Min, Max: hj.Max, NdvCount: hj.NdvCount, Counts: hj.Counts}
+	self.update_stats()
+	return nil
+}
+
+// HistogramSet is the JSON file of the histograms of the selected bands of
+// a raster, as exported by SaveHistograms.
+type HistogramSet struct {
+	// SrcSize and SrcModTime (in Unix nanoseconds) identify the version of
+	// the source the histograms were computed from.
+	SrcSize    int64 `json:"src_size,omitempty"`
+	SrcModTime int64 `json:"src_mtime,omitempty"`
+	// Key describes the bands, no-data definition and binning settings.
+	Key        string      `json:"key,omitempty"`
+	Histograms []Histogram `json:"histograms"`
+}
+
+func SaveHistograms(fn string, set *HistogramSet) error {
+	data, err := json.Marshal(set)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(fn, append(data, '\n'), 0644)
+}
+
+func LoadHistograms(fn string) (*HistogramSet, error) {
+	data, err := os.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	var set HistogramSet
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("%s: %w", fn, err)
+	}
+	return &set, nil
+}
+
+// histogram_cache keeps the histograms Run computes in the JSON file
+// Options.HistogramCache and/or the PAM metadata of the source bands
+// (Options.Pam), and reads them back on later runs.  Cached histograms
+// are stale once the size or modification time of the source, or the
+// settings in key, change.
+type histogram_cache struct {
+	opt         *Options
+	src_bands   []gdal.RasterBand
+	size, mtime int64
+	key         string
+}
+
+// new_histogram_cache returns nil if no cache is configured or the source
+// is not a plain file, e.g. a /vsi path.
+func new_histogram_cache(opt *Options, src_bands []gdal.RasterBand, bandlist []int, ndv_def *NdvDef) *histogram_cache {
+	if len(opt.HistogramCache) == 0 && !opt.Pam {
+		return nil
+	}
+	fi, err := os.Stat(opt.SrcFn)
+	if err != nil {
+		log.Printf("not caching histograms: %v\n", err)
+		return nil
+	}
+	self := &histogram_cache{opt: opt, src_bands: src_bands, size: fi.Size(), mtime: fi.ModTime().UnixNano()}
+	// Linked histograms may share a binning, so the link mode counts too.
+	self.key = fmt.Sprintf("bands=%v ndv=%v float-bins=%d histogram-memory=%d linked=%t approx=%t sample-step=%d",
+		bandlist, *ndv_def, opt.FloatBinning, opt.HistogramMemory, opt.Link != LinkNone, opt.Approx, opt.SampleStep)
+	return self
+}
+
+// load returns the cached histograms, or nil if there are none or they
+// are stale.
+func (self *histogram_cache) load() []Histogram {
+	if len(self.opt.HistogramCache) > 0 {
+		if histograms := self.load_json(); histograms != nil {
+			log.Printf("histograms read from %s\n", self.opt.HistogramCache)
+			return histograms
+		}
+	}
+	if self.opt.Pam {
+		if histograms := self.load_pam(); histograms != nil {
+			log.Printf("histograms read from the PAM metadata of %s\n", self.opt.SrcFn)
+			return histograms
+		}
+	}
+	return nil
+}
+
+func (self *histogram_cache) load_json() []Histogram {
+	set, err := LoadHistograms(self.opt.HistogramCache)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("ignoring histogram cache: %v\n", err)
+		}
+		return nil
+	}
+	if set.SrcSize != self.size || set.SrcModTime != self.mtime || set.Key != self.key || len(set.Histograms) != len(self.src_bands) {
+		log.Printf("histogram cache %s is stale\n", self.opt.HistogramCache)
+		return nil
+	}
+	return set.Histograms
+}
+
+// pam_marker is the pam_domain metadata of a band.  It keeps the value
+// range next to the default histogram, as GDAL has no statistics for an
+// all NoData band.
+func (self *histogram_cache) pam_marker(hg *Histogram) []string {
+	return []string{
+		"SOURCE_SIZE=" + strconv.FormatInt(self.size, 10),
+		"SOURCE_MTIME=" + strconv.FormatInt(self.mtime, 10),
+		"KEY=" + self.key,
+		"NDV_COUNT=" + strconv.FormatUint(uint64(hg.NdvCount), 10),
+		"MIN=" + strconv.FormatFloat(hg.Min, 'g', -1, 64),
+		"MAX=" + strconv.FormatFloat(hg.Max, 'g', -1, 64),
+	}
+}
+
+func (self *histogram_cache) load_pam() []Histogram {
+	histograms := make([]Histogram, len(self.src_bands))
+	for band_idx := range self.src_bands {
+		band := &self.src_bands[band_idx]
+		md := map[string]string{}
+		for _, item := range band_metadata(band, pam_domain) {
+			if kv := strings.SplitN(item, "=", 2); len(kv) == 2 {
+				md[kv[0]] = kv[1]
+			}
+		}
+		if md["SOURCE_SIZE"] != strconv.FormatInt(self.size, 10) || md["SOURCE_MTIME"] != strconv.FormatInt(self.mtime, 10) || md["KEY"] != self.key {
+			return nil
+		}
+		ndv_count, err := strconv.ParseUint(md["NDV_COUNT"], 10, 64)
+		if err != nil {
+			return nil
+		}
+		min, err := strconv.ParseFloat(md["MIN"], 64)
+		if err != nil {
+			return nil
+		}
+		max, err := strconv.ParseFloat(md["MAX"], 64)
+		if err != nil {
+			return nil
+		}
+		hist_min, hist_max, counts, ok := default_histogram(band)
+		if !ok || len(counts) == 0 {
+			return nil
+		}
+		// GDAL buckets span hist_min..hist_max, bins are centred on values
+		hg := &histograms[band_idx]
+		hg.Nbins = len(counts)
+		hg.Scale = (hist_max - hist_min) / float64(hg.Nbins)
+		hg.Offset = hist_min + hg.Scale/2
+		hg.Counts = counts
+		hg.Min, hg.Max = min, max
+		hg.NdvCount = uint(ndv_count)
+		hg.update_stats()
+	}
+	return histograms
+}
+
+func (self *histogram_cache) save(histograms []Histogram) error {
+	if len(self.opt.HistogramCache) > 0 {
+		set := &HistogramSet{SrcSize: self.size, SrcModTime: self.mtime, Key: self.key, Histograms: histograms}
+		if err := SaveHistograms(self.opt.HistogramCache, set); err != nil {
+			return err
+		}
+	}
+	if self.opt.Pam {
+		return self.save_pam(histograms)
+	}
+	return nil
+}
+
+// save_pam sets the histograms as the default histograms and statistics
+// of the source bands, which GDAL writes to the .aux.xml file when the
+// source is closed.
+func (self *histogram_cache) save_pam(histograms []Histogram) error {
+	for band_idx := range histograms {
+		if histograms[band_idx].LogBits > 0 {
+			log.Printf("log-scale bins cannot be kept in PAM metadata\n")
+			return nil
+		}
+	}
+	for band_idx := range histograms {
+		band := &self.src_bands[band_idx]
+		hg := &histograms[band_idx]
+		hist_min := hg.Offset - hg.Scale/2
+		if err := set_default_histogram(band, hist_min, hist_min+float64(hg.Nbins)*hg.Scale, hg.Counts); err != nil {
+			return err
+		}
+		if hg.DataCount > 0 {
+			if err := band.SetStatistics(hg.Min, hg.Max, hg.Mean, hg.Stddev); err != nil {
+				return err
+			}
+		}
+		if err := set_band_metadata(band, self.pam_marker(hg), pam_domain); err != nil {
+			return err
+		}
+	}
+	return nil
+}
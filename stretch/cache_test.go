@@ -0,0 +1,160 @@
+package stretch
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lukeroth/gdal"
+)
+
+// capture_log sends the log output to the returned buffer until the end
+// of the test.
+func capture_log(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return &buf
+}
+
+func TestHistogramJSON(t *testing.T) {
+	hg := Histogram{Binning: LinearBinning(-1, 1, 5), Counts: []uint{1, 0, 4, 2, 1}, Min: -1, Max: 1, NdvCount: 7}
+	hg.update_stats()
+	data, err := json.Marshal(hg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got Histogram
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Binning != hg.Binning || got.Min != hg.Min || got.Max != hg.Max || got.NdvCount != hg.NdvCount ||
+		got.DataCount != hg.DataCount || math.Abs(got.Mean-hg.Mean) > 1e-12 || math.Abs(got.Stddev-hg.Stddev) > 1e-12 {
+		t.Errorf("got %+v, want %+v", got, hg)
+	}
+
+	// no NaN for an empty histogram
+	empty := Histogram{Binning: Binning{Nbins: 2, Scale: 1}, Counts: []uint{0, 0}}
+	empty.update_stats()
+	if _, err := json.Marshal(empty); err != nil {
+		t.Error(err)
+	}
+	if err := json.Unmarshal([]byte(`{"Nbins": 3, "counts": [1, 2]}`), &got); !errors.Is(err, ErrBinningMismatch) {
+		t.Errorf("3 bins of 2 counts: got %v, want %v", err, ErrBinningMismatch)
+	}
+}
+
+func TestHistogramCache(t *testing.T) {
+	buf := capture_log(t)
+	r := rand.New(rand.NewSource(8))
+	dir := t.TempDir()
+	const hit = "histograms read from"
+	for _, dt := range []gdal.DataType{gdal.UInt16, gdal.Float32} {
+		src_fn := test_raster(t, "src"+dt.Name(), 140, 100, 2, dt, func(b, x, y int) float64 {
+			if x < 3 {
+				return 0
+			}
+			return float64(r.Intn(3000)) + 1
+		})
+		for _, pam := range []bool{false, true} {
+			cache_fn := ""
+			if !pam {
+				cache_fn = filepath.Join(dir, "cache"+dt.Name()+".json")
+			}
+			run := func(f func(opt *Options)) ([][]float64, string) {
+				t.Helper()
+				buf.Reset()
+				opt := Options{SrcFn: src_fn, DstFn: filepath.Join(dir, "out.tif"), HistogramCache: cache_fn, Pam: pam, Ndv: [][2]float64{{0, 0}},
+					Mode: "percentile", FromPercentile: []float64{0.05}, ToPercentile: []float64{0.9}}
+				if f != nil {
+					f(&opt)
+				}
+				if err := Run(&opt); err != nil {
+					t.Fatal(err)
+				}
+				return read_test_raster(t, opt.DstFn), buf.String()
+			}
+			name := dt.Name() + " JSON"
+			if pam {
+				name = dt.Name() + " PAM"
+			}
+
+			plain, _ := run(func(opt *Options) { opt.HistogramCache, opt.Pam = "", false })
+			if _, first := run(nil); strings.Contains(first, hit) {
+				t.Errorf("%s: read before it was written", name)
+			}
+			second, log_second := run(nil)
+			if !strings.Contains(log_second, hit) {
+				t.Errorf("%s: not read back", name)
+			}
+			for b := range plain {
+				for i := range plain[b] {
+					if plain[b][i] != second[b][i] {
+						t.Fatalf("%s: band %d pixel %d is %g without the cache, %g with it", name, b+1, i, plain[b][i], second[b][i])
+					}
+				}
+			}
+
+			// other settings or a newer source miss
+			if _, l := run(func(opt *Options) { opt.Ndv = [][2]float64{{1, 1}} }); strings.Contains(l, hit) {
+				t.Errorf("%s: read for another NoData value", name)
+			}
+			run(nil)
+			if err := os.Chtimes(src_fn, time.Now(), time.Now().Add(time.Hour)); err != nil {
+				t.Fatal(err)
+			}
+			if _, l := run(nil); strings.Contains(l, hit) {
+				t.Errorf("%s: read for a newer source", name)
+			}
+			if _, l := run(nil); !strings.Contains(l, hit) {
+				t.Errorf("%s: not cached again", name)
+			}
+		}
+	}
+
+	set, err := LoadHistograms(filepath.Join(dir, "cacheFloat32.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(set.Histograms) != 2 || len(set.Key) == 0 || set.Histograms[0].DataCount != 137*100 {
+		t.Errorf("cache of %d histograms, key %q", len(set.Histograms), set.Key)
+	}
+
+	// log-scale bins are not kept in PAM
+	buf.Reset()
+	opt := Options{SrcFn: test_raster(t, "log", 20, 20, 1, gdal.Float32, func(b, x, y int) float64 { return float64(x + y) }),
+		DstFn: filepath.Join(dir, "log.csv"), DumpHistogram: true, Pam: true, FloatBinning: FloatBinsLog}
+	if err := Run(&opt); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "log-scale bins cannot") {
+		t.Errorf("no notice for log-scale bins in PAM: %s", buf.String())
+	}
+
+	// an all NoData band is cached too, and read back from either cache
+	empty_fn := test_raster(t, "empty", 10, 10, 1, gdal.Byte, func(b, x, y int) float64 { return 0 })
+	for _, pam := range []bool{false, true} {
+		opt = Options{SrcFn: empty_fn, DstFn: filepath.Join(dir, "empty.csv"), DumpHistogram: true, Ndv: [][2]float64{{0, 0}}, Pam: pam}
+		if !pam {
+			opt.HistogramCache = filepath.Join(dir, "empty.json")
+		}
+		for i := 0; i < 2; i++ {
+			buf.Reset()
+			o := opt
+			if err := Run(&o); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if !strings.Contains(buf.String(), hit) {
+			t.Errorf("all NoData band, PAM %t: not read back", pam)
+		}
+	}
+}
@@ -0,0 +1,269 @@
+package stretch
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/lukeroth/gdal"
+)
+
+const (
+	default_clahe_tile = 256
+	default_clahe_clip = 4
+	// most bins of a tile histogram; finer binnings are coarsened to
+	// bound the memory of the tile tables
+	clahe_bins = 4096
+)
+
+// check_clahe_options validates and defaults the options of the "clahe"
+// mode, contrast-limited adaptive histogram equalization: every tile of
+// ClaheTile pixels is equalized with its own clipped histogram and the
+// tables of the four nearest tiles are blended bilinearly.
+func check_clahe_options(opt *Options) error {
+	if err := check_table_options(opt); err != nil {
+		return err
+	}
+	if opt.Link != LinkNone {
+		return fmt.Errorf("%w: -clahe cannot be linked", ErrBadArgs)
+	}
+	if len(opt.StatsFns) > 0 {
+		return fmt.Errorf("%w: -clahe tiles are equalized from the source only, not -stats-from", ErrBadArgs)
+	}
+	if len(opt.SaveParams) > 0 {
+		return fmt.Errorf("%w: -clahe tables depend on the tiles and cannot be saved", ErrBadArgs)
+	}
+	if len(opt.SaveParams) > 0 {
+		return fmt.Errorf("%w: -clahe tables depend on the tiles and cannot be saved", ErrBadArgs)
+	}
+	if opt.ClaheTile == 0 {
+		opt.ClaheTile = default_clahe_tile
+	}
+	if opt.ClaheClip == 0 {
+		opt.ClaheClip = default_clahe_clip
+	}
+	if opt.ClaheTile < 2 || opt.ClaheClip < 1 {
+		return fmt.Errorf("%w: -clahe-tile must be at least 2 and -clahe-clip at least 1", ErrBadArgs)
+	}
+	return nil
+}
+
+// clahe holds the tile tables around the rows being written.  Tile (r, c)
+// covers rows r*tile.. and columns c*tile.., its table is centred on the
+// middle of the tile.
+type clahe struct {
+	tile         int
+	rows, cols   int
+	clip         float64
+	output_range int
+	binnings     []Binning
+	// tile row -> tile column -> band -> output level of every bin, nil
+	// for tiles without valid pixels
+	luts map[int][][][]float64
+}
+
+func new_clahe(opt *Options, src_bands []gdal.RasterBand, histograms []Histogram, w, h int) *clahe {
+	self := &clahe{
+		tile:         opt.ClaheTile,
+		rows:         (h + opt.ClaheTile - 1) / opt.ClaheTile,
+		cols:         (w + opt.ClaheTile - 1) / opt.ClaheTile,
+		clip:         opt.ClaheClip,
+		output_range: opt.OutputRange,
+		binnings:     make([]Binning, len(histograms)),
+		luts:         map[int][][][]float64{},
+	}
+	for band_idx := range histograms {
+		self.binnings[band_idx] = clahe_binning(&histograms[band_idx], src_bands[band_idx].RasterDataType())
+	}
+	return self
+}
+
+// clahe_binning returns the binning of the tile histograms of a band: the
+// band binning if it is small enough, otherwise one bin per value of an
+// integer band or clahe_bins linear bins over the band values.
+func clahe_binning(hg *Histogram, dt gdal.DataType) Binning {
+	if hg.Nbins <= clahe_bins || hg.DataCount == 0 {
+		return hg.Binning
+	}
+	if exact_binning(dt, hg.Binning) && hg.Max-hg.Min < clahe_bins {
+		return Binning{Nbins: int(hg.Max-hg.Min) + 1, Offset: hg.Min, Scale: 1}
+	}
+	return LinearBinning(hg.Min, hg.Max, clahe_bins)
+}
+
+// clip_histogram cuts every bin of hg at clip times the mean bin count and
+// spreads the excess evenly over all bins.
+func clip_histogram(hg *Histogram, clip float64) {
+	limit := uint(math.Max(1, clip*float64(hg.DataCount)/float64(hg.Nbins)))
+	var excess uint
+	for i, cnt := range hg.Counts {
+		if cnt > limit {
+			excess += cnt - limit
+			hg.Counts[i] = limit
+		}
+	}
+	nbins := uint(hg.Nbins)
+	for i := range hg.Counts {
+		hg.Counts[i] += excess / nbins
+	}
+	rest := excess % nbins
+	for i := uint(0); i < rest; i++ {
+		hg.Counts[i*nbins/rest]++
+	}
+}
+
+// tile_pos returns the tile tables pixel p lies between along one axis and
+// the weight of the second one.
+func tile_pos(p, tile, count int) (t0, t1 int, weight float64) {
+	f := (float64(p)+0.5)/float64(tile) - 0.5
+	if f <= 0 {
+		return 0, 0, 0
+	}
+	t0 = int(f)
+	if t0 >= count-1 {
+		return count - 1, count - 1, 0
+	}
+	return t0, t0 + 1, f - float64(t0)
+}
+
+// tile_row_luts computes the tables of tile row r from the pixels of its
+// rows.
+func (self *clahe) tile_row_luts(src_bands []gdal.RasterBand, ndv_def *NdvDef, w, h, workers, r int) ([][][]float64, error) {
+	band_count := len(src_bands)
+	y0, y1 := r*self.tile, (r+1)*self.tile
+	if y1 > h {
+		y1 = h
+	}
+	// one partial histogram per worker, tile column and band
+	partial := make([][][]Histogram, workers)
+	for worker := 0; worker < workers; worker++ {
+		partial[worker] = make([][]Histogram, self.cols)
+		for c := 0; c < self.cols; c++ {
+			partial[worker][c] = make([]Histogram, band_count)
+			for band_idx := 0; band_idx < band_count; band_idx++ {
+				partial[worker][c][band_idx].Binning = self.binnings[band_idx]
+				partial[worker][c][band_idx].Counts = make([]uint, self.binnings[band_idx].Nbins)
+			}
+		}
+	}
+
+	err := for_each_block_in(src_bands, ndv_def, w, y0, y1, workers, func(worker int, blk block, rd *block_reader) error {
+		for band_idx := 0; band_idx < band_count; band_idx++ {
+			binning := self.binnings[band_idx]
+			p := rd.buf_in[band_idx]
+			for i := 0; i < rd.n; i++ {
+				if rd.ndv_mask[i] != 0 {
+					continue
+				}
+				bin, err := binning.ToBin(p[i])
+				if err != nil {
+					return err
+				}
+				c := (blk.off_x + i%blk.size_x) / self.tile
+				partial[worker][c][band_idx].Counts[bin]++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	target := gen_uniform(self.output_range)
+	luts := make([][][]float64, self.cols)
+	for c := 0; c < self.cols; c++ {
+		luts[c] = make([][]float64, band_count)
+		for band_idx := 0; band_idx < band_count; band_idx++ {
+			hg := &partial[0][c][band_idx]
+			for worker := 1; worker < workers; worker++ {
+				for i, cnt := range partial[worker][c][band_idx].Counts {
+					hg.Counts[i] += cnt
+				}
+			}
+			for _, cnt := range hg.Counts {
+				hg.DataCount += cnt
+			}
+			if hg.DataCount == 0 {
+				continue
+			}
+			clip_histogram(hg, self.clip)
+			luts[c][band_idx] = invert_histogram(hg, target, self.output_range)
+		}
+	}
+	return luts, nil
+}
+
+// load_rows makes the tables of tile rows r0..r1 available and drops the
+// ones above.
+func (self *clahe) load_rows(src_bands []gdal.RasterBand, ndv_def *NdvDef, w, h, workers, r0, r1 int) error {
+	for r := range self.luts {
+		if r < r0 {
+			delete(self.luts, r)
+		}
+	}
+	for r := r0; r <= r1; r++ {
+		if _, ok := self.luts[r]; ok {
+			continue
+		}
+		luts, err := self.tile_row_luts(src_bands, ndv_def, w, h, workers, r)
+		if err != nil {
+			return err
+		}
+		self.luts[r] = luts
+	}
+	return nil
+}
+
+// level returns the output level of value v of band band_idx at pixel i of
+// blk, blended from the tables around it.  Tables of tiles without valid
+// pixels are left out; the tile of the pixel itself always has one.
+func (self *clahe) level(band_idx int, blk block, i int, v float64) (float64, error) {
+	binning := self.binnings[band_idx]
+	bin, err := binning.ToBin(v)
+	if err != nil {
+		return 0, err
+	}
+	r0, r1, wy := tile_pos(blk.off_y+i/blk.size_x, self.tile, self.rows)
+	c0, c1, wx := tile_pos(blk.off_x+i%blk.size_x, self.tile, self.cols)
+	corners := [4]struct {
+		r, c   int
+		weight float64
+	}{
+		{r0, c0, (1 - wy) * (1 - wx)},
+		{r0, c1, (1 - wy) * wx},
+		{r1, c0, wy * (1 - wx)},
+		{r1, c1, wy * wx},
+	}
+	var level, total float64
+	for _, corner := range corners {
+		lut := self.luts[corner.r][corner.c][band_idx]
+		if lut == nil || corner.weight == 0 {
+			continue
+		}
+		level += corner.weight * lut[bin]
+		total += corner.weight
+	}
+	return level / total, nil
+}
+
+// transform_blocks is transform_blocks over strips of whole blocks at least
+// one tile high, with the tile tables of every strip loaded beforehand.
+func (self *clahe) transform_blocks(src_bands []gdal.RasterBand, ndv_def *NdvDef, w, h, workers, out_band_count int, with_mask bool,
+	transform func(rd *block_reader, ob *out_block) error, write func(ob *out_block) error) error {
+	_, blocksize_y := src_bands[0].BlockSize()
+	strip := (self.tile + blocksize_y - 1) / blocksize_y * blocksize_y
+	for y0 := 0; y0 < h; y0 += strip {
+		y1 := y0 + strip
+		if y1 > h {
+			y1 = h
+		}
+		r0, _, _ := tile_pos(y0, self.tile, self.rows)
+		_, r1, _ := tile_pos(y1-1, self.tile, self.rows)
+		if err := self.load_rows(src_bands, ndv_def, w, h, workers, r0, r1); err != nil {
+			return err
+		}
+		if err := transform_blocks_in(src_bands, ndv_def, w, y0, y1, workers, out_band_count, with_mask, transform, write); err != nil {
+			return err
+		}
+	}
+	return nil
+}
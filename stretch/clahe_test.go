@@ -0,0 +1,237 @@
+package stretch
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"path/filepath"
+	"testing"
+
+	"github.com/lukeroth/gdal"
+)
+
+func TestClipHistogram(t *testing.T) {
+	cases := []struct {
+		name   string
+		counts []uint
+		clip   float64
+		want   []uint
+	}{
+		{"below the limit", []uint{3, 3, 3, 3}, 2, []uint{3, 3, 3, 3}},
+		// limit 3, excess 7: 1 for every bin and the 3 left spread out
+		{"one peak", []uint{10, 2, 0, 0}, 1, []uint{5, 4, 2, 1}},
+		// limit at least one count
+		{"sparse", []uint{0, 0, 0, 2}, 1, []uint{1, 0, 0, 1}},
+		{"every bin", []uint{8, 8, 8, 8}, 0.5, []uint{8, 8, 8, 8}},
+	}
+	for _, tc := range cases {
+		hg := Histogram{Binning: Binning{Nbins: len(tc.counts)}, Counts: append([]uint(nil), tc.counts...)}
+		for _, cnt := range tc.counts {
+			hg.DataCount += cnt
+		}
+		clip_histogram(&hg, tc.clip)
+		var total uint
+		for i, cnt := range hg.Counts {
+			total += cnt
+			if cnt != tc.want[i] {
+				t.Errorf("%s: got %v, want %v", tc.name, hg.Counts, tc.want)
+				break
+			}
+		}
+		if total != hg.DataCount {
+			t.Errorf("%s: %d counts left of %d", tc.name, total, hg.DataCount)
+		}
+	}
+}
+
+func TestTilePos(t *testing.T) {
+	cases := []struct {
+		p, tile, count int
+		t0, t1         int
+		weight         float64
+	}{
+		// before the centre of the first tile
+		{0, 32, 4, 0, 0, 0},
+		{15, 32, 4, 0, 0, 0},
+		{16, 32, 4, 0, 1, 0.015625},
+		{47, 32, 4, 0, 1, 0.984375},
+		{48, 32, 4, 1, 2, 0.015625},
+		{111, 32, 4, 2, 3, 0.984375},
+		// past the centre of the last tile
+		{112, 32, 4, 3, 3, 0},
+		{127, 32, 4, 3, 3, 0},
+		{5, 8, 1, 0, 0, 0},
+	}
+	for _, tc := range cases {
+		t0, t1, weight := tile_pos(tc.p, tc.tile, tc.count)
+		if t0 != tc.t0 || t1 != tc.t1 || weight != tc.weight {
+			t.Errorf("pixel %d of %d tiles of %d: got %d, %d, %g, want %d, %d, %g",
+				tc.p, tc.count, tc.tile, t0, t1, weight, tc.t0, tc.t1, tc.weight)
+		}
+	}
+}
+
+// ref_clahe is CLAHE of Byte data by brute force: the clipped, equalized
+// table of every tile, blended bilinearly per pixel.
+func ref_clahe(data []float64, ndv []bool, w, h, tile int, clip float64) []float64 {
+	rows, cols := (h+tile-1)/tile, (w+tile-1)/tile
+	luts := make([][][]float64, rows)
+	for r := 0; r < rows; r++ {
+		luts[r] = make([][]float64, cols)
+		for c := 0; c < cols; c++ {
+			counts := make([]uint, 256)
+			var n uint
+			for y := r * tile; y < (r+1)*tile && y < h; y++ {
+				for x := c * tile; x < (c+1)*tile && x < w; x++ {
+					if !ndv[y*w+x] {
+						counts[int(data[y*w+x])]++
+						n++
+					}
+				}
+			}
+			if n == 0 {
+				continue
+			}
+			limit := uint(math.Max(1, clip*float64(n)/256))
+			var excess uint
+			for i := range counts {
+				if counts[i] > limit {
+					excess += counts[i] - limit
+					counts[i] = limit
+				}
+			}
+			for i := range counts {
+				counts[i] += excess / 256
+			}
+			rest := excess % 256
+			for i := uint(0); i < rest; i++ {
+				counts[i*256/rest]++
+			}
+			// every value to the first level whose share reaches the middle
+			// of the value's share
+			lut := make([]float64, 256)
+			var below float64
+			level, level_share := 0, 1.0/256
+			for i := range lut {
+				mid := (below + float64(counts[i])/2) / float64(n)
+				for level < 255 && level_share < mid {
+					level++
+					level_share += 1.0 / 256
+				}
+				lut[i] = float64(level)
+				below += float64(counts[i])
+			}
+			luts[r][c] = lut
+		}
+	}
+	out := make([]float64, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			if ndv[y*w+x] {
+				continue
+			}
+			r0, r1, wy := tile_pos(y, tile, rows)
+			c0, c1, wx := tile_pos(x, tile, cols)
+			var level, weight float64
+			for _, k := range []struct {
+				r, c int
+				w    float64
+			}{{r0, c0, (1 - wy) * (1 - wx)}, {r0, c1, (1 - wy) * wx}, {r1, c0, wy * (1 - wx)}, {r1, c1, wy * wx}} {
+				if luts[k.r][k.c] != nil && k.w != 0 {
+					level += k.w * luts[k.r][k.c][int(data[y*w+x])]
+					weight += k.w
+				}
+			}
+			// level 0 is the output NoData
+			out[y*w+x] = math.Max(1, math.Round(level/weight))
+		}
+	}
+	return out
+}
+
+func TestClahe(t *testing.T) {
+	r := rand.New(rand.NewSource(9))
+	w, h := 301, 217
+	data := make([]float64, w*h)
+	ndv := make([]bool, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			// a ramp above a low-contrast region
+			v := 30 + float64(x)/10 + r.NormFloat64()*5
+			if y > 120 {
+				v = 180 + r.NormFloat64()*3
+			}
+			v = math.Max(1, math.Min(255, math.Round(v)))
+			// a NoData corner covering whole tiles
+			if x < 70 && y < 90 {
+				v = 0
+				ndv[y*w+x] = true
+			}
+			data[y*w+x] = v
+		}
+	}
+	want := ref_clahe(data, ndv, w, h, 32, 3)
+	dir := t.TempDir()
+	src_fn := filepath.Join(dir, "src.tif")
+	dst_fn := filepath.Join(dir, "out.tif")
+	blocks := [][]string{test_tiles, {"BLOCKYSIZE=1"}, {"TILED=YES", "BLOCKXSIZE=64", "BLOCKYSIZE=64"}, {"BLOCKYSIZE=217"}}
+	for _, co := range blocks {
+		write_test_raster(t, src_fn, co, w, h, 1, gdal.Byte, func(b, x, y int) float64 { return data[y*w+x] })
+		for _, workers := range []int{1, 3} {
+			opt := Options{SrcFn: src_fn, DstFn: dst_fn, Mode: "clahe", ClaheTile: 32, ClaheClip: 3, Ndv: [][2]float64{{0, 0}}}
+			opt.Workers = workers
+			if err := Run(&opt); err != nil {
+				t.Fatal(err)
+			}
+			out := read_test_raster(t, dst_fn)
+			diff := 0
+			for i := range want {
+				if out[0][i] != want[i] {
+					diff++
+				}
+			}
+			if diff > 0 {
+				t.Errorf("blocks %v, %d workers: %d pixels differ", co, workers, diff)
+			}
+		}
+	}
+
+	// the low-contrast region is spread out
+	out := read_test_raster(t, dst_fn)
+	_, src_stddev := moments(data[130*w:200*w], -1)
+	_, dst_stddev := moments(out[0][130*w:200*w], -1)
+	if dst_stddev < 3*src_stddev {
+		t.Errorf("low-contrast region stretched from a stddev of %g to %g", src_stddev, dst_stddev)
+	}
+
+	bad := []func(opt *Options){
+		func(opt *Options) { opt.ClaheClip = 0.5 },
+		func(opt *Options) { opt.Link = LinkAll },
+		func(opt *Options) { opt.Transfer = TransferSqrt },
+		func(opt *Options) { opt.Stats = StatsTDigest },
+	}
+	for i, f := range bad {
+		opt := Options{SrcFn: src_fn, DstFn: dst_fn, Mode: "clahe"}
+		f(&opt)
+		if err := Run(&opt); !errors.Is(err, ErrBadArgs) {
+			t.Errorf("bad options %d: got %v, want %v", i, err, ErrBadArgs)
+		}
+	}
+
+	// float input and float output
+	float_fn := test_raster(t, "float", 150, 100, 2, gdal.Float32, func(b, x, y int) float64 { return r.NormFloat64() + float64(x*b) })
+	opt := Options{SrcFn: float_fn, DstFn: dst_fn, Mode: "clahe", ClaheTile: 40, OutputType: gdal.Float32}
+	if err := Run(&opt); err != nil {
+		t.Fatal(err)
+	}
+	out = read_test_raster(t, dst_fn)
+	for b := range out {
+		min, max := math.Inf(1), math.Inf(-1)
+		for _, v := range out[b] {
+			min, max = math.Min(min, v), math.Max(max, v)
+		}
+		if min < 0 || max > 1 || max-min < 0.9 {
+			t.Errorf("band %d: float output within %g..%g", b+1, min, max)
+		}
+	}
+}
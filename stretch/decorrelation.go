@@ -0,0 +1,247 @@
+package stretch
+
+import (
+	"fmt"
+	"log"
+	"math"
+
+	"github.com/lukeroth/gdal"
+)
+
+// Covariance holds the value range, mean and covariance matrix of the
+// bands over the valid pixels.
+type Covariance struct {
+	Count    uint
+	Min, Max []float64
+	Mean     []float64
+	// Cov is the population covariance, Cov[i][j] of bands i and j.
+	Cov   [][]float64
+	delta []float64
+}
+
+func new_covariance(band_count int) *Covariance {
+	self := &Covariance{Min: make([]float64, band_count), Max: make([]float64, band_count),
+		Mean: make([]float64, band_count), Cov: make([][]float64, band_count), delta: make([]float64, band_count)}
+	for band_idx := range self.Cov {
+		self.Cov[band_idx] = make([]float64, band_count)
+	}
+	return self
+}
+
+// add counts pixel x.  Until finish, Cov holds the sums of the products
+// of the deviations from the mean.
+func (self *Covariance) add(x []float64) {
+	self.Count++
+	n := float64(self.Count)
+	for i, v := range x {
+		if self.Count == 1 || v < self.Min[i] {
+			self.Min[i] = v
+		}
+		if self.Count == 1 || v > self.Max[i] {
+			self.Max[i] = v
+		}
+	}
+	delta := self.delta
+	for i := range x {
+		delta[i] = x[i] - self.Mean[i]
+		self.Mean[i] += delta[i] / n
+	}
+	for i := range x {
+		for j := range x {
+			self.Cov[i][j] += delta[i] * (x[j] - self.Mean[j])
+		}
+	}
+}
+
+// merge adds the pixels counted by other, neither being finished.
+func (self *Covariance) merge(other *Covariance) {
+	if other.Count == 0 {
+		return
+	}
+	for i := range self.Min {
+		if self.Count == 0 || other.Min[i] < self.Min[i] {
+			self.Min[i] = other.Min[i]
+		}
+		if self.Count == 0 || other.Max[i] > self.Max[i] {
+			self.Max[i] = other.Max[i]
+		}
+	}
+	n_a, n_b := float64(self.Count), float64(other.Count)
+	n := n_a + n_b
+	delta := make([]float64, len(self.Mean))
+	for i := range delta {
+		delta[i] = other.Mean[i] - self.Mean[i]
+	}
+	for i := range self.Cov {
+		for j := range self.Cov[i] {
+			self.Cov[i][j] += other.Cov[i][j] + delta[i]*delta[j]*n_a*n_b/n
+		}
+	}
+	for i := range self.Mean {
+		self.Mean[i] += delta[i] * n_b / n
+	}
+	self.Count += other.Count
+}
+
+func (self *Covariance) finish() {
+	for i := range self.Cov {
+		for j := range self.Cov[i] {
+			self.Cov[i][j] /= float64(self.Count)
+		}
+	}
+}
+
+// ComputeCovariance computes the covariance of src_bands in one pass,
+// leaving out the pixels masked by ndv_def.
+func ComputeCovariance(src_bands []gdal.RasterBand, ndv_def *NdvDef, w, h int, scan *ScanOptions) (*Covariance, error) {
+	band_count := len(src_bands)
+	cov := new_covariance(band_count)
+
+	// the rounding depends on the order the sums are merged in, so every
+	// block gets its own covariance and these are merged in block order
+	cov_block := func(blk block, rd *block_reader) (interface{}, error) {
+		part := new_covariance(band_count)
+		x := make([]float64, band_count)
+		for i := 0; i < rd.n; i++ {
+			if rd.ndv_mask[i] != 0 {
+				continue
+			}
+			for band_idx := 0; band_idx < band_count; band_idx++ {
+				x[band_idx] = rd.buf_in[band_idx][i]
+			}
+			part.add(x)
+		}
+		return part, nil
+	}
+	merge := func(result interface{}) {
+		cov.merge(result.(*Covariance))
+	}
+	err := scan_blocks(src_bands, ndv_def, w, h, scan, in_block_order(cov_block, merge))
+	if err != nil {
+		return nil, err
+	}
+	if cov.Count == 0 {
+		return nil, ErrNoWindow
+	}
+	cov.finish()
+	return cov, nil
+}
+
+// jacobi_eigen returns the eigenvalues of the symmetric matrix a and the
+// matching eigenvectors as the columns of vectors.
+func jacobi_eigen(a [][]float64) (values []float64, vectors [][]float64) {
+	n := len(a)
+	m := make([][]float64, n)
+	vectors = make([][]float64, n)
+	for i := range m {
+		m[i] = append([]float64(nil), a[i]...)
+		vectors[i] = make([]float64, n)
+		vectors[i][i] = 1
+	}
+	for sweep := 0; sweep < 100; sweep++ {
+		var off, diag float64
+		for p := 0; p < n; p++ {
+			diag += m[p][p] * m[p][p]
+			for q := p + 1; q < n; q++ {
+				off += m[p][q] * m[p][q]
+			}
+		}
+		if off <= 1e-30*diag {
+			break
+		}
+		for p := 0; p < n; p++ {
+			for q := p + 1; q < n; q++ {
+				if m[p][q] == 0 {
+					continue
+				}
+				// rotate rows and columns p and q so m[p][q] vanishes
+				theta := (m[q][q] - m[p][p]) / (2 * m[p][q])
+				t := math.Copysign(1, theta) / (math.Abs(theta) + math.Sqrt(theta*theta+1))
+				c := 1 / math.Sqrt(t*t+1)
+				s := t * c
+				for k := 0; k < n; k++ {
+					m_kp, m_kq := m[k][p], m[k][q]
+					m[k][p] = c*m_kp - s*m_kq
+					m[k][q] = s*m_kp + c*m_kq
+				}
+				for k := 0; k < n; k++ {
+					m_pk, m_qk := m[p][k], m[q][k]
+					m[p][k] = c*m_pk - s*m_qk
+					m[q][k] = s*m_pk + c*m_qk
+				}
+				for k := 0; k < n; k++ {
+					v_kp, v_kq := vectors[k][p], vectors[k][q]
+					vectors[k][p] = c*v_kp - s*v_kq
+					vectors[k][q] = s*v_kp + c*v_kq
+				}
+			}
+		}
+	}
+	values = make([]float64, n)
+	for i := range values {
+		values[i] = m[i][i]
+	}
+	return values, vectors
+}
+
+// check_decorrelation_options validates the options of the
+// "decorrelation" mode, which rotates the bands to their principal
+// components, scales every component to unit variance and rotates back,
+// so the bands become uncorrelated with equal variances.  The result is
+// stretched like -linear-stretch.
+func check_decorrelation_options(opt *Options) error {
+	if opt.Link != LinkNone {
+		return fmt.Errorf("%w: -decorrelation cannot be linked", ErrBadArgs)
+	}
+	if len(opt.StatsFns) > 0 {
+		return fmt.Errorf("%w: -decorrelation needs the pixels of the source, not -stats-from", ErrBadArgs)
+	}
+	if opt.DstStddev <= 0 || opt.DstAvg < 0 {
+		return fmt.Errorf("%w: -decorrelation needs a positive stddev and a non-negative mean", ErrBadArgs)
+	}
+	return nil
+}
+
+// decorrelation maps the pixels of all bands to the decorrelated bands.
+type decorrelation struct {
+	mean   []float64
+	matrix [][]float64
+}
+
+// new_decorrelation returns the decorrelation of cov.  Components of no
+// variance, e.g. of a constant or duplicated band, are dropped.
+func new_decorrelation(cov *Covariance) *decorrelation {
+	n := len(cov.Mean)
+	values, vectors := jacobi_eigen(cov.Cov)
+	var largest float64
+	for _, v := range values {
+		largest = math.Max(largest, v)
+	}
+	scales := make([]float64, n)
+	for k, v := range values {
+		if v > largest*1e-12 {
+			scales[k] = 1 / math.Sqrt(v)
+		}
+		log.Printf("component %d: variance=%f\n", k+1, v)
+	}
+	self := &decorrelation{mean: cov.Mean, matrix: make([][]float64, n)}
+	for i := 0; i < n; i++ {
+		self.matrix[i] = make([]float64, n)
+		for j := 0; j < n; j++ {
+			for k := 0; k < n; k++ {
+				self.matrix[i][j] += vectors[i][k] * scales[k] * vectors[j][k]
+			}
+		}
+	}
+	return self
+}
+
+// band_value returns decorrelated band band_idx of pixel i of rd, of mean 0
+// and variance 1.
+func (self *decorrelation) band_value(band_idx int, rd *block_reader, i int) float64 {
+	var v float64
+	for j, m := range self.matrix[band_idx] {
+		v += m * (rd.buf_in[j][i] - self.mean[j])
+	}
+	return v
+}
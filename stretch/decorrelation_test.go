@@ -0,0 +1,227 @@
+package stretch
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"path/filepath"
+	"testing"
+
+	"github.com/lukeroth/gdal"
+)
+
+func TestJacobiEigen(t *testing.T) {
+	cases := [][][]float64{
+		{{2, 0}, {0, 3}},
+		{{4, 1}, {1, 3}},
+		{{1, 1}, {1, 1}},
+		{{90000, 84000, 30000}, {84000, 80000, 28800}, {30000, 28800, 10500}},
+		{{2, -1, 0, 0}, {-1, 2, -1, 0}, {0, -1, 2, -1}, {0, 0, -1, 2}},
+	}
+	for _, a := range cases {
+		values, vectors := jacobi_eigen(a)
+		n := len(a)
+		scale := 0.0
+		for _, v := range values {
+			scale = math.Max(scale, math.Abs(v))
+		}
+		for k := 0; k < n; k++ {
+			// a v = lambda v, with unit v orthogonal to the others
+			for i := 0; i < n; i++ {
+				var av float64
+				for j := 0; j < n; j++ {
+					av += a[i][j] * vectors[j][k]
+				}
+				if math.Abs(av-values[k]*vectors[i][k]) > 1e-9*scale {
+					t.Errorf("%v: eigenpair %d is off by %g", a, k, av-values[k]*vectors[i][k])
+				}
+			}
+			for l := 0; l < n; l++ {
+				var dot float64
+				for i := 0; i < n; i++ {
+					dot += vectors[i][k] * vectors[i][l]
+				}
+				want := 0.0
+				if k == l {
+					want = 1
+				}
+				if math.Abs(dot-want) > 1e-9 {
+					t.Errorf("%v: vectors %d and %d have dot product %g", a, k, l, dot)
+				}
+			}
+		}
+	}
+}
+
+func TestNewDecorrelation(t *testing.T) {
+	cases := []struct {
+		name string
+		cov  [][]float64
+		// rank of the whitened covariance, which is the identity on the
+		// components that are kept
+		rank int
+	}{
+		{"uncorrelated", [][]float64{{4, 0}, {0, 9}}, 2},
+		{"correlated", [][]float64{{90000, 84000, 30000}, {84000, 80000, 28800}, {30000, 28800, 10500}}, 3},
+		{"duplicated band", [][]float64{{4, 4, 1}, {4, 4, 1}, {1, 1, 2}}, 2},
+	}
+	for _, tc := range cases {
+		n := len(tc.cov)
+		dc := new_decorrelation(&Covariance{Mean: make([]float64, n), Cov: tc.cov})
+		// whitened = M cov M^T
+		var trace float64
+		for i := 0; i < n; i++ {
+			for j := 0; j < n; j++ {
+				var v float64
+				for k := 0; k < n; k++ {
+					for l := 0; l < n; l++ {
+						v += dc.matrix[i][k] * tc.cov[k][l] * dc.matrix[j][l]
+					}
+				}
+				if i == j {
+					trace += v
+				} else if tc.rank == n && math.Abs(v) > 1e-6 {
+					t.Errorf("%s: bands %d and %d still have covariance %g", tc.name, i+1, j+1, v)
+				}
+				if tc.rank == n && i == j && math.Abs(v-1) > 1e-6 {
+					t.Errorf("%s: band %d has variance %g", tc.name, i+1, v)
+				}
+			}
+		}
+		if math.Abs(trace-float64(tc.rank)) > 1e-6 {
+			t.Errorf("%s: total variance %g, want %d", tc.name, trace, tc.rank)
+		}
+	}
+}
+
+func TestCovarianceMerge(t *testing.T) {
+	r := rand.New(rand.NewSource(5))
+	all, parts := new_covariance(2), []*Covariance{new_covariance(2), new_covariance(2), new_covariance(2)}
+	for i := 0; i < 1000; i++ {
+		a := r.NormFloat64()
+		x := []float64{10 + 3*a, -5 + 2*a + r.NormFloat64()}
+		all.add(x)
+		// the last part stays empty
+		parts[i%2].add(x)
+	}
+	merged := parts[0]
+	merged.merge(parts[1])
+	merged.merge(parts[2])
+	all.finish()
+	merged.finish()
+	for i := 0; i < 2; i++ {
+		if merged.Min[i] != all.Min[i] || merged.Max[i] != all.Max[i] || math.Abs(merged.Mean[i]-all.Mean[i]) > 1e-9 {
+			t.Errorf("band %d: merged %g..%g mean %g, want %g..%g mean %g", i+1, merged.Min[i], merged.Max[i], merged.Mean[i], all.Min[i], all.Max[i], all.Mean[i])
+		}
+		for j := 0; j < 2; j++ {
+			if math.Abs(merged.Cov[i][j]-all.Cov[i][j]) > 1e-9 {
+				t.Errorf("cov %d,%d: merged %g, want %g", i, j, merged.Cov[i][j], all.Cov[i][j])
+			}
+		}
+	}
+}
+
+// correlation returns the correlation of a and b and the stddev of a over
+// the pixels where x >= x0.
+func correlation(a, b []float64, w, x0 int) (float64, float64) {
+	var ma, mb, n float64
+	for i := range a {
+		if i%w >= x0 {
+			ma += a[i]
+			mb += b[i]
+			n++
+		}
+	}
+	ma /= n
+	mb /= n
+	var sab, saa, sbb float64
+	for i := range a {
+		if i%w >= x0 {
+			sab += (a[i] - ma) * (b[i] - mb)
+			saa += (a[i] - ma) * (a[i] - ma)
+			sbb += (b[i] - mb) * (b[i] - mb)
+		}
+	}
+	return sab / math.Sqrt(saa*sbb), math.Sqrt(saa / n)
+}
+
+func TestDecorrelation(t *testing.T) {
+	r := rand.New(rand.NewSource(3))
+	w, h := 250, 180
+	base := make([][3]float64, w*h)
+	for i := range base {
+		a, b, c := r.NormFloat64(), r.NormFloat64(), r.NormFloat64()
+		base[i] = [3]float64{1000 + 300*a, 2000 + 280*a + 40*b, 500 + 100*a + 20*b + 10*c}
+	}
+	// no-data in the first 10 columns
+	src_fn := test_raster(t, "dcs", w, h, 3, gdal.UInt16, func(b, x, y int) float64 {
+		if x < 10 {
+			return 0
+		}
+		return math.Round(base[y*w+x][b])
+	})
+	dir := t.TempDir()
+	var outs [][][]float64
+	for _, workers := range []int{1, 4} {
+		opt := Options{SrcFn: src_fn, DstFn: filepath.Join(dir, "out.tif"), SaveParams: filepath.Join(dir, "params.json"),
+			Mode: "decorrelation", DstAvg: 0.5 * 65535, DstStddev: 6000, OutputType: gdal.Float64, Ndv: [][2]float64{{0, 0}}}
+		opt.Workers = workers
+		if err := Run(&opt); err != nil {
+			t.Fatal(err)
+		}
+		outs = append(outs, read_test_raster(t, opt.DstFn))
+	}
+	for b := range outs[0] {
+		for i := range outs[0][b] {
+			if outs[0][b][i] != outs[1][b][i] {
+				t.Fatalf("band %d pixel %d: %g with 1 worker, %g with 4", b+1, i, outs[0][b][i], outs[1][b][i])
+			}
+		}
+	}
+	out := outs[0]
+	for _, pair := range [][2]int{{0, 1}, {0, 2}, {1, 2}} {
+		corr, stddev := correlation(out[pair[0]], out[pair[1]], w, 10)
+		if math.Abs(corr) > 1e-3 || math.Abs(stddev*65535-6000) > 10 {
+			t.Errorf("bands %d and %d: correlation %g, stddev %g levels", pair[0]+1, pair[1]+1, corr, stddev*65535)
+		}
+	}
+
+	// the saved statistics are those of the covariance pass
+	params, err := LoadParams(filepath.Join(dir, "params.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for b, bp := range params.Bands {
+		if bp.Stats.Count != uint((w-10)*h) || !(bp.Stats.Min < bp.Stats.Mean && bp.Stats.Mean < bp.Stats.Max) || bp.Stats.Stddev <= 0 {
+			t.Errorf("band %d: saved %+v", b+1, bp.Stats)
+		}
+	}
+
+	// a duplicated band, to Byte through a transfer curve
+	opt := Options{SrcFn: src_fn, DstFn: filepath.Join(dir, "out.tif"), Bands: []int{1, 2, 2}, Transfer: TransferSqrt,
+		Mode: "decorrelation", DstAvg: 128, DstStddev: 40, Ndv: [][2]float64{{0, 0}}}
+	if err := Run(&opt); err != nil {
+		t.Fatal(err)
+	}
+	for b, band := range read_test_raster(t, opt.DstFn) {
+		if _, stddev := moments(band, 0); stddev < 10 {
+			t.Errorf("duplicated band %d: stddev %g levels", b+1, stddev)
+		}
+	}
+
+	bad := []struct {
+		name string
+		opt  Options
+	}{
+		{"no stddev", Options{DstAvg: 128}},
+		{"linked", Options{DstAvg: 128, DstStddev: 3, Link: LinkAll}},
+		{"t-digest", Options{DstAvg: 128, DstStddev: 40, Stats: StatsTDigest}},
+	}
+	for _, tc := range bad {
+		opt := tc.opt
+		opt.SrcFn, opt.DstFn, opt.Mode = src_fn, filepath.Join(dir, "out.tif"), "decorrelation"
+		if err := Run(&opt); !errors.Is(err, ErrBadArgs) {
+			t.Errorf("%s: got %v, want %v", tc.name, err, ErrBadArgs)
+		}
+	}
+}
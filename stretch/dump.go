@@ -0,0 +1,137 @@
+package stretch
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+)
+
+type DumpFormat int
+
+const (
+	// DumpCSV writes one band,bin,value,lo,hi,count row per bin, after a
+	// "# band=... min=... ..." comment line per band with its statistics.
+	DumpCSV DumpFormat = iota
+	// DumpJSON writes {"bands": [...]} with the statistics of every band and
+	// its bins as the columns bin, value, lo, hi and count.  Values that are not
+	// finite are null.
+	DumpJSON
+)
+
+// dump_histograms writes the histograms of the source bands bandlist to
+// opt.DstFn, or stdout if it is empty or "-", as opt.DumpFormat.
+func dump_histograms(opt *Options, bandlist []int, histograms []Histogram) error {
+	dumped := make([]Histogram, len(histograms))
+	bins := make([][]int, len(histograms))
+	for band_idx := range histograms {
+		hg := &histograms[band_idx]
+		dumped[band_idx] = *hg
+		if opt.DumpBins > 0 && hg.Nbins > opt.DumpBins && hg.DataCount > 0 {
+			rebinned, err := hg.Rebin(LinearBinning(hg.Min, hg.Max, opt.DumpBins))
+			if err != nil {
+				return err
+			}
+			dumped[band_idx] = rebinned
+		}
+		for i, cnt := range dumped[band_idx].Counts {
+			if cnt > 0 || opt.DumpEmptyBins {
+				bins[band_idx] = append(bins[band_idx], i)
+			}
+		}
+	}
+
+	out := os.Stdout
+	if len(opt.DstFn) > 0 && opt.DstFn != "-" {
+		f, err := os.Create(opt.DstFn)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+	// write errors stick to bw and are returned by Flush
+	bw := bufio.NewWriter(out)
+	if opt.DumpFormat == DumpJSON {
+		dump_json(bw, bandlist, histograms, dumped, bins)
+	} else {
+		dump_csv(bw, bandlist, histograms, dumped, bins)
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	if out != os.Stdout {
+		return out.Close()
+	}
+	return nil
+}
+
+func format_float(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// dump_csv writes bins of the dumped histograms.  The statistics are those
+// of histograms, i.e. of the band values rather than the bins.
+func dump_csv(w *bufio.Writer, bandlist []int, histograms, dumped []Histogram, bins [][]int) {
+	for band_idx := range histograms {
+		hg := &histograms[band_idx]
+		fmt.Fprintf(w, "# band=%d nbins=%d min=%s max=%s mean=%s stddev=%s valid_count=%d ndv_count=%d\n", bandlist[band_idx], dumped[band_idx].Nbins,
+			format_float(hg.Min), format_float(hg.Max), format_float(hg.Mean), format_float(hg.Stddev), hg.DataCount, hg.NdvCount)
+	}
+	w.WriteString("band,bin,value,lo,hi,count\n")
+	for band_idx := range dumped {
+		hg := &dumped[band_idx]
+		for _, i := range bins[band_idx] {
+			lo, hi := hg.Binning.bin_edges(i)
+			fmt.Fprintf(w, "%d,%d,%s,%s,%s,%d\n", bandlist[band_idx], i,
+				format_float(hg.Binning.FromBin(i)), format_float(lo), format_float(hi), hg.Counts[i])
+		}
+	}
+}
+
+// json_float formats v as a JSON number, or null if it has none.
+func json_float(v float64) string {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return "null"
+	}
+	return format_float(v)
+}
+
+// dump_json is dump_csv as JSON.  The bins are written column by column,
+// so a band of millions of bins is never held as JSON values in memory.
+func dump_json(w *bufio.Writer, bandlist []int, histograms, dumped []Histogram, bins [][]int) {
+	w.WriteString("{\"bands\": [")
+	for band_idx := range histograms {
+		if band_idx > 0 {
+			w.WriteString(",")
+		}
+		hg := &histograms[band_idx]
+		fmt.Fprintf(w, "\n  {\"band\": %d, \"nbins\": %d, \"min\": %s, \"max\": %s, \"mean\": %s, \"stddev\": %s, \"valid_count\": %d, \"ndv_count\": %d",
+			bandlist[band_idx], dumped[band_idx].Nbins, json_float(hg.Min), json_float(hg.Max), json_float(hg.Mean), json_float(hg.Stddev), hg.DataCount, hg.NdvCount)
+		binning := &dumped[band_idx].Binning
+		counts := dumped[band_idx].Counts
+		columns := []struct {
+			name  string
+			value func(i int) string
+		}{
+			{"bin", strconv.Itoa},
+			{"value", func(i int) string { return json_float(binning.FromBin(i)) }},
+			{"lo", func(i int) string { lo, _ := binning.bin_edges(i); return json_float(lo) }},
+			{"hi", func(i int) string { _, hi := binning.bin_edges(i); return json_float(hi) }},
+			{"count", func(i int) string { return strconv.FormatUint(uint64(counts[i]), 10) }},
+		}
+		for _, col := range columns {
+			fmt.Fprintf(w, ",\n   \"%s\": [", col.name)
+			for j, i := range bins[band_idx] {
+				if j > 0 {
+					w.WriteString(",")
+				}
+				w.WriteString(col.value(i))
+			}
+			w.WriteString("]")
+		}
+		w.WriteString("}")
+	}
+	w.WriteString("\n]}\n")
+}
@@ -0,0 +1,150 @@
+package stretch
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/lukeroth/gdal"
+)
+
+func TestRebin(t *testing.T) {
+	hg := Histogram{Binning: Binning{Nbins: 10, Offset: 100, Scale: 1}, Counts: []uint{1, 2, 0, 0, 3, 0, 0, 0, 4, 5}, Min: 100, Max: 109, NdvCount: 2}
+	hg.update_stats()
+	cases := []struct {
+		binning Binning
+		want    []uint
+	}{
+		{LinearBinning(100, 109, 4), []uint{3, 3, 0, 9}},
+		{LinearBinning(100, 109, 2), []uint{6, 9}},
+		{Binning{Nbins: 10, Offset: 100, Scale: 1}, hg.Counts},
+	}
+	for _, tc := range cases {
+		got, err := hg.Rebin(tc.binning)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.DataCount != hg.DataCount || got.Min != hg.Min || got.Max != hg.Max || got.NdvCount != hg.NdvCount {
+			t.Errorf("%d bins: got %d values within %g..%g", tc.binning.Nbins, got.DataCount, got.Min, got.Max)
+		}
+		for i := range tc.want {
+			if got.Counts[i] != tc.want[i] {
+				t.Errorf("%d bins: got %v, want %v", tc.binning.Nbins, got.Counts, tc.want)
+				break
+			}
+		}
+	}
+}
+
+func TestDump(t *testing.T) {
+	r := rand.New(rand.NewSource(3))
+	dir := t.TempDir()
+	for _, dt := range []gdal.DataType{gdal.UInt16, gdal.Float32} {
+		// NoData in the first two columns
+		src_fn := test_raster(t, "src"+dt.Name(), 90, 70, 2, dt, func(b, x, y int) float64 {
+			if x < 2 {
+				return 0
+			}
+			return float64(r.Intn(2000))*1.5 + 1 + float64(b)*100
+		})
+		const valid = 88 * 70
+		for _, dump_bins := range []int{0, 50} {
+			for _, empty := range []bool{false, true} {
+				// 8192 bins for each Float32 band
+				opt := Options{SrcFn: src_fn, DstFn: filepath.Join(dir, "h.csv"), DumpHistogram: true, Ndv: [][2]float64{{0, 0}},
+					DumpBins: dump_bins, DumpEmptyBins: empty, HistogramMemory: 2 * min_histogram_memory}
+				name := dt.Name() + " " + strconv.Itoa(dump_bins) + " bins"
+				if err := Run(&opt); err != nil {
+					t.Fatal(err)
+				}
+				data, err := os.ReadFile(opt.DstFn)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var comments int
+				var body []string
+				for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+					if strings.HasPrefix(line, "#") {
+						comments++
+					} else {
+						body = append(body, line)
+					}
+				}
+				records, err := csv.NewReader(strings.NewReader(strings.Join(body, "\n"))).ReadAll()
+				if err != nil {
+					t.Fatal(err)
+				}
+				counts, rows := map[string]int{}, map[string]int{}
+				for _, rec := range records[1:] {
+					cnt, err := strconv.Atoi(rec[5])
+					if err != nil {
+						t.Fatal(err)
+					}
+					counts[rec[0]] += cnt
+					rows[rec[0]]++
+				}
+				if comments != 2 || counts["1"] != valid || counts["2"] != valid {
+					t.Errorf("%s: %d comment lines, counts %v", name, comments, counts)
+				}
+				if dump_bins > 0 && empty && rows["1"] != dump_bins {
+					t.Errorf("%s: %d rows for band 1", name, rows["1"])
+				}
+
+				opt.DumpFormat, opt.DstFn = DumpJSON, filepath.Join(dir, "h.json")
+				if err := Run(&opt); err != nil {
+					t.Fatal(err)
+				}
+				if data, err = os.ReadFile(opt.DstFn); err != nil {
+					t.Fatal(err)
+				}
+				var doc struct {
+					Bands []struct {
+						Band       int
+						Mean       *float64
+						ValidCount uint `json:"valid_count"`
+						Bin        []int
+						Value      []*float64
+						Count      []uint
+					}
+				}
+				if err := json.Unmarshal(data, &doc); err != nil {
+					t.Fatal(err)
+				}
+				for _, band := range doc.Bands {
+					var total uint
+					for _, cnt := range band.Count {
+						total += cnt
+					}
+					if band.Mean == nil || total != band.ValidCount || len(band.Value) != len(band.Count) || len(band.Bin) != rows[strconv.Itoa(band.Band)] {
+						t.Errorf("%s: JSON band %d has %d of %d values in %d bins", name, band.Band, total, band.ValidCount, len(band.Bin))
+					}
+				}
+			}
+		}
+	}
+
+	// no data: null statistics in JSON
+	opt := Options{SrcFn: test_raster(t, "empty", 10, 10, 1, gdal.Byte, func(b, x, y int) float64 { return 0 }),
+		DstFn: filepath.Join(dir, "empty.json"), DumpHistogram: true, DumpFormat: DumpJSON, Ndv: [][2]float64{{0, 0}}}
+	if err := Run(&opt); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(opt.DstFn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc struct {
+		Bands []struct{ Mean, Stddev *float64 }
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		t.Fatal(err)
+	}
+	if len(doc.Bands) != 1 || doc.Bands[0].Mean != nil || doc.Bands[0].Stddev != nil {
+		t.Errorf("no data dumped as %s", data)
+	}
+}
@@ -0,0 +1,23 @@
+package stretch
+
+import "errors"
+
+var (
+	ErrNoMode           = errors.New("one mode to choose")
+	ErrMissingSrcFn     = errors.New("missing srcfn")
+	ErrMissingDstFn     = errors.New("missing dstfn")
+	ErrBadArgs          = errors.New("wrong args")
+	ErrNdvAndValidRange = errors.New("you cannot use both Ndv and ValidRange")
+	ErrEmptyRaster      = errors.New("missing width/height")
+	ErrBandOutOfRange   = errors.New("bandid out of range")
+	ErrCreateOutput     = errors.New("couldn't create output")
+	ErrNanInToBin       = errors.New("nan in to_bin")
+	ErrBinningMismatch  = errors.New("histograms use different binnings")
+	ErrNoWindow         = errors.New("impossible: could not find window")
+	ErrUnsupportedType  = errors.New("unsupported data type")
+	ErrGdal             = errors.New("gdal call failed")
+	ErrBadTarget        = errors.New("bad target distribution")
+	ErrBadParams        = errors.New("bad stretch parameters")
+	ErrBatchFailed      = errors.New("batch failed")
+	ErrBatchStopped     = errors.New("not run after an earlier failure")
+)
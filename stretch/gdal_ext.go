@@ -0,0 +1,131 @@
+package stretch
+
+// The gdal binding has no accessors for GCPs, its metadata list getter
+// does not stop at the terminating NULL and its default histogram getter
+// neither frees the counts nor tells whether there are any, so these few
+// calls go straight to the C API.
+
+/*
+#cgo pkg-config: gdal
+#include <stdlib.h>
+#include "gdal.h"
+#include "cpl_vsi.h"
+*/
+import "C"
+
+import (
+	"unsafe"
+
+	"github.com/lukeroth/gdal"
+)
+
+// The binding's Dataset and RasterBand types hold nothing but the C handle.
+func dataset_handle(ds *gdal.Dataset) C.GDALDatasetH {
+	return *(*C.GDALDatasetH)(unsafe.Pointer(ds))
+}
+
+func band_handle(band *gdal.RasterBand) C.GDALRasterBandH {
+	return *(*C.GDALRasterBandH)(unsafe.Pointer(band))
+}
+
+func get_metadata(obj C.GDALMajorObjectH, domain string) []string {
+	c_domain := C.CString(domain)
+	defer C.free(unsafe.Pointer(c_domain))
+
+	p := C.GDALGetMetadata(obj, c_domain)
+	if p == nil {
+		return nil
+	}
+	var md []string
+	for {
+		item := *(**C.char)(unsafe.Pointer(p))
+		if item == nil {
+			break
+		}
+		md = append(md, C.GoString(item))
+		p = (**C.char)(unsafe.Pointer(uintptr(unsafe.Pointer(p)) + unsafe.Sizeof(item)))
+	}
+	return md
+}
+
+func set_metadata(obj C.GDALMajorObjectH, md []string, domain string) error {
+	c_domain := C.CString(domain)
+	defer C.free(unsafe.Pointer(c_domain))
+
+	c_md := make([]*C.char, len(md)+1)
+	for i, item := range md {
+		c_md[i] = C.CString(item)
+		defer C.free(unsafe.Pointer(c_md[i]))
+	}
+	if C.GDALSetMetadata(obj, &c_md[0], c_domain) != C.CE_None {
+		return ErrGdal
+	}
+	return nil
+}
+
+func dataset_metadata(ds *gdal.Dataset, domain string) []string {
+	return get_metadata(C.GDALMajorObjectH(dataset_handle(ds)), domain)
+}
+
+func set_dataset_metadata(ds *gdal.Dataset, md []string, domain string) error {
+	return set_metadata(C.GDALMajorObjectH(dataset_handle(ds)), md, domain)
+}
+
+func band_metadata(band *gdal.RasterBand, domain string) []string {
+	return get_metadata(C.GDALMajorObjectH(band_handle(band)), domain)
+}
+
+func set_band_metadata(band *gdal.RasterBand, md []string, domain string) error {
+	return set_metadata(C.GDALMajorObjectH(band_handle(band)), md, domain)
+}
+
+// copy_gcps copies the ground control points and their projection.
+func copy_gcps(dst_ds, src_ds *gdal.Dataset) error {
+	src := dataset_handle(src_ds)
+	count := C.GDALGetGCPCount(src)
+	if count == 0 {
+		return nil
+	}
+	if C.GDALSetGCPs(dataset_handle(dst_ds), count, C.GDALGetGCPs(src), C.GDALGetGCPProjection(src)) != C.CE_None {
+		return ErrGdal
+	}
+	return nil
+}
+
+// dataset_description is the name the dataset was opened with, which can
+// be passed to gdal.Open again.
+func dataset_description(ds *gdal.Dataset) string {
+	return C.GoString(C.GDALGetDescription(C.GDALMajorObjectH(dataset_handle(ds))))
+}
+
+// default_histogram returns the default histogram of band, as kept in its
+// PAM metadata, without computing one.  The counts are evenly spread
+// between min and max.
+func default_histogram(band *gdal.RasterBand) (min, max float64, counts []uint, ok bool) {
+	var (
+		c_min, c_max C.double
+		buckets      C.int
+		c_counts     *C.GUIntBig
+	)
+	if C.GDALGetDefaultHistogramEx(band_handle(band), &c_min, &c_max, &buckets, &c_counts, 0, nil, nil) != C.CE_None || c_counts == nil {
+		return 0, 0, nil, false
+	}
+	defer C.VSIFree(unsafe.Pointer(c_counts))
+	src := (*[1 << 30]C.GUIntBig)(unsafe.Pointer(c_counts))[:buckets:buckets]
+	counts = make([]uint, int(buckets))
+	for i, cnt := range src {
+		counts[i] = uint(cnt)
+	}
+	return float64(c_min), float64(c_max), counts, true
+}
+
+func set_default_histogram(band *gdal.RasterBand, min, max float64, counts []uint) error {
+	c_counts := make([]C.GUIntBig, len(counts))
+	for i, cnt := range counts {
+		c_counts[i] = C.GUIntBig(cnt)
+	}
+	if C.GDALSetDefaultHistogramEx(band_handle(band), C.double(min), C.double(max), C.int(len(counts)), &c_counts[0]) != C.CE_None {
+		return ErrGdal
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package stretch
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/lukeroth/gdal"
+)
+
+// LinkMode selects whether the bands share one stretch, which keeps the
+// colour balance of composites.
+type LinkMode int
+
+const (
+	// LinkNone stretches every band on its own.
+	LinkNone LinkMode = iota
+	// LinkAll stretches all bands with the merged histogram of all bands,
+	// like "stretch using all bands" in ENVI and QGIS.
+	LinkAll
+	// LinkLuminance stretches all bands with the histogram of the
+	// luminance, a weighted mean of the bands.
+	LinkLuminance
+)
+
+// luma_weights returns the normalised luminance weights for band_count
+// bands: Options.LumaWeights if set, Rec. 601 for three bands in R, G, B
+// order, equal weights otherwise.
+func luma_weights(opt *Options, band_count int) ([]float64, error) {
+	weights := opt.LumaWeights
+	switch {
+	case len(weights) > 0:
+		if len(weights) != band_count {
+			return nil, fmt.Errorf("%w: got %d luminance weights for %d bands", ErrBadArgs, len(weights), band_count)
+		}
+	case band_count == 3:
+		weights = []float64{0.299, 0.587, 0.114}
+	default:
+		weights = make([]float64, band_count)
+		for band_idx := range weights {
+			weights[band_idx] = 1
+		}
+	}
+	var total float64
+	for _, v := range weights {
+		if v < 0 {
+			return nil, fmt.Errorf("%w: negative luminance weight", ErrBadArgs)
+		}
+		total += v
+	}
+	if total == 0 {
+		return nil, fmt.Errorf("%w: luminance weights sum to 0", ErrBadArgs)
+	}
+	normalised := make([]float64, band_count)
+	for band_idx, v := range weights {
+		normalised[band_idx] = v / total
+	}
+	return normalised, nil
+}
+
+func same_binning(binnings []Binning) bool {
+	for _, binning := range binnings[1:] {
+		if binning != binnings[0] {
+			return false
+		}
+	}
+	return true
+}
+
+// value_range returns the smallest range holding every band of minmax.
+func value_range(minmax [][2]float64) (min, max float64) {
+	min, max = minmax[0][0], minmax[0][1]
+	for _, mm := range minmax[1:] {
+		min = math.Min(min, mm[0])
+		max = math.Max(max, mm[1])
+	}
+	return min, max
+}
+
+// ComputeLuminanceHistogram counts the weighted mean of the bands of every
+// valid pixel.  weights must sum to 1 so the luminance stays within the
+// values covered by binning.
+func ComputeLuminanceHistogram(src_bands []gdal.RasterBand, ndv_def *NdvDef, w, h int, weights []float64, binning Binning, scan *ScanOptions) (Histogram, error) {
+	workers := scan_workers(scan)
+	partial := make([]Histogram, workers)
+	first_valid_pixel := make([]bool, workers)
+	for worker := 0; worker < workers; worker++ {
+		partial[worker].Binning = binning
+		partial[worker].Counts = make([]uint, binning.Nbins)
+	}
+
+	err := scan_blocks(src_bands, ndv_def, w, h, scan, func(worker int, blk block, rd *block_reader) error {
+		hg := &partial[worker]
+		for i := 0; i < rd.n; i++ {
+			if rd.ndv_mask[i] != 0 {
+				hg.NdvCount++
+				continue
+			}
+			var v float64
+			for band_idx, weight := range weights {
+				v += weight * rd.buf_in[band_idx][i]
+			}
+			if !hg.Binning.counts(v) {
+				continue
+			}
+			bin, err := hg.Binning.ToBin(v)
+			if err != nil {
+				return err
+			}
+			hg.Counts[bin]++
+			if !first_valid_pixel[worker] {
+				hg.Min = v
+				hg.Max = v
+				first_valid_pixel[worker] = true
+			}
+			if v < hg.Min {
+				hg.Min = v
+			}
+			if v > hg.Max {
+				hg.Max = v
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return Histogram{}, err
+	}
+
+	hg := partial[0]
+	hg.update_stats()
+	for worker := 1; worker < workers; worker++ {
+		other := &partial[worker]
+		other.update_stats()
+		if err := hg.Merge(other); err != nil {
+			return Histogram{}, err
+		}
+	}
+	return hg, nil
+}
+
+// merge_histograms merges the histograms of all bands, which must share
+// their binning.
+func merge_histograms(histograms []Histogram) (Histogram, error) {
+	merged := Histogram{Binning: histograms[0].Binning, Counts: make([]uint, histograms[0].Nbins)}
+	for band_idx := range histograms {
+		if err := merged.Merge(&histograms[band_idx]); err != nil {
+			return Histogram{}, err
+		}
+	}
+	return merged, nil
+}
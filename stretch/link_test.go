@@ -0,0 +1,101 @@
+package stretch
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"path/filepath"
+	"testing"
+
+	"github.com/lukeroth/gdal"
+)
+
+func TestLumaWeights(t *testing.T) {
+	cases := []struct {
+		weights    []float64
+		band_count int
+		want       []float64
+	}{
+		{nil, 3, []float64{0.299, 0.587, 0.114}},
+		{nil, 2, []float64{0.5, 0.5}},
+		{[]float64{1, 1, 2}, 3, []float64{0.25, 0.25, 0.5}},
+		{[]float64{0, 3}, 2, []float64{0, 1}},
+	}
+	for _, tc := range cases {
+		got, err := luma_weights(&Options{LumaWeights: tc.weights}, tc.band_count)
+		if err != nil {
+			t.Errorf("%v for %d bands: %v", tc.weights, tc.band_count, err)
+			continue
+		}
+		for i := range got {
+			if math.Abs(got[i]-tc.want[i]) > 1e-12 {
+				t.Errorf("%v for %d bands: got %v, want %v", tc.weights, tc.band_count, got, tc.want)
+				break
+			}
+		}
+	}
+	for _, weights := range [][]float64{{1, 1}, {1, -1, 1}, {0, 0, 0}} {
+		if _, err := luma_weights(&Options{LumaWeights: weights}, 3); !errors.Is(err, ErrBadArgs) {
+			t.Errorf("%v: got %v, want %v", weights, err, ErrBadArgs)
+		}
+	}
+}
+
+func TestLink(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	// the bands 50 apart
+	sources := []string{
+		test_raster(t, "rgbf", 200, 100, 3, gdal.Float32, func(b, x, y int) float64 { return r.NormFloat64()*10 + float64(b)*50 }),
+		test_raster(t, "rgb8", 200, 100, 3, gdal.Byte, func(b, x, y int) float64 { return float64(r.Intn(100) + b*50) }),
+	}
+	dir := t.TempDir()
+	for _, src_fn := range sources {
+		src := read_test_raster(t, src_fn)
+		for _, stats := range []StatsEngine{StatsHistogram, StatsTDigest} {
+			for _, link := range []LinkMode{LinkNone, LinkAll, LinkLuminance} {
+				opt := Options{SrcFn: src_fn, DstFn: filepath.Join(dir, "out.tif"), Link: link, Stats: stats,
+					Mode: "percentile", FromPercentile: []float64{0.01}, ToPercentile: []float64{0.99}}
+				opt.Workers = 2
+				err := Run(&opt)
+				if stats == StatsTDigest && link == LinkLuminance {
+					if !errors.Is(err, ErrBadArgs) {
+						t.Errorf("%s: t-digest luminance: got %v, want %v", filepath.Base(src_fn), err, ErrBadArgs)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				out := read_test_raster(t, opt.DstFn)
+				var means []float64
+				for b := range out {
+					mean, _ := moments(out[b], -1)
+					means = append(means, mean)
+				}
+				if link == LinkNone {
+					// every band over the whole output range
+					for b := range means {
+						if math.Abs(means[b]-means[0]) > 10 {
+							t.Errorf("%s stats %d unlinked: band means %v", filepath.Base(src_fn), stats, means)
+							break
+						}
+					}
+					continue
+				}
+				// one stretch: the bands keep their order
+				if !(means[0] < means[1] && means[1] < means[2]) {
+					t.Errorf("%s stats %d link %d: band means %v", filepath.Base(src_fn), stats, link, means)
+				}
+				level := map[float64]float64{}
+				for b := range src {
+					for i, v := range src[b] {
+						if l, ok := level[v]; ok && l != out[b][i] {
+							t.Fatalf("%s stats %d link %d: %g stretched to %g and %g", filepath.Base(src_fn), stats, link, v, l, out[b][i])
+						}
+						level[v] = out[b][i]
+					}
+				}
+			}
+		}
+	}
+}
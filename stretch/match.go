@@ -0,0 +1,114 @@
+package stretch
+
+import (
+	"fmt"
+	"log"
+	"math"
+
+	"github.com/lukeroth/gdal"
+)
+
+// reference_targets computes the histogram of every selected band of
+// opt.RefFn over the output levels, normalised for invert_histogram.  The
+// reference pixels are read as output values, so the stretched bands take
+// on the reference's distribution, which is what makes neighbouring scenes
+// of a mosaic match.  They are counted with the binning of their own data
+// type and spread onto the levels by their CDF.  A reference band with
+// values outside the output range has its CDF rescaled linearly from its
+// min..max onto the levels instead.  ndv_def is the user's no-data definition; if it is
+// empty the NoData values of the reference bands are used.
+func reference_targets(opt *Options, ndv_def NdvDef, bandlist []int) ([][]float64, error) {
+	ref_ds, err := gdal.Open(opt.RefFn, gdal.ReadOnly)
+	if err != nil {
+		return nil, err
+	}
+	defer ref_ds.Close()
+
+	w := ref_ds.RasterXSize()
+	h := ref_ds.RasterYSize()
+	if w == 0 || h == 0 {
+		return nil, ErrEmptyRaster
+	}
+	var ref_bands []gdal.RasterBand
+	for _, v := range bandlist {
+		if v > ref_ds.RasterCount() {
+			return nil, fmt.Errorf("%w: %d in reference %s", ErrBandOutOfRange, v, opt.RefFn)
+		}
+		ref_bands = append(ref_bands, ref_ds.RasterBand(v))
+	}
+	ref_ndv_def, err := band_ndv_def(ndv_def, &ref_ds, bandlist)
+	if err != nil {
+		return nil, err
+	}
+
+	// the reference bands are matched one by one, never linked
+	ref_opt := *opt
+	ref_opt.Link = LinkNone
+	binnings, err := histogram_binnings(&ref_opt, ref_bands, &ref_ndv_def, w, h)
+	if err != nil {
+		return nil, err
+	}
+	histograms, err := ComputeHistogram(ref_bands, &ref_ndv_def, w, h, binnings, &opt.ScanOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	output_range := opt.OutputRange
+	level_scale := 1.0
+	if is_float_type(opt.OutputType) {
+		level_scale = 1 / float64(output_range-1)
+	}
+	targets := make([][]float64, len(histograms))
+	for band_idx := range histograms {
+		hg := &histograms[band_idx]
+		log.Printf("reference band %d: min=%f, max=%f, mean=%f, stddev=%f, valid_count=%d\n", band_idx+1, hg.Min, hg.Max, hg.Mean, hg.Stddev, hg.DataCount)
+		if hg.DataCount == 0 {
+			return nil, fmt.Errorf("%w: reference band %d has no valid pixels", ErrBadTarget, bandlist[band_idx])
+		}
+		top := float64(output_range-1) * level_scale
+		if hg.Min >= 0 && hg.Max <= top {
+			targets[band_idx] = level_shares(hg, 0, level_scale, output_range)
+			continue
+		}
+		log.Printf("reference band %d: values %g..%g outside the output range 0..%g, rescaling them\n", bandlist[band_idx], hg.Min, hg.Max, top)
+		if hg.Max == hg.Min {
+			targets[band_idx] = make([]float64, output_range)
+			targets[band_idx][output_range/2] = 1
+			continue
+		}
+		targets[band_idx] = level_shares(hg, hg.Min, (hg.Max-hg.Min)/float64(output_range-1), output_range)
+	}
+	return targets, nil
+}
+
+// level_shares spreads the counts of hg over the output levels, level j
+// holding the values within offset+(j-0.5)*level_scale and
+// offset+(j+0.5)*level_scale.  A
+// bin straddling levels is split in proportion, i.e. linearly along the CDF
+// as in Histogram.Quantile.
+func level_shares(hg *Histogram, offset, level_scale float64, output_range int) []float64 {
+	shares := make([]float64, output_range)
+	top := float64(output_range - 1)
+	for i, cnt := range hg.Counts {
+		if cnt == 0 {
+			continue
+		}
+		share := float64(cnt) / float64(hg.DataCount)
+		lo, hi := hg.Binning.bin_edges(i)
+		lo = (math.Max(lo, hg.Min) - offset) / level_scale
+		hi = (math.Min(hi, hg.Max) - offset) / level_scale
+		lo = math.Min(math.Max(lo, 0), top)
+		hi = math.Min(math.Max(hi, lo), top)
+		if hi <= lo {
+			shares[int(math.Round(lo))] += share
+			continue
+		}
+		for j := int(math.Round(lo)); j < output_range && float64(j)-0.5 < hi; j++ {
+			overlap := math.Min(hi, float64(j)+0.5) - math.Max(lo, float64(j)-0.5)
+			if overlap > 0 {
+				shares[j] += share * overlap / (hi - lo)
+			}
+		}
+	}
+	return shares
+}
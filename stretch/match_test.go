@@ -0,0 +1,95 @@
+package stretch
+
+import (
+	"math"
+	"math/rand"
+	"path/filepath"
+	"testing"
+
+	"github.com/lukeroth/gdal"
+)
+
+func TestLevelShares(t *testing.T) {
+	flat := func(binning Binning, min, max float64) *Histogram {
+		hg := &Histogram{Binning: binning, Min: min, Max: max, Counts: make([]uint, binning.Nbins)}
+		for i := range hg.Counts {
+			if v := binning.FromBin(i); v >= min && v <= max {
+				hg.Counts[i] = 10
+			}
+		}
+		hg.update_stats()
+		return hg
+	}
+	cases := []struct {
+		name        string
+		hg          *Histogram
+		offset      float64
+		level_scale float64
+		levels      int
+		want        []float64
+	}{
+		// one bin per level
+		{"byte", flat(Binning{Nbins: 256, Scale: 1}, 2, 5), 0, 1, 8, []float64{0, 0, 0.25, 0.25, 0.25, 0.25, 0, 0}},
+		// 0..1 floats onto 11 levels 0.1 apart, the end levels half covered
+		{"float", flat(LinearBinning(0, 1, 1001), 0, 1), 0, 0.1, 11, []float64{0.05, 0.1, 0.1, 0.1, 0.1, 0.1, 0.1, 0.1, 0.1, 0.1, 0.05}},
+		// 16-bit values within the 8-bit levels
+		{"uint16", flat(Binning{Nbins: 65536, Scale: 1}, 0, 3), 0, 1, 256, append([]float64{0.25, 0.25, 0.25, 0.25}, make([]float64, 252)...)},
+		// 16-bit values 1000..1999 rescaled onto 11 levels
+		{"rescaled", flat(Binning{Nbins: 65536, Scale: 1}, 1000, 1999), 1000, 99.9, 11, []float64{0.05, 0.1, 0.1, 0.1, 0.1, 0.1, 0.1, 0.1, 0.1, 0.1, 0.05}},
+	}
+	for _, tc := range cases {
+		shares := level_shares(tc.hg, tc.offset, tc.level_scale, tc.levels)
+		for j := range tc.want {
+			if math.Abs(shares[j]-tc.want[j]) > 1e-3 {
+				t.Errorf("%s: level %d has share %g, want %g", tc.name, j, shares[j], tc.want[j])
+			}
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	r := rand.New(rand.NewSource(9))
+	ref_fn := test_raster(t, "ref", 300, 200, 2, gdal.Byte, func(b, x, y int) float64 {
+		if x < 5 {
+			return 0
+		}
+		return math.Min(255, math.Max(1, math.Floor(r.NormFloat64()*20+80+float64(b)*60)))
+	})
+	set_test_ndv(t, ref_fn, 0)
+	src_fn := test_raster(t, "src", 400, 300, 2, gdal.UInt16, func(b, x, y int) float64 { return math.Floor(r.ExpFloat64() * 900) })
+	ref := read_test_raster(t, ref_fn)
+	for _, workers := range []int{1, 3} {
+		opt := Options{SrcFn: src_fn, DstFn: filepath.Join(t.TempDir(), "out.tif"), Mode: "match", RefFn: ref_fn}
+		opt.Workers = workers
+		if err := Run(&opt); err != nil {
+			t.Fatal(err)
+		}
+		out := read_test_raster(t, opt.DstFn)
+		for b := range out {
+			ref_mean, ref_stddev := moments(ref[b], 0)
+			out_mean, out_stddev := moments(out[b], math.NaN())
+			if math.Abs(out_mean-ref_mean) > 1 || math.Abs(out_stddev-ref_stddev) > 1 {
+				t.Errorf("%d workers, band %d: got %g+/-%g, want the reference %g+/-%g", workers, b+1, out_mean, out_stddev, ref_mean, ref_stddev)
+			}
+		}
+	}
+
+	// 16-bit reference values are rescaled onto the levels of a Byte output
+	wide_fn := test_raster(t, "wide", 50, 40, 2, gdal.UInt16, func(b, x, y int) float64 { return float64(x * 100) })
+	opt := Options{SrcFn: src_fn, DstFn: filepath.Join(t.TempDir(), "out.tif"), Mode: "match", RefFn: wide_fn}
+	if err := Run(&opt); err != nil {
+		t.Fatal(err)
+	}
+	out := read_test_raster(t, opt.DstFn)
+	for b := range out {
+		min, max := math.Inf(1), math.Inf(-1)
+		for _, v := range out[b] {
+			min = math.Min(min, v)
+			max = math.Max(max, v)
+		}
+		mean, _ := moments(out[b], math.NaN())
+		if min > 5 || max < 250 || math.Abs(mean-127.5) > 5 {
+			t.Errorf("rescaled reference, band %d: got %g..%g with mean %g, want the levels spanned evenly", b+1, min, max, mean)
+		}
+	}
+}
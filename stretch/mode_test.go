@@ -0,0 +1,114 @@
+package stretch
+
+import (
+	"errors"
+	"math"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/lukeroth/gdal"
+)
+
+// midgrey_stretcher maps mean-2*stddev..mean+2*stddev of every band onto
+// the output range and records its mode option x.
+type midgrey_stretcher struct {
+	x string
+}
+
+func (self *midgrey_stretcher) Stretch(ctx *StretchContext, histograms []Histogram) ([]Transform, error) {
+	transforms := make([]Transform, len(histograms))
+	for band_idx, hg := range histograms {
+		transforms[band_idx].Scale = float64(ctx.Options.OutputRange-1) / (4 * hg.Stddev)
+		transforms[band_idx].Offset = hg.Mean - 2*hg.Stddev
+	}
+	self.x, _ = ctx.Options.ModeOption("x")
+	return transforms, nil
+}
+
+// midgrey registers midgrey_stretcher once per test binary.
+func midgrey(t *testing.T) *midgrey_stretcher {
+	t.Helper()
+	if s, ok := LookupStretcher("test-midgrey"); ok {
+		return s.(*midgrey_stretcher)
+	}
+	s := &midgrey_stretcher{}
+	RegisterStretcher("test-midgrey", s)
+	return s
+}
+
+func TestRegisterStretcher(t *testing.T) {
+	midgrey(t)
+	names := Stretchers()
+	if !sort.StringsAreSorted(names) {
+		t.Errorf("not sorted: %v", names)
+	}
+	for _, name := range []string{"histeq", "minmax", "percentile", "stddev", "test-midgrey"} {
+		if i := sort.SearchStrings(names, name); i == len(names) || names[i] != name {
+			t.Errorf("%s missing from %v", name, names)
+		}
+	}
+	// taken by a Stretcher and by a mode Run handles itself
+	for _, name := range []string{"stddev", "clahe"} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("registered %s twice", name)
+				}
+			}()
+			RegisterStretcher(name, stddev_stretcher{})
+		}()
+	}
+}
+
+func TestModeOption(t *testing.T) {
+	opt := Options{ModeOptions: []string{"a=1", "b", "x=3=4", "a=2"}}
+	cases := []struct {
+		key, want string
+		ok        bool
+	}{
+		{"a", "1", true},
+		{"x", "3=4", true},
+		{"b", "", false},
+		{"c", "", false},
+	}
+	for _, tc := range cases {
+		if got, ok := opt.ModeOption(tc.key); got != tc.want || ok != tc.ok {
+			t.Errorf("%s: got %q, %v, want %q, %v", tc.key, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestMode(t *testing.T) {
+	s := midgrey(t)
+	src_fn := test_raster(t, "mode", 50, 50, 1, gdal.UInt16, func(b, x, y int) float64 { return float64(x * y) })
+	dst_fn := filepath.Join(t.TempDir(), "out.tif")
+	opt := Options{SrcFn: src_fn, DstFn: dst_fn, Mode: "test-midgrey", ModeOptions: []string{"x=3"}}
+	if err := Run(&opt); err != nil {
+		t.Fatal(err)
+	}
+	if s.x != "3" {
+		t.Errorf("mode option x is %q, want 3", s.x)
+	}
+	if mean, _ := moments(read_test_raster(t, dst_fn)[0], -1); math.Abs(mean-127.5) > 15 {
+		t.Errorf("mean level %g, want about 127.5", mean)
+	}
+
+	cases := []struct {
+		name string
+		opt  Options
+		want error
+	}{
+		{"unknown mode", Options{Mode: "nope"}, ErrNoMode},
+		{"mode and dump", Options{Mode: "test-midgrey", DumpHistogram: true}, ErrNoMode},
+		{"no mode", Options{}, ErrNoMode},
+		{"t-digest", Options{Mode: "test-midgrey", Stats: StatsTDigest}, ErrBadArgs},
+	}
+	for _, tc := range cases {
+		opt := tc.opt
+		opt.SrcFn, opt.DstFn = src_fn, dst_fn
+		if err := Run(&opt); !errors.Is(err, tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.name, err, tc.want)
+		}
+	}
+}
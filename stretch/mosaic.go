@@ -0,0 +1,298 @@
+package stretch
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"unsafe"
+
+	"github.com/lukeroth/gdal"
+)
+
+// expand_fns returns the files named by patterns: directories for their
+// .tif and .tiff files, file names, globs, and @list for the files listed
+// in list, one per line.  Names without glob characters are kept as they
+// are, so GDAL /vsi paths work too.
+func expand_fns(patterns []string) ([]string, error) {
+	var fns []string
+	seen := map[string]bool{}
+	add := func(fn string) {
+		if !seen[fn] {
+			seen[fn] = true
+			fns = append(fns, fn)
+		}
+	}
+	for _, pattern := range patterns {
+		if strings.HasPrefix(pattern, "@") {
+			data, err := os.ReadFile(pattern[1:])
+			if err != nil {
+				return nil, err
+			}
+			for _, line := range strings.Split(string(data), "\n") {
+				if line = strings.TrimSpace(line); len(line) > 0 && !strings.HasPrefix(line, "#") {
+					add(line)
+				}
+			}
+			continue
+		}
+		if fi, err := os.Stat(pattern); err == nil && fi.IsDir() {
+			entries, err := os.ReadDir(pattern)
+			if err != nil {
+				return nil, err
+			}
+			for _, entry := range entries {
+				ext := strings.ToLower(filepath.Ext(entry.Name()))
+				if !entry.IsDir() && (ext == ".tif" || ext == ".tiff") {
+					add(filepath.Join(pattern, entry.Name()))
+				}
+			}
+			continue
+		}
+		if !strings.ContainsAny(pattern, "*?[") {
+			add(pattern)
+			continue
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", ErrBadArgs, pattern, err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("%w: no file matches %s", ErrBadArgs, pattern)
+		}
+		for _, fn := range matches {
+			add(fn)
+		}
+	}
+	if len(fns) == 0 {
+		return nil, fmt.Errorf("%w: no files in %s", ErrBadArgs, strings.Join(patterns, " "))
+	}
+	return fns, nil
+}
+
+// for_each_source calls fn with the bands bandlist of every file of fns in
+// turn, and the no-data definition of the file: ndv_def, or the NoData
+// values of its bands if that is empty.
+func for_each_source(fns []string, bandlist []int, ndv_def NdvDef,
+	fn func(src_fn string, src_bands []gdal.RasterBand, ndv_def *NdvDef, w, h int) error) error {
+	for _, src_fn := range fns {
+		err := func() error {
+			ds, err := gdal.Open(src_fn, gdal.ReadOnly)
+			if err != nil {
+				return err
+			}
+			defer ds.Close()
+			var src_bands []gdal.RasterBand
+			for _, v := range bandlist {
+				if v > ds.RasterCount() {
+					return fmt.Errorf("%w: %d", ErrBandOutOfRange, v)
+				}
+				src_bands = append(src_bands, ds.RasterBand(v))
+			}
+			file_ndv_def, err := band_ndv_def(ndv_def, &ds, bandlist)
+			if err != nil {
+				return err
+			}
+			return fn(src_fn, src_bands, &file_ndv_def, ds.RasterXSize(), ds.RasterYSize())
+		}()
+		if err != nil {
+			return fmt.Errorf("%s: %w", src_fn, err)
+		}
+	}
+	return nil
+}
+
+// mosaic_binnings returns the binning the histograms of every file of fns
+// are counted with, so they line up bin for bin: one bin per value over
+// all data types while they are 8 or 16-bit, Options.FloatBinning over the
+// values of all files otherwise.
+func mosaic_binnings(opt *Options, fns []string, bandlist []int, ndv_def NdvDef) ([]Binning, error) {
+	band_count := len(bandlist)
+	binnings := make([]Binning, band_count)
+	exact := make([]bool, band_count)
+	for band_idx := range exact {
+		exact[band_idx] = true
+	}
+	first := true
+	err := for_each_source(fns, bandlist, ndv_def, func(src_fn string, src_bands []gdal.RasterBand, ndv_def *NdvDef, w, h int) error {
+		for band_idx := range src_bands {
+			binning, ok := type_binning(src_bands[band_idx].RasterDataType())
+			exact[band_idx] = exact[band_idx] && ok
+			if !exact[band_idx] {
+				continue
+			}
+			if first {
+				binnings[band_idx] = binning
+				continue
+			}
+			// the union of both value ranges
+			lo := math.Min(binnings[band_idx].Offset, binning.Offset)
+			hi := math.Max(binnings[band_idx].FromBin(binnings[band_idx].Nbins-1), binning.FromBin(binning.Nbins-1))
+			binnings[band_idx] = Binning{Nbins: int(hi-lo) + 1, Offset: lo, Scale: 1}
+		}
+		first = false
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// bounded per worker like histogram_binnings
+	float_bands := 0
+	for _, ok := range exact {
+		if !ok {
+			float_bands++
+		}
+	}
+	band_memory := opt.HistogramMemory
+	if float_bands > 1 {
+		band_memory /= float_bands
+	}
+	if band_memory < min_histogram_memory {
+		return nil, fmt.Errorf("%w: histogram memory must be at least %d bytes per band", ErrBadArgs, min_histogram_memory)
+	}
+	float_nbins := band_memory / int(unsafe.Sizeof(uint(0)))
+
+	var minmax [][2]float64
+	global_minmax := func() error {
+		if minmax != nil {
+			return nil
+		}
+		opt.progress(fmt.Sprintf("Computing the value range of %d files", len(fns)))
+		minmax = make([][2]float64, len(bandlist))
+		// files without valid pixels in a band leave its range alone
+		got_data := make([]bool, len(bandlist))
+		return for_each_source(fns, bandlist, ndv_def, func(src_fn string, src_bands []gdal.RasterBand, ndv_def *NdvDef, w, h int) error {
+			file_minmax, file_got_data, err := compute_minmax(src_bands, ndv_def, w, h, &opt.ScanOptions)
+			if err != nil {
+				return err
+			}
+			for band_idx, mm := range file_minmax {
+				switch {
+				case !file_got_data[band_idx]:
+				case !got_data[band_idx]:
+					minmax[band_idx] = mm
+					got_data[band_idx] = true
+				default:
+					minmax[band_idx][0] = math.Min(minmax[band_idx][0], mm[0])
+					minmax[band_idx][1] = math.Max(minmax[band_idx][1], mm[1])
+				}
+			}
+			return nil
+		})
+	}
+	for band_idx := range binnings {
+		binning := &binnings[band_idx]
+		switch {
+		case exact[band_idx]:
+		case opt.FloatBinning == FloatBinsLog:
+			*binning = LogBinning(float_nbins)
+			log.Printf("band %d: %d log-scale bins, values accurate to %g%%\n", band_idx+1, binning.Nbins, 100*binning.RelativeError())
+		default:
+			if err := global_minmax(); err != nil {
+				return nil, err
+			}
+			*binning = LinearBinning(minmax[band_idx][0], minmax[band_idx][1], float_nbins)
+			log.Printf("band %d: %d linear bins, values accurate to +/-%g\n", band_idx+1, binning.Nbins, binning.Scale/2)
+		}
+	}
+	if opt.Link != LinkNone && !same_binning(binnings) {
+		if err := global_minmax(); err != nil {
+			return nil, err
+		}
+		band_memory = opt.HistogramMemory / band_count
+		if band_memory < min_histogram_memory {
+			return nil, fmt.Errorf("%w: histogram memory must be at least %d bytes per band", ErrBadArgs, min_histogram_memory)
+		}
+		min, max := value_range(minmax)
+		shared := LinearBinning(min, max, band_memory/int(unsafe.Sizeof(uint(0))))
+		for band_idx := range binnings {
+			binnings[band_idx] = shared
+		}
+		log.Printf("all bands: %d linear bins, values accurate to +/-%g\n", shared.Nbins, shared.Scale/2)
+	}
+	return binnings, nil
+}
+
+// mosaic_histograms returns the histograms of the bands bandlist of all
+// files of Options.StatsFns merged, so every file stretched with them is
+// stretched alike.
+func mosaic_histograms(opt *Options, bandlist []int, ndv_def NdvDef) ([]Histogram, error) {
+	fns, err := expand_fns(opt.StatsFns)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("merging the histograms of %d files\n", len(fns))
+	binnings, err := mosaic_binnings(opt, fns, bandlist, ndv_def)
+	if err != nil {
+		return nil, err
+	}
+	histograms := make([]Histogram, len(bandlist))
+	for band_idx := range histograms {
+		histograms[band_idx] = Histogram{Binning: binnings[band_idx], Counts: make([]uint, binnings[band_idx].Nbins)}
+	}
+	err = for_each_source(fns, bandlist, ndv_def, func(src_fn string, src_bands []gdal.RasterBand, ndv_def *NdvDef, w, h int) error {
+		opt.progress("Computing histogram of " + src_fn)
+		file_histograms, err := ComputeHistogram(src_bands, ndv_def, w, h, binnings, &opt.ScanOptions)
+		if err != nil {
+			return err
+		}
+		for band_idx := range histograms {
+			if err := histograms[band_idx].Merge(&file_histograms[band_idx]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return histograms, nil
+}
+
+// mosaic_stats are the merged histograms of Options.StatsFns over the
+// bands bandlist, computed once for a batch.
+type mosaic_stats struct {
+	bandlist   []int
+	histograms []Histogram
+}
+
+// new_mosaic_stats computes the merged histograms of opt.StatsFns over the
+// bands opt selects in opt.SrcFn.
+func new_mosaic_stats(opt *Options) (*mosaic_stats, error) {
+	ndv_def, err := opt.ndv_def()
+	if err != nil {
+		return nil, err
+	}
+	src_ds, err := gdal.Open(opt.SrcFn, gdal.ReadOnly)
+	if err != nil {
+		return nil, err
+	}
+	bandlist, err := opt.bandlist(src_ds.RasterCount())
+	src_ds.Close()
+	if err != nil {
+		return nil, err
+	}
+	histograms, err := mosaic_histograms(opt, bandlist, ndv_def)
+	if err != nil {
+		return nil, err
+	}
+	return &mosaic_stats{bandlist: bandlist, histograms: histograms}, nil
+}
+
+// band_histograms returns the merged histograms for a source whose bands
+// bandlist are stretched.  The slice is a copy, since Run replaces its
+// histograms when linking; the counts are shared and only read.
+func (self *mosaic_stats) band_histograms(bandlist []int) ([]Histogram, error) {
+	if len(bandlist) != len(self.bandlist) {
+		return nil, fmt.Errorf("%w: %d bands, the -stats-from histograms have %d", ErrBandOutOfRange, len(bandlist), len(self.bandlist))
+	}
+	for band_idx, v := range bandlist {
+		if v != self.bandlist[band_idx] {
+			return nil, fmt.Errorf("%w: band %d, the -stats-from histograms are of band %d", ErrBandOutOfRange, v, self.bandlist[band_idx])
+		}
+	}
+	return append([]Histogram(nil), self.histograms...), nil
+}
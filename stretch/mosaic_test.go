@@ -0,0 +1,154 @@
+package stretch
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/lukeroth/gdal"
+)
+
+func TestExpandFns(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.tif", "b.TIFF", "c.png", "list.txt"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	list := filepath.Join(dir, "list.txt")
+	if err := os.WriteFile(list, []byte("# tiles\nx.tif\n\n  /vsis3/b/y.tif\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	a, b, c := filepath.Join(dir, "a.tif"), filepath.Join(dir, "b.TIFF"), filepath.Join(dir, "c.png")
+	cases := []struct {
+		patterns []string
+		want     []string
+	}{
+		{[]string{dir}, []string{a, b}},
+		{[]string{filepath.Join(dir, "*.png"), a, dir}, []string{c, a, b}},
+		{[]string{"@" + list, "x.tif"}, []string{"x.tif", "/vsis3/b/y.tif"}},
+		{[]string{"/vsizip/z.zip/t.tif"}, []string{"/vsizip/z.zip/t.tif"}},
+	}
+	for _, tc := range cases {
+		got, err := expand_fns(tc.patterns)
+		if err != nil || len(got) != len(tc.want) {
+			t.Errorf("%v: got %v, %v, want %v", tc.patterns, got, err, tc.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tc.want[i] {
+				t.Errorf("%v: got %v, want %v", tc.patterns, got, tc.want)
+				break
+			}
+		}
+	}
+	for _, patterns := range [][]string{{filepath.Join(dir, "*.jpg")}, {"@" + filepath.Join(dir, "none.txt")}, {t.TempDir()}} {
+		if _, err := expand_fns(patterns); err == nil {
+			t.Errorf("%v: accepted", patterns)
+		}
+	}
+}
+
+func TestMosaic(t *testing.T) {
+	r := rand.New(rand.NewSource(5))
+	type_sets := [][]gdal.DataType{
+		{gdal.UInt16, gdal.UInt16, gdal.UInt16},
+		{gdal.Byte, gdal.UInt16, gdal.Int16},
+		{gdal.Float32, gdal.Float32, gdal.Float32},
+		{gdal.Byte, gdal.Float32, gdal.UInt16},
+	}
+	for _, dts := range type_sets {
+		dir := t.TempDir()
+		var tiles []string
+		for i, dt := range dts {
+			// NoData in the first column, the tiles overlapping in value
+			offset := float64(i * 60)
+			fn := filepath.Join(dir, "tile"+string(rune('a'+i))+".tif")
+			write_test_raster(t, fn, test_tiles, 50, 40, 2, dt, func(b, x, y int) float64 {
+				if x == 0 {
+					return 0
+				}
+				return offset + float64(r.Intn(150)) + 1
+			})
+			tiles = append(tiles, fn)
+		}
+		list := filepath.Join(dir, "list.txt")
+		if err := os.WriteFile(list, []byte(tiles[0]+"\n"+tiles[1]+"\n\n"+tiles[2]+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		for _, pattern := range []string{filepath.Join(dir, "tile*.tif"), "@" + list} {
+			// the merged histogram counts the pixels of all tiles
+			opt := Options{SrcFn: tiles[0], DstFn: filepath.Join(dir, "h.csv"), DumpHistogram: true, StatsFns: []string{pattern}, Ndv: [][2]float64{{0, 0}}}
+			if err := Run(&opt); err != nil {
+				t.Fatal(err)
+			}
+			data, err := os.ReadFile(opt.DstFn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Contains(data, []byte("valid_count=5880 ")) {
+				t.Errorf("%v %s: %s", dts, pattern, bytes.SplitN(data, []byte("\n"), 2)[0])
+			}
+
+			// a value is stretched to the same level in every tile
+			level := map[float64]float64{}
+			for i, tile := range tiles {
+				opt := Options{SrcFn: tile, DstFn: filepath.Join(dir, "out.tif"), StatsFns: []string{pattern}, Ndv: [][2]float64{{0, 0}},
+					Mode: "percentile", FromPercentile: []float64{0.02}, ToPercentile: []float64{0.98}}
+				if err := Run(&opt); err != nil {
+					t.Fatal(err)
+				}
+				src, out := read_test_raster(t, tile), read_test_raster(t, opt.DstFn)
+				for j, v := range src[0] {
+					if v == 0 {
+						continue
+					}
+					if l, ok := level[v]; ok && l != out[0][j] {
+						t.Errorf("%v %s: %g stretched to %g in tile %d, %g before", dts, pattern, v, out[0][j], i, l)
+						break
+					}
+					level[v] = out[0][j]
+				}
+			}
+		}
+	}
+
+	opt := Options{SrcFn: "x", DstFn: "y", Mode: "clahe", StatsFns: []string{"x"}}
+	if err := Run(&opt); !errors.Is(err, ErrBadArgs) {
+		t.Errorf("-clahe with -stats-from: got %v, want %v", err, ErrBadArgs)
+	}
+}
+
+func TestMosaicBinnings(t *testing.T) {
+	dir := t.TempDir()
+	// the second tile is NoData throughout
+	var tiles []string
+	for i := 0; i < 2; i++ {
+		fn := filepath.Join(dir, "tile"+string(rune('a'+i))+".tif")
+		write_test_raster(t, fn, test_tiles, 40, 30, 2, gdal.Float32, func(b, x, y int) float64 {
+			if i == 1 {
+				return -1
+			}
+			return 100 + float64(x*y)/10
+		})
+		tiles = append(tiles, fn)
+	}
+	for _, link := range []LinkMode{LinkNone, LinkAll} {
+		opt := Options{HistogramMemory: DefaultHistogramMemory, Link: link}
+		ndv_def := NdvDef{Slabs: []NdvSlab{{RangeByBand: [][2]float64{{-1, -1}}}}}
+		binnings, err := mosaic_binnings(&opt, tiles, []int{1, 2}, ndv_def)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for band_idx, binning := range binnings {
+			lo, hi := binning.FromBin(0), binning.FromBin(binning.Nbins-1)
+			if math.Abs(lo-100) > binning.Scale || math.Abs(hi-213.1) > binning.Scale {
+				t.Errorf("link %v, band %d: bins over %g..%g, want 100..213.1", link, band_idx+1, lo, hi)
+			}
+		}
+	}
+}
@@ -1,11 +1,8 @@
-package main
+package stretch
 
 import (
-	"bytes"
-	"encoding/binary"
 	"fmt"
-	"log"
-	"unsafe"
+	"math"
 
 	"github.com/lukeroth/gdal"
 )
@@ -18,29 +15,28 @@ func (self *NdvSlab) Empty() bool {
 	return len(self.RangeByBand) == 0
 }
 
-func contains_templated(interval [2]float64, p interface{}) bool {
+func contains_templated(interval [2]float64, p interface{}) (bool, error) {
 	switch p.(type) {
 	case byte:
-		return float64(p.(byte)) >= interval[0] && float64(p.(byte)) <= interval[1]
+		return float64(p.(byte)) >= interval[0] && float64(p.(byte)) <= interval[1], nil
 	case uint16:
-		return float64(p.(uint16)) >= interval[0] && float64(p.(uint16)) <= interval[1]
+		return float64(p.(uint16)) >= interval[0] && float64(p.(uint16)) <= interval[1], nil
 	case int16:
-		return float64(p.(int16)) >= interval[0] && float64(p.(int16)) <= interval[1]
+		return float64(p.(int16)) >= interval[0] && float64(p.(int16)) <= interval[1], nil
 	case int32:
-		return float64(p.(int32)) >= interval[0] && float64(p.(int32)) <= interval[1]
+		return float64(p.(int32)) >= interval[0] && float64(p.(int32)) <= interval[1], nil
 	case uint32:
-		return float64(p.(uint32)) >= interval[0] && float64(p.(uint32)) <= interval[1]
+		return float64(p.(uint32)) >= interval[0] && float64(p.(uint32)) <= interval[1], nil
 	case float32:
-		return float64(p.(float32)) >= interval[0] && float64(p.(float32)) <= interval[1]
+		return float64(p.(float32)) >= interval[0] && float64(p.(float32)) <= interval[1], nil
 	case float64:
-		return p.(float64) >= interval[0] && p.(float64) <= interval[1]
+		return p.(float64) >= interval[0] && p.(float64) <= interval[1], nil
 	case complex64:
-		return float64(real(p.(complex64))) >= interval[0] && float64(real(p.(complex64))) <= interval[1]
+		return float64(real(p.(complex64))) >= interval[0] && float64(real(p.(complex64))) <= interval[1], nil
 	case complex128:
-		return real(p.(complex128)) >= interval[0] && real(p.(complex128)) <= interval[1]
+		return real(p.(complex128)) >= interval[0] && real(p.(complex128)) <= interval[1], nil
 	default:
-		log.Fatal("interval doesnot match any type")
-		return false
+		return false, fmt.Errorf("%w: interval doesnot match %T", ErrUnsupportedType, p)
 	}
 }
 
@@ -78,30 +74,22 @@ func (self *NdvDef) IsInert() bool {
 	return self.Invert
 }
 
-func (self *NdvDef) GetNdvMaskA(band float64, dt gdal.DataType, mask_out []uint8, num_pixels int) {
-	var (
-		bands   []float64
-		dt_list []gdal.DataType
-	)
-	bands = append(bands, band)
-	dt_list = append(dt_list, dt)
-	self.GetNdvMaskB(bands, dt_list, mask_out, num_pixels)
+func (self *NdvDef) GetNdvMaskA(band []float64, dt gdal.DataType, mask_out []uint8, num_pixels int) error {
+	return self.GetNdvMaskB([][]float64{band}, []gdal.DataType{dt}, mask_out, num_pixels)
 }
 
-func (self *NdvDef) GetNdvMaskB(bands []float64, dt_list []gdal.DataType, mask_out []uint8, num_pixels int) {
-	var (
-		in_p     [][]uint8
-		dt_sizes []int
-	)
-	for i, v := range bands {
-		in_p = append(in_p, convertToBytes(v))
-		dt_sizes = append(dt_sizes, (dt_list[i] / 8).Size())
-	}
-	// MemSet(unsafe.Pointer(&mask_out), 0, uintptr(num_pixels))
+// GetNdvMaskB sets mask_out[i] to 1 for every pixel that is no-data, 0
+// otherwise.  The pixel buffers hold values read as float64 while dt_list
+// gives the data type of the band they came from.
+func (self *NdvDef) GetNdvMaskB(bands [][]float64, dt_list []gdal.DataType, mask_out []uint8, num_pixels int) error {
 	for pix_idx := 0; pix_idx < num_pixels; pix_idx++ {
 		mask_out[pix_idx] = 0
 		for j := range bands {
-			if gdal_scalar_pointer_isnan(in_p[j][0], dt_list[j]) {
+			isnan, err := gdal_scalar_isnan(bands[j][pix_idx], dt_list[j])
+			if err != nil {
+				return err
+			}
+			if isnan {
 				mask_out[pix_idx] = 1
 			}
 		}
@@ -114,7 +102,11 @@ func (self *NdvDef) GetNdvMaskB(bands []float64, dt_list []gdal.DataType, mask_o
 				} else {
 					k = j
 				}
-				if !contains_templated(v.RangeByBand[k], dt_list[j]) {
+				contains, err := contains_templated(v.RangeByBand[k], bands[j][pix_idx])
+				if err != nil {
+					return err
+				}
+				if !contains {
 					all_match = 0
 				}
 			}
@@ -128,79 +120,29 @@ func (self *NdvDef) GetNdvMaskB(bands []float64, dt_list []gdal.DataType, mask_o
 				mask_out[pix_idx] = 0
 			}
 		}
-
-		for band_idx := 0; band_idx < len(bands); band_idx++ {
-			in_p[band_idx] = in_p[band_idx][dt_sizes[band_idx]:]
-		}
 	}
+	return nil
 }
 
-func (self *NdvDef) GetNdvMaskC(bands [][]float64, mask_out []uint8, num_pixels int) {
-	dt := gdal.Float64
-	var (
-		band_p  []float64
-		dt_list []gdal.DataType
-	)
-	for _, v := range bands {
-		band_p = append(band_p, v[0])
-		dt_list = append(dt_list, dt)
+func (self *NdvDef) GetNdvMaskC(bands [][]float64, mask_out []uint8, num_pixels int) error {
+	dt_list := make([]gdal.DataType, len(bands))
+	for i := range dt_list {
+		dt_list[i] = gdal.Float64
 	}
-	self.GetNdvMaskB(band_p, dt_list, mask_out, num_pixels)
+	return self.GetNdvMaskB(bands, dt_list, mask_out, num_pixels)
 }
 
-func (self *NdvDef) GetNdvMaskD(bands [][]float64, dt_list []gdal.DataType, mask_out []uint8, num_pixels int) {
-	var band_p []float64
-	for _, v := range bands {
-		band_p = append(band_p, v[0])
-	}
-	self.GetNdvMaskB(band_p, dt_list, mask_out, num_pixels)
+func (self *NdvDef) GetNdvMaskD(bands [][]float64, dt_list []gdal.DataType, mask_out []uint8, num_pixels int) error {
+	return self.GetNdvMaskB(bands, dt_list, mask_out, num_pixels)
 }
 
-func gdal_scalar_pointer_isnan(p interface{}, dt gdal.DataType) bool {
-	var ok bool
+func gdal_scalar_isnan(v float64, dt gdal.DataType) (bool, error) {
 	switch dt {
-	case gdal.Byte:
-		_, ok = p.(uint8)
-	case gdal.UInt16:
-		_, ok = p.(uint16)
-	case gdal.Int16:
-		_, ok = p.(int16)
-	case gdal.UInt32:
-		_, ok = p.(uint32)
-	case gdal.Int32:
-		_, ok = p.(int32)
-	case gdal.Float32:
-		_, ok = p.(float32)
-	case gdal.Float64:
-		_, ok = p.(float64)
-	// case gdal.CInt16:
-
-	// case gdal.CInt32:
-	case gdal.CFloat32:
-		_, ok = p.(complex64)
-	case gdal.CFloat64:
-		_, ok = p.(complex128)
+	case gdal.Byte, gdal.UInt16, gdal.Int16, gdal.UInt32, gdal.Int32:
+		return false, nil
+	case gdal.Float32, gdal.Float64, gdal.CFloat32, gdal.CFloat64:
+		return math.IsNaN(v), nil
 	default:
-		log.Fatal("unrecognized datatype")
-	}
-	return ok
-}
-
-func convertToBytes(n interface{}) []uint8 {
-	var buf bytes.Buffer
-	err := binary.Write(&buf, binary.BigEndian, n)
-	if err != nil {
-		log.Panic(err)
-	}
-	return buf.Bytes()
-}
-
-func MemSet(s unsafe.Pointer, c byte, n uintptr) {
-	var ptr uintptr
-	ptr = uintptr(s)
-	var i uintptr
-	for i = 0; i < n; i++ {
-		pByte := (*byte)(unsafe.Pointer(ptr + i))
-		*pByte = c
+		return false, fmt.Errorf("%w: unrecognized datatype %d", ErrUnsupportedType, dt)
 	}
 }
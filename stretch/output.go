@@ -0,0 +1,143 @@
+package stretch
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+
+	"github.com/lukeroth/gdal"
+)
+
+// MaskMode selects how nodata pixels are marked in the output.
+type MaskMode int
+
+const (
+	// MaskNdv writes OutNdv into nodata pixels and sets it as the band
+	// NoData value.  Valid pixels that would map to OutNdv are nudged by
+	// one level.
+	MaskNdv MaskMode = iota
+	// MaskAlpha adds an alpha band that is 0 for nodata pixels.
+	MaskAlpha
+	// MaskInternal writes a per-dataset GDAL mask band.
+	MaskInternal
+)
+
+// GMF_PER_DATASET from gdal.h
+const gmf_per_dataset = 0x02
+
+// output_type_range returns the default and the largest number of output
+// levels for dt.  Levels count from 0 upwards, so signed types only use
+// their non-negative half, and types wider than 16 bits default to 65536
+// levels.  Floating point types are normalised to [0,1] in steps of
+// 1/(levels-1).
+func output_type_range(dt gdal.DataType) (def, max int, err error) {
+	switch dt {
+	case gdal.Byte:
+		return 256, 256, nil
+	case gdal.UInt16:
+		return 65536, 65536, nil
+	case gdal.Int16:
+		return 32768, 32768, nil
+	case gdal.UInt32:
+		return 65536, 1 << 32, nil
+	case gdal.Int32:
+		return 65536, 1 << 31, nil
+	case gdal.Float32, gdal.Float64:
+		return 65536, 1 << 24, nil
+	default:
+		return 0, 0, fmt.Errorf("%w: output type %d", ErrUnsupportedType, dt)
+	}
+}
+
+func is_float_type(dt gdal.DataType) bool {
+	return dt == gdal.Float32 || dt == gdal.Float64
+}
+
+// check_out_ndv reports whether ndv can be stored in a band of type dt.
+func check_out_ndv(ndv float64, dt gdal.DataType) bool {
+	var lo, hi float64
+	switch dt {
+	case gdal.Byte:
+		lo, hi = 0, math.MaxUint8
+	case gdal.UInt16:
+		lo, hi = 0, math.MaxUint16
+	case gdal.Int16:
+		lo, hi = math.MinInt16, math.MaxInt16
+	case gdal.UInt32:
+		lo, hi = 0, math.MaxUint32
+	case gdal.Int32:
+		lo, hi = math.MinInt32, math.MaxInt32
+	default:
+		return !math.IsInf(ndv, 0)
+	}
+	return ndv == math.Trunc(ndv) && ndv >= lo && ndv <= hi
+}
+
+// avoid_ndv moves an output level that collides with the output no-data
+// level one step towards the middle of the output range.
+func avoid_ndv(v, ndv_level float64, output_range int) float64 {
+	if v == ndv_level {
+		if ndv_level < float64(output_range)/2 {
+			v++
+		} else {
+			v--
+		}
+	}
+	return v
+}
+
+// output_dataset is the destination of Run.  Drivers that only support
+// CreateCopy (PNG, JPEG, ...) are written through an in-memory dataset
+// which Commit copies to the real file.
+type output_dataset struct {
+	gdal.Dataset
+	driver  gdal.Driver
+	fn      string
+	options []string
+	via_mem bool
+	closed  bool
+}
+
+func create_output(driver gdal.Driver, fn string, w, h, band_count int, dt gdal.DataType, options []string) (*output_dataset, error) {
+	out := &output_dataset{driver: driver, fn: fn, options: options}
+	if driver.MetadataItem(gdal.DCAP_CREATE, "") == "YES" {
+		out.Dataset = driver.Create(fn, w, h, band_count, dt, options)
+	} else if driver.MetadataItem(gdal.DCAP_CREATECOPY, "") == "YES" {
+		mem_driver, err := gdal.GetDriverByName("MEM")
+		if err != nil {
+			return nil, err
+		}
+		out.Dataset = mem_driver.Create("", w, h, band_count, dt, nil)
+		out.via_mem = true
+	} else {
+		return nil, fmt.Errorf("%w: driver %s supports neither Create nor CreateCopy", ErrCreateOutput, driver.ShortName())
+	}
+	if reflect.DeepEqual(out.Dataset, gdal.Dataset{}) {
+		return nil, ErrCreateOutput
+	}
+	return out, nil
+}
+
+// Commit writes the in-memory dataset to the output file if needed and
+// closes the output.
+func (self *output_dataset) Commit() error {
+	if self.via_mem {
+		copy_ds := self.driver.CreateCopy(self.fn, self.Dataset, 0, self.options, nil, nil)
+		if reflect.DeepEqual(copy_ds, gdal.Dataset{}) {
+			self.Close()
+			return ErrCreateOutput
+		}
+		copy_ds.Close()
+	}
+	self.Close()
+	return nil
+}
+
+// Close releases the output without copying it anywhere.  It is a no-op
+// after Commit.
+func (self *output_dataset) Close() {
+	if !self.closed {
+		self.Dataset.Close()
+		self.closed = true
+	}
+}
@@ -0,0 +1,286 @@
+package stretch
+
+import (
+	"errors"
+	"math"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/lukeroth/gdal"
+)
+
+func TestOutputTypeRange(t *testing.T) {
+	cases := []struct {
+		dt       gdal.DataType
+		def, max int
+	}{
+		{gdal.Byte, 256, 256},
+		{gdal.UInt16, 65536, 65536},
+		{gdal.Int16, 32768, 32768},
+		{gdal.UInt32, 65536, 1 << 32},
+		{gdal.Int32, 65536, 1 << 31},
+		{gdal.Float32, 65536, 1 << 24},
+		{gdal.Float64, 65536, 1 << 24},
+	}
+	for _, tc := range cases {
+		def, max, err := output_type_range(tc.dt)
+		if err != nil || def != tc.def || max != tc.max {
+			t.Errorf("%s: got %d, %d, %v; want %d, %d", tc.dt.Name(), def, max, err, tc.def, tc.max)
+		}
+	}
+	if _, _, err := output_type_range(gdal.CInt16); !errors.Is(err, ErrUnsupportedType) {
+		t.Errorf("CInt16: got %v, want %v", err, ErrUnsupportedType)
+	}
+}
+
+func TestOutputType(t *testing.T) {
+	src_fn := test_raster(t, "ramp", 256, 64, 1, gdal.UInt16, func(b, x, y int) float64 { return float64(x*64 + y) })
+	dst_fn := filepath.Join(t.TempDir(), "out.tif")
+	cases := []struct {
+		dt           gdal.DataType
+		output_range int
+		want_type    gdal.DataType
+		want_levels  int
+		// the top level of the output
+		want_max float64
+	}{
+		{gdal.Unknown, 0, gdal.Byte, 256, 255},
+		{gdal.UInt16, 0, gdal.UInt16, 65536, 65535},
+		{gdal.UInt16, 4096, gdal.UInt16, 4096, 4095},
+		{gdal.Int16, 0, gdal.Int16, 32768, 32767},
+		{gdal.UInt32, 0, gdal.UInt32, 65536, 65535},
+		{gdal.Int32, 1000, gdal.Int32, 1000, 999},
+		{gdal.Float32, 0, gdal.Float32, 65536, 1},
+		{gdal.Float64, 11, gdal.Float64, 11, 1},
+	}
+	for _, tc := range cases {
+		// wide enough to clip at both ends of the output range
+		levels := float64(tc.want_levels)
+		opt := Options{SrcFn: src_fn, DstFn: dst_fn, Mode: "stddev", DstAvg: (levels - 1) / 2, DstStddev: levels, OutputType: tc.dt, OutputRange: tc.output_range}
+		if err := Run(&opt); err != nil {
+			t.Fatal(err)
+		}
+		ds, err := gdal.Open(dst_fn, gdal.ReadOnly)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dt := ds.RasterBand(1).RasterDataType()
+		ds.Close()
+		if dt != tc.want_type {
+			t.Errorf("-ot %s: output type %s", tc.want_type.Name(), dt.Name())
+		}
+		if opt.OutputRange != tc.want_levels {
+			t.Errorf("-ot %s -outrange %d: %d levels, want %d", tc.want_type.Name(), tc.output_range, opt.OutputRange, tc.want_levels)
+		}
+		var min, max float64 = math.Inf(1), math.Inf(-1)
+		for _, v := range read_test_raster(t, dst_fn)[0] {
+			min, max = math.Min(min, v), math.Max(max, v)
+		}
+		if min < 0 || max != tc.want_max {
+			t.Errorf("-ot %s -outrange %d: output within %g..%g, want 0..%g", tc.want_type.Name(), tc.output_range, min, max, tc.want_max)
+		}
+	}
+
+	bad := []struct {
+		name string
+		opt  Options
+		want error
+	}{
+		{"1 level", Options{OutputRange: 1}, ErrBadArgs},
+		{"257 Byte levels", Options{OutputRange: 257}, ErrBadArgs},
+		{"32769 Int16 levels", Options{OutputType: gdal.Int16, OutputRange: 32769}, ErrBadArgs},
+		{"NoData 256 for Byte", Options{OutNdv: 256}, ErrBadArgs},
+		{"NoData -1 for UInt16", Options{OutputType: gdal.UInt16, OutNdv: -1}, ErrBadArgs},
+		{"NoData 0.5 for Int32", Options{OutputType: gdal.Int32, OutNdv: 0.5}, ErrBadArgs},
+		{"complex output", Options{OutputType: gdal.CFloat32}, ErrUnsupportedType},
+	}
+	for _, tc := range bad {
+		opt := tc.opt
+		opt.SrcFn, opt.DstFn, opt.Mode, opt.DstAvg, opt.DstStddev = src_fn, dst_fn, "stddev", 100, 40
+		if err := Run(&opt); !errors.Is(err, tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.name, err, tc.want)
+		}
+	}
+}
+
+func TestCreationOptions(t *testing.T) {
+	src_fn := test_raster(t, "src", 100, 70, 2, gdal.Byte, func(b, x, y int) float64 { return float64(x + y*b) })
+	dir := t.TempDir()
+	run := func(format, dst_fn string, co []string) [][]float64 {
+		opt := Options{SrcFn: src_fn, DstFn: dst_fn, OutputFormat: format, CreationOptions: co, Mode: "stddev", DstAvg: 127, DstStddev: 40}
+		if err := Run(&opt); err != nil {
+			t.Fatal(err)
+		}
+		return read_test_raster(t, dst_fn)
+	}
+
+	tif_fn := filepath.Join(dir, "out.tif")
+	tif := run("GTiff", tif_fn, []string{"TILED=YES", "BLOCKXSIZE=48", "BLOCKYSIZE=32"})
+	ds, err := gdal.Open(tif_fn, gdal.ReadOnly)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bx, by := ds.RasterBand(1).BlockSize()
+	ds.Close()
+	if bx != 48 || by != 32 {
+		t.Errorf("-co BLOCKXSIZE=48 -co BLOCKYSIZE=32: got %dx%d blocks", bx, by)
+	}
+
+	// PNG has no Create and is written through a MEM dataset
+	png := run("PNG", filepath.Join(dir, "out.png"), []string{"ZLEVEL=9"})
+	if !reflect.DeepEqual(png, tif) {
+		t.Error("PNG output differs from the GTiff output")
+	}
+}
+
+// ndv_test_raster is a ramp with a NoData 0 strip down its left edge.
+func ndv_test_raster(t *testing.T, nb int) string {
+	fn := test_raster(t, "ndv", 64, 48, nb, gdal.Byte, func(b, x, y int) float64 {
+		if x < 8 {
+			return 0
+		}
+		return float64(x + y + b)
+	})
+	set_test_ndv(t, fn, 0)
+	return fn
+}
+
+func TestOutputNdv(t *testing.T) {
+	src_fn := ndv_test_raster(t, 2)
+	dst_fn := filepath.Join(t.TempDir(), "out.tif")
+	cases := []struct {
+		name   string
+		opt    Options
+		levels float64
+	}{
+		// wide enough to reach both ends of the output range
+		{"linear", Options{Mode: "stddev", DstAvg: 127, DstStddev: 200}, 256},
+		{"linear to 255", Options{Mode: "stddev", DstAvg: 127, DstStddev: 200, OutNdv: 255}, 256},
+		{"linear to 100", Options{Mode: "stddev", DstAvg: 127, DstStddev: 200, OutNdv: 100}, 256},
+		{"histeq", Options{Mode: "histeq"}, 256},
+		{"histeq to 255", Options{Mode: "histeq", OutNdv: 255}, 256},
+		{"UInt16 to 65535", Options{Mode: "stddev", DstAvg: 32767, DstStddev: 50000, OutputType: gdal.UInt16, OutNdv: 65535}, 65536},
+		{"Float32 to 0", Options{Mode: "stddev", DstAvg: 32767, DstStddev: 50000, OutputType: gdal.Float32}, 65536},
+	}
+	for _, tc := range cases {
+		opt := tc.opt
+		opt.SrcFn, opt.DstFn = src_fn, dst_fn
+		if err := Run(&opt); err != nil {
+			t.Fatal(err)
+		}
+		ds, err := gdal.Open(dst_fn, gdal.ReadOnly)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for b := 1; b <= ds.RasterCount(); b++ {
+			if ndv, ok := ds.RasterBand(b).NoDataValue(); !ok || ndv != opt.OutNdv {
+				t.Errorf("%s: band %d NoData %g, %v; want %g", tc.name, b, ndv, ok, opt.OutNdv)
+			}
+		}
+		ds.Close()
+
+		// valid pixels are nudged one level towards the middle
+		step := 1.0
+		if is_float_type(opt.OutputType) {
+			step = 1 / (tc.levels - 1)
+		}
+		nudged := opt.OutNdv + step
+		if opt.OutNdv >= (tc.levels/2)*step {
+			nudged = opt.OutNdv - step
+		}
+		for b, data := range read_test_raster(t, dst_fn) {
+			var n_nudged int
+			for i, v := range data {
+				switch {
+				case i%64 < 8 && v != opt.OutNdv:
+					t.Errorf("%s: band %d NoData pixel %d is %g", tc.name, b+1, i, v)
+				case i%64 >= 8 && v == opt.OutNdv:
+					t.Errorf("%s: band %d valid pixel %d is the NoData value", tc.name, b+1, i)
+				case i%64 >= 8 && math.Abs(v-nudged) < step/2:
+					n_nudged++
+				}
+			}
+			at_end := opt.OutNdv == 0 || opt.OutNdv == (tc.levels-1)*step
+			if at_end && n_nudged == 0 {
+				t.Errorf("%s: band %d has no pixels at %g next to the NoData value", tc.name, b+1, nudged)
+			}
+		}
+	}
+
+	// without NoData in the source the output has none either
+	plain_fn := test_raster(t, "plain", 64, 48, 1, gdal.Byte, func(b, x, y int) float64 { return float64(x + y) })
+	opt := Options{SrcFn: plain_fn, DstFn: dst_fn, Mode: "stddev", DstAvg: 127, DstStddev: 40}
+	if err := Run(&opt); err != nil {
+		t.Fatal(err)
+	}
+	ds, err := gdal.Open(dst_fn, gdal.ReadOnly)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ndv, ok := ds.RasterBand(1).NoDataValue(); ok {
+		t.Errorf("no source NoData: output NoData %g", ndv)
+	}
+	ds.Close()
+}
+
+func TestMask(t *testing.T) {
+	src_fn := ndv_test_raster(t, 2)
+	dst_fn := filepath.Join(t.TempDir(), "out.tif")
+	cases := []struct {
+		mode  MaskMode
+		dt    gdal.DataType
+		bands int
+		// alpha is the top output level
+		mask_valid float64
+	}{
+		{MaskAlpha, gdal.Byte, 3, 255},
+		{MaskAlpha, gdal.UInt16, 3, 65535},
+		{MaskInternal, gdal.Byte, 2, 255},
+		{MaskInternal, gdal.UInt16, 2, 255},
+	}
+	for _, tc := range cases {
+		opt := Options{SrcFn: src_fn, DstFn: dst_fn, Mode: "stddev", DstAvg: 127, DstStddev: 200, Mask: tc.mode, OutputType: tc.dt}
+		if err := Run(&opt); err != nil {
+			t.Fatal(err)
+		}
+		ds, err := gdal.Open(dst_fn, gdal.ReadOnly)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := ds.RasterCount(); n != tc.bands {
+			t.Fatalf("mask mode %d: %d bands, want %d", tc.mode, n, tc.bands)
+		}
+		if _, ok := ds.RasterBand(1).NoDataValue(); ok {
+			t.Errorf("mask mode %d: output has a NoData value", tc.mode)
+		}
+		mask := ds.RasterBand(tc.bands).GetMaskBand()
+		if tc.mode == MaskAlpha {
+			mask = ds.RasterBand(tc.bands)
+			if ci := mask.ColorInterp(); ci != gdal.CI_AlphaBand {
+				t.Errorf("alpha band colour interpretation %s", ci.Name())
+			}
+		}
+		mask_data := make([]float64, 64*48)
+		if err := mask.IO(gdal.Read, 0, 0, 64, 48, mask_data, 64, 48, 0, 0); err != nil {
+			t.Fatal(err)
+		}
+		ds.Close()
+		for i, v := range mask_data {
+			if want := map[bool]float64{true: 0, false: tc.mask_valid}[i%64 < 8]; v != want {
+				t.Errorf("mask mode %d, %s: mask pixel %d is %g, want %g", tc.mode, tc.dt.Name(), i, v, want)
+				break
+			}
+		}
+		// valid pixels keep level 0
+		var zeros int
+		for _, v := range read_test_raster(t, dst_fn)[0] {
+			if v == 0 {
+				zeros++
+			}
+		}
+		if zeros <= 8*48 {
+			t.Errorf("mask mode %d, %s: valid pixels were nudged off level 0", tc.mode, tc.dt.Name())
+		}
+	}
+}
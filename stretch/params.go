@@ -0,0 +1,234 @@
+package stretch
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+
+	"github.com/lukeroth/gdal"
+)
+
+// StretchParams is the stretch computed by Run, as saved with
+// Options.SaveParams and reapplied to other rasters with Options.ApplyFn.
+type StretchParams struct {
+	// Mode is the mode the stretch was computed with.
+	Mode          string               `json:"mode"`
+	OutputType    string               `json:"output_type"`
+	OutputRange   int                  `json:"output_range"`
+	Transfer      string               `json:"transfer"`
+	Gamma         float64              `json:"gamma,omitempty"`
+	Gain          float64              `json:"gain,omitempty"`
+	Midpoint      *float64             `json:"midpoint,omitempty"`
+	Ndv           [][2]float64         `json:"ndv,omitempty"`
+	ValidRange    [][2]float64         `json:"valid_range,omitempty"`
+	OutNdv        float64              `json:"out_ndv"`
+	Mask          MaskMode             `json:"mask"`
+	Bands         []BandParams         `json:"bands"`
+	Decorrelation *DecorrelationParams `json:"decorrelation,omitempty"`
+}
+
+// BandParams is the Transform of one output band.
+type BandParams struct {
+	// Band is the source band id.
+	Band   int     `json:"band"`
+	Scale  float64 `json:"scale"`
+	Offset float64 `json:"offset"`
+	// Binning maps the values to the entries of Table, if set.
+	Binning *Binning  `json:"binning,omitempty"`
+	Table   []float64 `json:"table,omitempty"`
+	Stats   BandStats `json:"stats"`
+}
+
+// BandStats describes the valid source pixels the stretch was computed
+// from.  Mean and Stddev are 0 for t-digest statistics.
+type BandStats struct {
+	Count  uint    `json:"count"`
+	Min    float64 `json:"min"`
+	Max    float64 `json:"max"`
+	Mean   float64 `json:"mean"`
+	Stddev float64 `json:"stddev"`
+}
+
+// DecorrelationParams is the matrix of a decorrelation stretch, applied
+// to the pixels minus Mean before the linear stretch.
+type DecorrelationParams struct {
+	Mean   []float64   `json:"mean"`
+	Matrix [][]float64 `json:"matrix"`
+}
+
+var params_types = []gdal.DataType{gdal.Byte, gdal.UInt16, gdal.Int16, gdal.UInt32, gdal.Int32, gdal.Float32, gdal.Float64}
+
+func transfer_name(fn TransferFunc) string {
+	for name, v := range transfer_names {
+		if v == fn {
+			return name
+		}
+	}
+	return ""
+}
+
+// SaveParams writes params to fn as JSON.
+func SaveParams(fn string, params *StretchParams) error {
+	data, err := json.MarshalIndent(params, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(fn, append(data, '\n'), 0644)
+}
+
+// LoadParams reads parameters written by SaveParams and checks that they
+// can be applied.
+func LoadParams(fn string) (*StretchParams, error) {
+	data, err := os.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	var params StretchParams
+	if err := json.Unmarshal(data, &params); err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrBadParams, fn, err)
+	}
+	if len(params.Bands) == 0 {
+		return nil, fmt.Errorf("%w: %s: no bands", ErrBadParams, fn)
+	}
+	if _, err := params.output_type(); err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrBadParams, fn, err)
+	}
+	if _, err := ParseTransferFunc(params.Transfer); err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrBadParams, fn, err)
+	}
+	for band_idx, bp := range params.Bands {
+		if bp.Table != nil && (bp.Binning == nil || bp.Binning.Nbins != len(bp.Table)) {
+			return nil, fmt.Errorf("%w: %s: table of band %d does not match its binning", ErrBadParams, fn, band_idx+1)
+		}
+	}
+	if dp := params.Decorrelation; dp != nil {
+		n := len(params.Bands)
+		ok := len(dp.Mean) == n && len(dp.Matrix) == n
+		for _, row := range dp.Matrix {
+			ok = ok && len(row) == n
+		}
+		if !ok {
+			return nil, fmt.Errorf("%w: %s: decorrelation matrix does not match the %d bands", ErrBadParams, fn, n)
+		}
+	}
+	return &params, nil
+}
+
+func (self *StretchParams) output_type() (gdal.DataType, error) {
+	for _, dt := range params_types {
+		if dt.Name() == self.OutputType {
+			return dt, nil
+		}
+	}
+	return gdal.Unknown, fmt.Errorf("unsupported output type %s", self.OutputType)
+}
+
+// new_params collects the stretch of Run.  table_binnings are the
+// binnings of the tables in xform_table; the statistics come from
+// histograms, dists or cov, whichever Run computed.
+func new_params(opt *Options, bandlist []int, lin_scales, lin_offsets []float64, xform_table [][]float64, table_binnings []Binning,
+	histograms []Histogram, dists []Distribution, cov *Covariance, dc *decorrelation) *StretchParams {
+	params := &StretchParams{
+		Mode:        opt.Mode,
+		OutputType:  opt.OutputType.Name(),
+		OutputRange: opt.OutputRange,
+		Transfer:    transfer_name(opt.Transfer),
+		Gamma:       opt.Gamma,
+		Gain:        opt.Gain,
+		Ndv:         opt.Ndv,
+		ValidRange:  opt.ValidRange,
+		OutNdv:      opt.OutNdv,
+		Mask:        opt.Mask,
+		Bands:       make([]BandParams, len(bandlist)),
+	}
+	if opt.Transfer == TransferSigmoid {
+		midpoint := opt.Midpoint
+		params.Midpoint = &midpoint
+	}
+	if opt.applied != nil {
+		params.Mode = opt.applied.Mode
+	}
+	for band_idx, v := range bandlist {
+		bp := &params.Bands[band_idx]
+		bp.Band = v
+		if xform_table[band_idx] != nil {
+			binning := table_binnings[band_idx]
+			bp.Binning = &binning
+			bp.Table = append([]float64(nil), xform_table[band_idx]...)
+		} else {
+			bp.Scale = lin_scales[band_idx]
+			bp.Offset = lin_offsets[band_idx]
+		}
+		switch {
+		case opt.applied != nil:
+			bp.Stats = opt.applied.Bands[band_idx].Stats
+		case cov != nil:
+			bp.Stats = BandStats{Count: cov.Count, Min: cov.Min[band_idx], Max: cov.Max[band_idx], Mean: cov.Mean[band_idx], Stddev: math.Sqrt(cov.Cov[band_idx][band_idx])}
+		case histograms != nil:
+			hg := &histograms[band_idx]
+			bp.Stats = BandStats{Count: hg.DataCount, Min: hg.Min, Max: hg.Max, Mean: hg.Mean, Stddev: hg.Stddev}
+		case dists[band_idx].Count() > 0:
+			// an empty t-digest has no statistics to save
+			min, _ := dists[band_idx].Quantile(0)
+			max, _ := dists[band_idx].Quantile(1)
+			bp.Stats = BandStats{Count: dists[band_idx].Count(), Min: min, Max: max}
+		}
+	}
+	if dc != nil {
+		params.Decorrelation = &DecorrelationParams{Mean: dc.mean, Matrix: dc.matrix}
+	}
+	return params
+}
+
+// load_applied loads the parameters of ApplyFn and takes the output and
+// no-data settings, and the bands if none are selected, from them.
+func (self *Options) load_applied() error {
+	if len(self.StatsFns) > 0 {
+		return fmt.Errorf("%w: -apply takes the stretch from its file, not from -stats-from", ErrBadArgs)
+	}
+	params, err := LoadParams(self.ApplyFn)
+	if err != nil {
+		return err
+	}
+	if self.OutputType, err = params.output_type(); err != nil {
+		return err
+	}
+	if self.Transfer, err = ParseTransferFunc(params.Transfer); err != nil {
+		return err
+	}
+	self.OutputRange = params.OutputRange
+	self.Gamma, self.Gain = params.Gamma, params.Gain
+	if params.Midpoint != nil {
+		self.Midpoint, self.MidpointSet = *params.Midpoint, true
+	}
+	self.OutNdv = params.OutNdv
+	self.Mask = params.Mask
+	if len(self.Ndv) == 0 && len(self.ValidRange) == 0 {
+		self.Ndv, self.ValidRange = params.Ndv, params.ValidRange
+	}
+	if len(self.Bands) == 0 {
+		for _, bp := range params.Bands {
+			self.Bands = append(self.Bands, bp.Band)
+		}
+	}
+	if len(self.Bands) != len(params.Bands) {
+		return fmt.Errorf("%w: %s has %d bands, %d selected", ErrBadParams, self.ApplyFn, len(params.Bands), len(self.Bands))
+	}
+	self.applied = params
+	return nil
+}
+
+// transforms returns the saved Transform of every band.
+func (self *StretchParams) transforms() []Transform {
+	transforms := make([]Transform, len(self.Bands))
+	for band_idx, bp := range self.Bands {
+		tr := &transforms[band_idx]
+		tr.Scale, tr.Offset = bp.Scale, bp.Offset
+		// Run modifies the tables in place
+		if bp.Table != nil {
+			tr.Table = append([]float64(nil), bp.Table...)
+		}
+	}
+	return transforms
+}
@@ -0,0 +1,125 @@
+package stretch
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/lukeroth/gdal"
+)
+
+func TestLoadParams(t *testing.T) {
+	dir := t.TempDir()
+	cases := []struct{ name, data string }{
+		{"not json", `{"bands": [`},
+		{"no bands", `{"output_type": "Byte", "transfer": "linear", "bands": []}`},
+		{"output type", `{"output_type": "CInt16", "transfer": "linear", "bands": [{"band": 1}]}`},
+		{"transfer", `{"output_type": "Byte", "transfer": "cubic", "bands": [{"band": 1}]}`},
+		{"table without binning", `{"output_type": "Byte", "transfer": "linear", "bands": [{"band": 1, "table": [1, 2]}]}`},
+		{"table and binning", `{"output_type": "Byte", "transfer": "linear", "bands": [{"band": 1, "binning": {"Nbins": 3}, "table": [1, 2]}]}`},
+		{"decorrelation", `{"output_type": "Byte", "transfer": "linear", "bands": [{"band": 1}, {"band": 2}],
+			"decorrelation": {"mean": [0, 0], "matrix": [[1, 0], [0]]}}`},
+	}
+	for _, tc := range cases {
+		fn := filepath.Join(dir, "params.json")
+		if err := os.WriteFile(fn, []byte(tc.data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadParams(fn); !errors.Is(err, ErrBadParams) {
+			t.Errorf("%s: got %v, want %v", tc.name, err, ErrBadParams)
+		}
+	}
+}
+
+func TestParams(t *testing.T) {
+	r := rand.New(rand.NewSource(4))
+	src16 := test_raster(t, "ps16", 120, 90, 3, gdal.UInt16, func(b, x, y int) float64 {
+		if x < 5 {
+			return 0
+		}
+		return math.Floor(r.ExpFloat64()*300) + float64(b*50) + 1
+	})
+	srcf := test_raster(t, "psf", 120, 90, 2, gdal.Float32, func(b, x, y int) float64 { return r.NormFloat64() + float64(b) })
+	pct := Options{Mode: "percentile", FromPercentile: []float64{0.02}, ToPercentile: []float64{0.98}}
+	cases := []struct {
+		name   string
+		src_fn string
+		opt    func(opt *Options)
+	}{
+		{"pct", src16, func(opt *Options) { *opt = pct; opt.Ndv, opt.OutNdv = [][2]float64{{0, 0}}, 255 }},
+		{"pct_sigmoid", src16, func(opt *Options) { *opt = pct; opt.Transfer = TransferSigmoid }},
+		// not replaced by the default when applied
+		{"pct_sigmoid_0", src16, func(opt *Options) { *opt = pct; opt.Transfer, opt.MidpointSet = TransferSigmoid, true }},
+		{"heq", src16, func(opt *Options) { opt.Mode, opt.DstStddev, opt.Bands = "histeq", 40, []int{3, 1} }},
+		{"heqf", srcf, func(opt *Options) { opt.Mode, opt.OutputType, opt.OutputRange = "histeq", gdal.UInt16, 4096 }},
+		{"dcs", src16, func(opt *Options) {
+			opt.Mode, opt.DstAvg, opt.DstStddev, opt.Mask, opt.Ndv = "decorrelation", 128, 30, MaskAlpha, [][2]float64{{0, 0}}
+		}},
+		{"td", srcf, func(opt *Options) { opt.Mode, opt.Stats, opt.OutputType = "minmax", StatsTDigest, gdal.Float32 }},
+	}
+	dir := t.TempDir()
+	for _, tc := range cases {
+		params_fn := filepath.Join(dir, tc.name+".json")
+		var opt Options
+		tc.opt(&opt)
+		opt.SrcFn, opt.DstFn, opt.SaveParams = tc.src_fn, filepath.Join(dir, "computed.tif"), params_fn
+		if err := Run(&opt); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		// applied and saved again from the applied stretch
+		resaved_fn := filepath.Join(dir, tc.name+"_resaved.json")
+		applied := Options{SrcFn: tc.src_fn, DstFn: filepath.Join(dir, "applied.tif"), ApplyFn: params_fn, SaveParams: resaved_fn}
+		if err := Run(&applied); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		computed, out := read_test_raster(t, opt.DstFn), read_test_raster(t, applied.DstFn)
+		if len(computed) != len(out) {
+			t.Fatalf("%s: %d bands computed, %d applied", tc.name, len(computed), len(out))
+		}
+		for b := range computed {
+			for i := range computed[b] {
+				if computed[b][i] != out[b][i] {
+					t.Fatalf("%s: band %d pixel %d is %g computed, %g applied", tc.name, b+1, i, computed[b][i], out[b][i])
+				}
+			}
+		}
+		saved, err := os.ReadFile(params_fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resaved, err := os.ReadFile(resaved_fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(saved) != string(resaved) {
+			t.Errorf("%s: saved again as\n%s\nwant\n%s", tc.name, resaved, saved)
+		}
+	}
+
+	pct_fn := filepath.Join(dir, "pct.json")
+	bad := []struct {
+		name string
+		opt  Options
+		want error
+	}{
+		{"other bands", Options{ApplyFn: pct_fn, Bands: []int{1}}, ErrBadParams},
+		{"another mode", Options{ApplyFn: pct_fn, Mode: "histeq"}, ErrNoMode},
+		{"clahe", Options{Mode: "clahe", SaveParams: filepath.Join(dir, "clahe.json")}, ErrBadArgs},
+	}
+	for _, tc := range bad {
+		opt := tc.opt
+		opt.SrcFn, opt.DstFn = src16, filepath.Join(dir, "out.tif")
+		if err := Run(&opt); !errors.Is(err, tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.name, err, tc.want)
+		}
+	}
+	// an empty t-digest has no statistics to save
+	empty := new_params(&Options{Mode: "minmax", OutputType: gdal.Byte, OutputRange: 256}, []int{1}, []float64{1}, []float64{0},
+		make([][]float64, 1), make([]Binning, 1), nil, []Distribution{NewTDigest(0)}, nil, nil)
+	if err := SaveParams(filepath.Join(dir, "empty.json"), empty); err != nil || empty.Bands[0].Stats != (BandStats{}) {
+		t.Errorf("empty t-digest: saved %+v, %v", empty.Bands[0].Stats, err)
+	}
+}
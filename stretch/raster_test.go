@@ -0,0 +1,100 @@
+package stretch
+
+import (
+	"math"
+	"path/filepath"
+	"testing"
+
+	"github.com/lukeroth/gdal"
+)
+
+// test_tiles splits test rasters into several blocks across and down.
+var test_tiles = []string{"TILED=YES", "BLOCKXSIZE=32", "BLOCKYSIZE=16"}
+
+// test_raster writes a tiled w x h GTiff of nb bands valued f into the
+// temporary directory of t and returns its name.
+func test_raster(t *testing.T, name string, w, h, nb int, dt gdal.DataType, f func(b, x, y int) float64) string {
+	t.Helper()
+	fn := filepath.Join(t.TempDir(), name+".tif")
+	write_test_raster(t, fn, test_tiles, w, h, nb, dt, f)
+	return fn
+}
+
+// write_test_raster writes a w x h GTiff of nb bands valued f, created
+// with the creation options co.
+func write_test_raster(t *testing.T, fn string, co []string, w, h, nb int, dt gdal.DataType, f func(b, x, y int) float64) {
+	t.Helper()
+	drv, err := gdal.GetDriverByName("GTiff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds := drv.Create(fn, w, h, nb, dt, co)
+	defer ds.Close()
+	buf := make([]float64, w*h)
+	for b := 0; b < nb; b++ {
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				buf[y*w+x] = f(b, x, y)
+			}
+		}
+		band := ds.RasterBand(b + 1)
+		if err := band.IO(gdal.Write, 0, 0, w, h, buf, w, h, 0, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// set_test_ndv sets the NoData value of every band of fn.
+func set_test_ndv(t *testing.T, fn string, ndv float64) {
+	t.Helper()
+	ds, err := gdal.Open(fn, gdal.Update)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+	for b := 1; b <= ds.RasterCount(); b++ {
+		band := ds.RasterBand(b)
+		if err := band.SetNoDataValue(ndv); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// read_test_raster returns the pixels of every band of fn.
+func read_test_raster(t *testing.T, fn string) [][]float64 {
+	t.Helper()
+	ds, err := gdal.Open(fn, gdal.ReadOnly)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+	w, h := ds.RasterXSize(), ds.RasterYSize()
+	bands := make([][]float64, ds.RasterCount())
+	for b := range bands {
+		bands[b] = make([]float64, w*h)
+		band := ds.RasterBand(b + 1)
+		if err := band.IO(gdal.Read, 0, 0, w, h, bands[b], w, h, 0, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return bands
+}
+
+// moments returns the mean and standard deviation of the values of data
+// that are not skip.
+func moments(data []float64, skip float64) (mean, stddev float64) {
+	var n float64
+	for _, v := range data {
+		if v != skip {
+			mean += v
+			n++
+		}
+	}
+	mean /= n
+	for _, v := range data {
+		if v != skip {
+			stddev += (v - mean) * (v - mean)
+		}
+	}
+	return mean, math.Sqrt(stddev / n)
+}
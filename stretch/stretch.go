@@ -0,0 +1,1228 @@
+package stretch
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strings"
+	"unsafe"
+
+	"github.com/lukeroth/gdal"
+)
+
+// Binning maps values to histogram bins.  Bins are linear, bin i holding
+// values around Offset + i*Scale, unless LogBits is set; see LogBinning.
+type Binning struct {
+	Nbins   int     `json:"nbins"`
+	Offset  float64 `json:"offset"`
+	Scale   float64 `json:"scale"`
+	LogBits int     `json:"log_bits,omitempty"`
+}
+
+func (self *Binning) ToBin(v float64) (int, error) {
+	if math.IsInf(v, -1) {
+		return 0, nil
+	}
+	if math.IsInf(v, 1) {
+		return self.Nbins - 1, nil
+	}
+	if self.LogBits > 0 {
+		return self.to_log_bin(v)
+	}
+	bin_dbl := math.Round((v - self.Offset) / self.Scale)
+	if math.IsNaN(bin_dbl) {
+		return 0, ErrNanInToBin
+	}
+	if bin_dbl < 0 {
+		return 0, nil
+	}
+	if bin_dbl > float64(self.Nbins)-1 {
+		return self.Nbins - 1, nil
+	}
+	return int(bin_dbl), nil
+}
+
+func (self *Binning) FromBin(i int) float64 {
+	if self.LogBits > 0 {
+		return self.from_log_bin(i)
+	}
+	return float64(i)*self.Scale + self.Offset
+}
+
+type Histogram struct {
+	Binning
+	Max, Min, Mean, Stddev float64
+	DataCount              uint
+	NdvCount               uint
+	Counts                 []uint
+}
+
+func ComputeMinmax(src_bands []gdal.RasterBand, ndv_def *NdvDef, w, h int, scan *ScanOptions) ([][2]float64, error) {
+	minmax, _, err := compute_minmax(src_bands, ndv_def, w, h, scan)
+	return minmax, err
+}
+
+// compute_minmax is ComputeMinmax, also telling which bands have valid
+// pixels; the range of the others is 0..0.
+func compute_minmax(src_bands []gdal.RasterBand, ndv_def *NdvDef, w, h int, scan *ScanOptions) ([][2]float64, []bool, error) {
+	band_count := len(src_bands)
+	workers := scan_workers(scan)
+	// one partial result per worker, merged below
+	partial := make([][][2]float64, workers)
+	got_data := make([][]bool, workers)
+	for worker := 0; worker < workers; worker++ {
+		partial[worker] = make([][2]float64, band_count)
+		got_data[worker] = make([]bool, band_count)
+	}
+
+	err := scan_blocks(src_bands, ndv_def, w, h, scan, func(worker int, blk block, rd *block_reader) error {
+		minmax := partial[worker]
+		for band_idx := 0; band_idx < band_count; band_idx++ {
+			for i := 0; i < rd.n; i++ {
+				if rd.ndv_mask[i] != 0 {
+					continue
+				}
+				v := rd.buf_in[band_idx][i]
+				if math.IsNaN(v) || math.IsInf(v, 0) {
+					continue
+				}
+				if !got_data[worker][band_idx] {
+					minmax[band_idx][0] = v
+					minmax[band_idx][1] = v
+					got_data[worker][band_idx] = true
+				}
+				if v < minmax[band_idx][0] {
+					minmax[band_idx][0] = v
+				}
+				if v > minmax[band_idx][1] {
+					minmax[band_idx][1] = v
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	minmax := partial[0]
+	for worker := 1; worker < workers; worker++ {
+		for band_idx := 0; band_idx < band_count; band_idx++ {
+			if !got_data[worker][band_idx] {
+				continue
+			}
+			if !got_data[0][band_idx] {
+				minmax[band_idx] = partial[worker][band_idx]
+				got_data[0][band_idx] = true
+				continue
+			}
+			minmax[band_idx][0] = math.Min(minmax[band_idx][0], partial[worker][band_idx][0])
+			minmax[band_idx][1] = math.Max(minmax[band_idx][1], partial[worker][band_idx][1])
+		}
+	}
+	return minmax, got_data[0], nil
+}
+
+func ComputeHistogram(src_bands []gdal.RasterBand, ndv_def *NdvDef, w, h int, binnings []Binning, scan *ScanOptions) ([]Histogram, error) {
+	band_count := len(src_bands)
+	workers := scan_workers(scan)
+	// one partial histogram per worker and band, merged below
+	partial := make([][]Histogram, workers)
+	first_valid_pixel := make([][]bool, workers)
+	for worker := 0; worker < workers; worker++ {
+		partial[worker] = make([]Histogram, band_count)
+		for band_idx := 0; band_idx < band_count; band_idx++ {
+			partial[worker][band_idx].Binning = binnings[band_idx]
+			partial[worker][band_idx].Counts = make([]uint, binnings[band_idx].Nbins)
+		}
+		first_valid_pixel[worker] = make([]bool, band_count)
+	}
+
+	err := scan_blocks(src_bands, ndv_def, w, h, scan, func(worker int, blk block, rd *block_reader) error {
+		for band_idx := 0; band_idx < band_count; band_idx++ {
+			hg := &partial[worker][band_idx]
+			p := rd.buf_in[band_idx]
+			for i := 0; i < rd.n; i++ {
+				if rd.ndv_mask[i] != 0 {
+					hg.NdvCount++
+				} else {
+					v := p[i]
+					if !hg.Binning.counts(v) {
+						continue
+					}
+					bin, err := hg.Binning.ToBin(v)
+					if err != nil {
+						return err
+					}
+					hg.Counts[bin]++
+					if !first_valid_pixel[worker][band_idx] {
+						hg.Min = v
+						hg.Max = v
+						first_valid_pixel[worker][band_idx] = true
+					}
+					if v < hg.Min {
+						hg.Min = v
+					}
+					if v > hg.Max {
+						hg.Max = v
+					}
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	histograms := partial[0]
+	for band_idx := 0; band_idx < band_count; band_idx++ {
+		hg := &histograms[band_idx]
+		hg.update_stats()
+		for worker := 1; worker < workers; worker++ {
+			other := &partial[worker][band_idx]
+			other.update_stats()
+			if err := hg.Merge(other); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return histograms, nil
+}
+
+// update_stats recomputes DataCount, Mean and Stddev from the counts.
+func (self *Histogram) update_stats() {
+	var accum float64
+	self.DataCount = 0
+	for i := 0; i < self.Binning.Nbins; i++ {
+		cnt := self.Counts[i]
+		if cnt == 0 {
+			// as are the Inf/NaN bins of log-scale binnings, see counts
+			continue
+		}
+		self.DataCount += cnt
+		accum += self.Binning.FromBin(i) * float64(cnt)
+	}
+	self.Mean = accum / float64(self.DataCount)
+	var var_accum float64
+	for i := 0; i < self.Binning.Nbins; i++ {
+		cnt := self.Counts[i]
+		if cnt == 0 {
+			continue
+		}
+		v := self.Binning.FromBin(i)
+		var_accum += (v - self.Mean) * (v - self.Mean) * float64(cnt)
+	}
+	self.Stddev = math.Sqrt(var_accum / float64(self.DataCount))
+}
+
+// Merge adds the pixels counted by other, which must use the same binning,
+// and updates the statistics.
+func (self *Histogram) Merge(other *Histogram) error {
+	if self.Binning != other.Binning {
+		return ErrBinningMismatch
+	}
+	if other.DataCount > 0 {
+		if self.DataCount == 0 {
+			self.Min = other.Min
+			self.Max = other.Max
+		} else {
+			self.Min = math.Min(self.Min, other.Min)
+			self.Max = math.Max(self.Max, other.Max)
+		}
+	}
+	for i := range self.Counts {
+		self.Counts[i] += other.Counts[i]
+	}
+	self.NdvCount += other.NdvCount
+	self.update_stats()
+	return nil
+}
+
+// Rebin returns the histogram with the counts moved to the bins of binning
+// their bin values fall into.  Min, Max and NdvCount are kept, Mean and
+// Stddev are recomputed from the new bins.
+func (self *Histogram) Rebin(binning Binning) (Histogram, error) {
+	hg := Histogram{Binning: binning, Min: self.Min, Max: self.Max, NdvCount: self.NdvCount, Counts: make([]uint, binning.Nbins)}
+	for i, cnt := range self.Counts {
+		if cnt == 0 {
+			continue
+		}
+		v := self.Binning.FromBin(i)
+		if math.IsNaN(v) {
+			continue
+		}
+		bin, err := binning.ToBin(v)
+		if err != nil {
+			return hg, err
+		}
+		hg.Counts[bin] += cnt
+	}
+	hg.update_stats()
+	return hg, nil
+}
+
+func (self *Histogram) Count() uint {
+	return self.DataCount
+}
+
+// Quantile returns the value of rank q*DataCount, interpolated linearly
+// within the bin that holds it and clamped to [Min, Max].
+func (self *Histogram) Quantile(q float64) (float64, error) {
+	if self.DataCount == 0 {
+		return 0, ErrNoWindow
+	}
+	rank := float64(self.DataCount) * q
+	var cnt float64 = 0
+	for i := 0; i < self.Binning.Nbins; i++ {
+		if self.Counts[i] == 0 {
+			continue
+		}
+		bin_cnt := float64(self.Counts[i])
+		if cnt+bin_cnt >= rank {
+			lo, hi := self.Binning.bin_edges(i)
+			lo = math.Max(lo, self.Min)
+			hi = math.Min(hi, self.Max)
+			v := lo + (hi-lo)*(rank-cnt)/bin_cnt
+			return math.Min(math.Max(v, self.Min), self.Max), nil
+		}
+		cnt += bin_cnt
+	}
+	return self.Max, nil
+}
+
+// get_scale_from_percentile maps the values between the from_percentile
+// and to_percentile cuts onto the output levels.  It returns the cut
+// values.  If the cuts coincide the whole value range is used instead, and
+// a constant band gets a zero scale.
+func get_scale_from_percentile(dist Distribution, output_range int, from_percentile, to_percentile float64, scale_out, offset_out *float64) (from_val, to_val float64, err error) {
+	from_val, err = dist.Quantile(from_percentile)
+	if err != nil {
+		return 0, 0, err
+	}
+	to_val, err = dist.Quantile(to_percentile)
+	if err != nil {
+		return 0, 0, err
+	}
+	if from_val == to_val {
+		min, _ := dist.Quantile(0)
+		max, _ := dist.Quantile(1)
+		log.Printf("percentiles %g and %g both cut at %f, using the value range %f..%f\n", from_percentile, to_percentile, from_val, min, max)
+		from_val, to_val = min, max
+	}
+
+	*offset_out = from_val
+	if to_val == from_val {
+		*scale_out = 0
+	} else {
+		*scale_out = float64(output_range-1) / (to_val - from_val)
+	}
+	return from_val, to_val, nil
+}
+
+// invert_histogram maps every bin of src_h_in to the output level whose
+// share of the normalised target histogram dst_h reaches the middle of the
+// bin's share of the pixels.  It returns the levels as a transform table.
+func invert_histogram(src_h_in *Histogram, dst_h []float64, output_range int) []float64 {
+	var (
+		src_h               = src_h_in.Counts
+		pixel_count         = float64(src_h_in.DataCount)
+		j           int     = 0
+		src_total   float64 = 0
+		dst_total   float64 = dst_h[0]
+	)
+	out_h := make([]float64, len(src_h))
+	if pixel_count == 0 {
+		return out_h
+	}
+
+	for i := 0; i < len(src_h); i++ {
+		mid := (src_total + float64(src_h[i])/2) / pixel_count
+		for j < output_range-1 && dst_total < mid {
+			j++
+			dst_total += dst_h[j]
+		}
+		out_h[i] = float64(j)
+		src_total += float64(src_h[i])
+	}
+	return out_h
+}
+
+// gen_gaussian returns a normal distribution over bin_count levels,
+// truncated to the levels and normalised to sum to 1.  A zero stddev gives
+// a flat distribution, i.e. plain histogram equalization.
+func gen_gaussian(mean, stddev float64, bin_count int) []float64 {
+	arr := make([]float64, bin_count)
+	var total float64 = 0
+	for i := 0; i < bin_count; i++ {
+		if stddev == 0.0 {
+			arr[i] = 1
+		} else {
+			x := (float64(i) - mean) / stddev
+			arr[i] = math.Exp(-x * x / 2)
+		}
+		total += arr[i]
+	}
+	for i := 0; i < bin_count; i++ {
+		arr[i] /= total
+	}
+	return arr
+}
+
+func copyGeoCode(dst_ds, src_ds *gdal.Dataset, opt *Options) error {
+	if !opt.NoGeoTransform {
+		affine := src_ds.GeoTransform()
+		// GDAL reports the identity transform when there is none
+		if affine != [6]float64{0, 1, 0, 0, 0, 1} {
+			if err := dst_ds.SetGeoTransform(affine); err != nil {
+				return err
+			}
+		}
+	}
+	if !opt.NoProjection {
+		if proj := src_ds.Projection(); len(proj) > 0 {
+			if err := dst_ds.SetProjection(proj); err != nil {
+				return err
+			}
+		}
+	}
+	if !opt.NoGCPs {
+		if err := copy_gcps(dst_ds, src_ds); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyMetadata copies the dataset metadata, the RPC and IMAGERY domains
+// and, for every output band, the metadata and colour interpretation of
+// the source band it was made from.  Band statistics are dropped since
+// they no longer describe the stretched values.
+func copyMetadata(dst_ds, src_ds *gdal.Dataset, bandlist []int, opt *Options) error {
+	var domains []string
+	if !opt.NoMetadata {
+		domains = append(domains, "")
+	}
+	if !opt.NoRPC {
+		domains = append(domains, "RPC")
+	}
+	if !opt.NoImagery {
+		domains = append(domains, "IMAGERY")
+	}
+	for _, domain := range domains {
+		if md := dataset_metadata(src_ds, domain); len(md) > 0 {
+			if err := set_dataset_metadata(dst_ds, md, domain); err != nil {
+				return err
+			}
+		}
+	}
+
+	for band_idx, v := range bandlist {
+		src_band := src_ds.RasterBand(v)
+		dst_band := dst_ds.RasterBand(band_idx + 1)
+		if !opt.NoBandMetadata {
+			var md []string
+			for _, item := range band_metadata(&src_band, "") {
+				if !strings.HasPrefix(item, "STATISTICS_") {
+					md = append(md, item)
+				}
+			}
+			if len(md) > 0 {
+				if err := set_band_metadata(&dst_band, md, ""); err != nil {
+					return err
+				}
+			}
+		}
+		if !opt.NoColorInterp {
+			ci := src_band.ColorInterp()
+			if ci != gdal.CI_Undefined && ci != gdal.CI_PaletteIndex {
+				if err := dst_band.SetColorInterp(ci); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+type Options struct {
+	ScanOptions
+	OutputFormat    string           //-of
+	CreationOptions []string         //-co KEY=VALUE
+	Mode            string           //-mode; name of a registered Stretcher, also set by the mode flags
+	ModeOptions     []string         //-mode-opt KEY=VALUE; for registered Stretchers
+	DumpHistogram   bool             //-dump-histogram; to DstFn, or stdout if it is empty or "-"
+	DumpFormat      DumpFormat       //-dump-format csv|json
+	DumpEmptyBins   bool             //-dump-empty
+	DumpBins        int              //-dump-bins; linear bins between the band min and max, if the histogram has more
+	ApplyFn         string           //-apply; stretch saved with SaveParams, used instead of a Mode; its output and no-data settings replace these
+	SaveParams      string           //-save-params; JSON file the computed stretch is saved to, see StretchParams
+	DstAvg          float64          //-linear-stretch, -decorrelation, -histeq-avg; in output levels, mid-range for -histeq unless DstAvgSet
+	DstAvgSet       bool             //-histeq-avg; DstAvg was given, so -histeq uses it even if 0
+	DstStddev       float64          //-linear-stretch, -decorrelation, -histeq; in output levels
+	Target          TargetShape      //-histeq-target; distribution -histeq maps onto
+	TargetFn        string           //-histeq-target; CSV or JSON PDF if Target is TargetFile
+	RefFn           string           //-match; raster whose values the output takes on, same band ids as the source
+	FromPercentile  []float64        //-percentile-range; one for all bands or one per selected band
+	ToPercentile    []float64        //-percentile-range; same layout as FromPercentile
+	OutNdv          float64          //-outndv; in output units
+	Mask            MaskMode         //-alpha, -mask
+	OutputType      gdal.DataType    //-ot; Byte if unset
+	OutputRange     int              //-outrange; number of output levels from 0, see output_type_range for the default
+	FloatBinning    FloatBinningMode //-float-bins linear|log; histogram of non 8/16-bit bands
+	HistogramMemory int              //-histogram-memory; bytes per worker, shared by the non 8/16-bit bands
+	HistogramCache  string           //-histogram-cache; JSON file histograms are reused from while the source is unchanged
+	Pam             bool             //-pam; the same with the default histograms and statistics of the source .aux.xml
+	StatsFns        []string         //-stats-from; files, globs or @lists of files whose merged histograms replace those of SrcFn
+	Stats           StatsEngine      //-stats histogram|tdigest
+	Compression     float64          //-tdigest-compression; DefaultCompression if unset
+	Transfer        TransferFunc     //-transfer gamma|log|sqrt|sigmoid; curve after the linear modes
+	Gamma           float64          //-gamma
+	Gain            float64          //-gain; of log and sigmoid, 10 if unset
+	Midpoint        float64          //-midpoint; of sigmoid within 0..1, 0.5 unless MidpointSet
+	MidpointSet     bool             //-midpoint; Midpoint was given, so sigmoid uses it even if 0
+	Link            LinkMode         //-link all|luminance; one stretch shared by all bands
+	LumaWeights     []float64        //-luma-weights; per selected band, see LinkLuminance
+	ClaheTile       int              //-clahe-tile; tile edge in pixels, 256 if unset
+	ClaheClip       float64          //-clahe-clip; tile bins are clipped at this multiple of their mean count, 4 if unset
+	SrcFn           string
+	DstFn           string
+	Bands           []int        //-b; source band ids in output order, all bands if empty
+	NoGeoTransform  bool         //-nogt
+	NoProjection    bool         //-nosrs
+	NoGCPs          bool         //-nogcp
+	NoRPC           bool         //-norpc
+	NoImagery       bool         //-noimagery
+	NoMetadata      bool         //-nomd; dataset metadata
+	NoBandMetadata  bool         //-nobandmd
+	NoColorInterp   bool         //-nocolorinterp
+	Ndv             [][2]float64 //-ndv; one range for all bands or one per selected band
+	ValidRange      [][2]float64 //-valid-range; same layout as Ndv
+	applied         *StretchParams
+	// mosaic holds the merged histograms of StatsFns once computed, so a
+	// batch computes them once for all sources.
+	mosaic *mosaic_stats
+	// progress_prefix names the source in the progress messages while a
+	// batch runs several at once, see progress.
+	progress_prefix string
+}
+
+func (self *Options) handle() error {
+	selected := 0
+	for _, set := range []bool{len(self.Mode) > 0, len(self.ApplyFn) > 0, self.DumpHistogram} {
+		if set {
+			selected++
+		}
+	}
+	if selected != 1 {
+		return ErrNoMode
+	}
+	// the saved settings are checked like given ones below
+	if len(self.ApplyFn) > 0 {
+		if err := self.load_applied(); err != nil {
+			return err
+		}
+	}
+	var stretcher Stretcher
+	if len(self.Mode) > 0 && !builtin_modes[self.Mode] {
+		var ok bool
+		if stretcher, ok = LookupStretcher(self.Mode); !ok {
+			return fmt.Errorf("%w: unknown mode %s, have %s", ErrNoMode, self.Mode, strings.Join(Stretchers(), ", "))
+		}
+	}
+
+	if len(self.SrcFn) == 0 {
+		return ErrMissingSrcFn
+	}
+	if len(self.DstFn) == 0 && !self.DumpHistogram {
+		return ErrMissingDstFn
+	}
+	if self.DumpFormat < DumpCSV || self.DumpFormat > DumpJSON {
+		return fmt.Errorf("%w: unknown dump format %d", ErrBadArgs, self.DumpFormat)
+	}
+	if self.DumpBins < 0 {
+		return fmt.Errorf("%w: negative -dump-bins", ErrBadArgs)
+	}
+	if len(self.OutputFormat) == 0 {
+		self.OutputFormat = "GTiff"
+	}
+	if self.OutputType == gdal.Unknown {
+		self.OutputType = gdal.Byte
+	}
+	def_range, max_range, err := output_type_range(self.OutputType)
+	if err != nil {
+		return err
+	}
+	if self.OutputRange == 0 {
+		self.OutputRange = def_range
+	}
+	if self.OutputRange < 2 || self.OutputRange > max_range {
+		return fmt.Errorf("%w: output range must be within 2..%d", ErrBadArgs, max_range)
+	}
+	if self.HistogramMemory == 0 {
+		self.HistogramMemory = DefaultHistogramMemory
+	}
+	if self.SampleStep < 0 {
+		return fmt.Errorf("%w: negative -sample-step", ErrBadArgs)
+	}
+	if self.HistogramMemory < min_histogram_memory {
+		return fmt.Errorf("%w: histogram memory must be at least %d bytes", ErrBadArgs, min_histogram_memory)
+	}
+	if self.Stats == StatsTDigest {
+		if _, ok := stretcher.(DistributionStretcher); !ok {
+			return fmt.Errorf("%w: t-digest statistics only support -percentile-range and -minmax", ErrBadArgs)
+		}
+	}
+	switch self.Transfer {
+	case TransferLinear, TransferSqrt:
+	case TransferGamma:
+		if self.Gamma <= 0 {
+			return fmt.Errorf("%w: -gamma must be positive", ErrBadArgs)
+		}
+	case TransferLog, TransferSigmoid:
+		if self.Gain == 0 {
+			self.Gain = default_gain
+		}
+		if !self.MidpointSet {
+			self.Midpoint = default_midpoint
+		}
+		if self.Gain < 0 || self.Midpoint < 0 || self.Midpoint > 1 {
+			return fmt.Errorf("%w: -gain must be positive and -midpoint within 0..1", ErrBadArgs)
+		}
+	default:
+		return fmt.Errorf("%w: unknown transfer function %d", ErrBadArgs, self.Transfer)
+	}
+	if len(self.StatsFns) > 0 {
+		switch {
+		case self.Stats == StatsTDigest:
+			return fmt.Errorf("%w: -stats-from needs histogram statistics", ErrBadArgs)
+		case self.Link == LinkLuminance:
+			return fmt.Errorf("%w: -stats-from cannot be linked by luminance", ErrBadArgs)
+		case len(self.HistogramCache) > 0 || self.Pam:
+			return fmt.Errorf("%w: -histogram-cache and -pam keep the histograms of the source only, not of -stats-from", ErrBadArgs)
+		}
+	}
+	if self.Stats == StatsTDigest && self.Link == LinkLuminance {
+		return fmt.Errorf("%w: t-digest statistics cannot be linked by luminance", ErrBadArgs)
+	}
+	if self.Link < LinkNone || self.Link > LinkLuminance {
+		return fmt.Errorf("%w: unknown link mode %d", ErrBadArgs, self.Link)
+	}
+	if self.Compression < 0 {
+		return fmt.Errorf("%w: negative t-digest compression", ErrBadArgs)
+	}
+	if self.Mask < MaskNdv || self.Mask > MaskInternal {
+		return fmt.Errorf("%w: unknown mask mode %d", ErrBadArgs, self.Mask)
+	}
+	if !check_out_ndv(self.OutNdv, self.OutputType) {
+		return fmt.Errorf("%w: output no-data value %g does not fit the output type", ErrBadArgs, self.OutNdv)
+	}
+	switch self.Mode {
+	case "clahe":
+		return check_clahe_options(self)
+	case "decorrelation":
+		return check_decorrelation_options(self)
+	}
+	if checker, ok := stretcher.(OptionsChecker); ok {
+		return checker.CheckOptions(self)
+	}
+	return nil
+}
+
+// ModeOption returns the value of key in ModeOptions.
+func (self *Options) ModeOption(key string) (string, bool) {
+	for _, item := range self.ModeOptions {
+		if k := strings.SplitN(item, "=", 2); len(k) == 2 && k[0] == key {
+			return k[1], true
+		}
+	}
+	return "", false
+}
+
+// percentile_range returns the percentile cuts of band band_idx.
+func (self *Options) percentile_range(band_idx int) (from, to float64) {
+	from = self.FromPercentile[0]
+	if len(self.FromPercentile) > 1 {
+		from = self.FromPercentile[band_idx]
+	}
+	to = self.ToPercentile[0]
+	if len(self.ToPercentile) > 1 {
+		to = self.ToPercentile[band_idx]
+	}
+	return from, to
+}
+
+// progress announces a stage of Run.  The sources of a batch of several
+// jobs are announced at once, so each message is then a single line
+// naming its source.
+func (self *Options) progress(stage string) {
+	if len(self.progress_prefix) > 0 {
+		fmt.Fprintf(os.Stderr, "%s: %s...\n", self.progress_prefix, stage)
+		return
+	}
+	print("\n", stage, "...\n")
+}
+
+// ndv_def returns the no-data definition given by Ndv or ValidRange.
+func (self *Options) ndv_def() (NdvDef, error) {
+	ndv_def := NdvDef{}
+	if len(self.Ndv) > 0 && len(self.ValidRange) > 0 {
+		return ndv_def, ErrNdvAndValidRange
+	} else {
+		ndv_def.Invert = len(self.ValidRange) > 0
+	}
+	ndvslab := NdvSlab{}
+	switch {
+	case len(self.Ndv) > 0:
+		ndvslab.RangeByBand = self.Ndv
+	case len(self.ValidRange) > 0:
+		ndvslab.RangeByBand = self.ValidRange
+	}
+	if !ndvslab.Empty() {
+		ndv_def.Slabs = append(ndv_def.Slabs, ndvslab)
+	}
+	return ndv_def, nil
+}
+
+// bandlist returns the source band ids of Bands, or of all src_band_count
+// bands if it is empty.
+func (self *Options) bandlist(src_band_count int) ([]int, error) {
+	var bandlist []int
+	if len(self.Bands) > 0 {
+		for _, v := range self.Bands {
+			if v < 1 || v > src_band_count {
+				return nil, fmt.Errorf("%w: %d", ErrBandOutOfRange, v)
+			}
+			bandlist = append(bandlist, v)
+		}
+	} else {
+		for i := 0; i < src_band_count; i++ {
+			bandlist = append(bandlist, i+1)
+		}
+	}
+	return bandlist, nil
+}
+
+// band_ndv_def returns ndv_def, or if it is empty the NoData values of the
+// selected bands of ds, provided every one of them declares one.
+func band_ndv_def(ndv_def NdvDef, ds *gdal.Dataset, bandlist []int) (NdvDef, error) {
+	if ndv_def.Empty() {
+		var tmp [][2]float64
+		for _, v := range bandlist {
+			band := ds.RasterBand(v)
+			val, ok := band.NoDataValue()
+			if ok {
+				tmp = append(tmp, [2]float64{val, val})
+			}
+		}
+		// only usable if every selected band declares one
+		if len(tmp) == len(bandlist) {
+			ndv_def.Slabs = append(ndv_def.Slabs, NdvSlab{RangeByBand: tmp})
+		}
+	}
+	for _, slab := range ndv_def.Slabs {
+		if len(slab.RangeByBand) != 1 && len(slab.RangeByBand) != len(bandlist) {
+			return ndv_def, fmt.Errorf("%w: got %d no-data ranges for %d bands", ErrBadArgs, len(slab.RangeByBand), len(bandlist))
+		}
+	}
+	return ndv_def, nil
+}
+
+// histogram_binnings chooses the binning of every band: one bin per value
+// for the 8 and 16-bit integer types and opt.FloatBinning within
+// opt.HistogramMemory for the others, and one linear binning for all bands
+// if they are linked but differ.
+func histogram_binnings(opt *Options, bands []gdal.RasterBand, ndv_def *NdvDef, w, h int) ([]Binning, error) {
+	var binnings = make([]Binning, len(bands))
+	var minmax [][2]float64
+	var err error
+	// every worker keeps its own counts, so this bounds the memory per
+	// worker
+	float_bands := 0
+	for _, band := range bands {
+		if _, ok := type_binning(band.RasterDataType()); !ok {
+			float_bands++
+		}
+	}
+	band_memory := opt.HistogramMemory
+	if float_bands > 1 {
+		band_memory /= float_bands
+	}
+	if band_memory < min_histogram_memory {
+		return nil, fmt.Errorf("%w: histogram memory must be at least %d bytes per band", ErrBadArgs, min_histogram_memory)
+	}
+	float_nbins := band_memory / int(unsafe.Sizeof(uint(0)))
+	for band_idx := 0; band_idx < len(bands); band_idx++ {
+		var binning = &binnings[band_idx]
+		var ok bool
+		if *binning, ok = type_binning(bands[band_idx].RasterDataType()); ok {
+			continue
+		}
+		if opt.FloatBinning == FloatBinsLog {
+			*binning = LogBinning(float_nbins)
+			log.Printf("band %d: %d log-scale bins, values accurate to %g%%\n", band_idx+1, binning.Nbins, 100*binning.RelativeError())
+			continue
+		}
+		if len(minmax) == 0 {
+			minmax, err = ComputeMinmax(bands, ndv_def, w, h, &opt.ScanOptions)
+			if err != nil {
+				return nil, err
+			}
+		}
+		*binning = LinearBinning(minmax[band_idx][0], minmax[band_idx][1], float_nbins)
+		log.Printf("band %d: %d linear bins, values accurate to +/-%g\n", band_idx+1, binning.Nbins, binning.Scale/2)
+	}
+	// linked histograms are merged or binned from several bands, so
+	// they need a common binning, which then counts every band
+	if opt.Link != LinkNone && !same_binning(binnings) {
+		band_memory = opt.HistogramMemory / len(bands)
+		if band_memory < min_histogram_memory {
+			return nil, fmt.Errorf("%w: histogram memory must be at least %d bytes per band", ErrBadArgs, min_histogram_memory)
+		}
+		if len(minmax) == 0 {
+			minmax, err = ComputeMinmax(bands, ndv_def, w, h, &opt.ScanOptions)
+			if err != nil {
+				return nil, err
+			}
+		}
+		min, max := value_range(minmax)
+		shared := LinearBinning(min, max, band_memory/int(unsafe.Sizeof(uint(0))))
+		for band_idx := range binnings {
+			binnings[band_idx] = shared
+		}
+		log.Printf("all bands: %d linear bins, values accurate to +/-%g\n", shared.Nbins, shared.Scale/2)
+	}
+	return binnings, nil
+}
+
+// Run stretches opt.SrcFn into opt.DstFn (or only dumps the histogram) as
+// described by opt.  Errors wrap one of the Err* sentinels where applicable.
+func Run(opt *Options) error {
+	if err := opt.handle(); err != nil {
+		return err
+	}
+	ndv_def, err := opt.ndv_def()
+	if err != nil {
+		return err
+	}
+
+	src_ds, err := gdal.Open(opt.SrcFn, gdal.ReadOnly)
+	if err != nil {
+		return err
+	}
+	defer src_ds.Close()
+
+	w := src_ds.RasterXSize()
+	h := src_ds.RasterYSize()
+	if w == 0 || h == 0 {
+		return ErrEmptyRaster
+	}
+	src_band_count := src_ds.RasterCount()
+	log.Printf("Input size is %d, %d, %d\n", w, h, src_band_count)
+
+	bandlist, err := opt.bandlist(src_band_count)
+	if err != nil {
+		return err
+	}
+	dst_band_count := len(bandlist)
+
+	opt_ndv_def := ndv_def
+	ndv_def, err = band_ndv_def(opt_ndv_def, &src_ds, bandlist)
+	if err != nil {
+		return err
+	}
+
+	dst_driver, err := gdal.GetDriverByName(opt.OutputFormat)
+	if err != nil {
+		return err
+	}
+	var src_bands, dst_bands []gdal.RasterBand
+	for _, v := range bandlist {
+		src_bands = append(src_bands, src_ds.RasterBand(v))
+	}
+	// Without histograms, i.e. with t-digest statistics, the transforms
+	// are computed from dists.  The decorrelation stretch only needs the
+	// covariance, saved transforms nothing.
+	var (
+		histograms []Histogram
+		cov        *Covariance
+	)
+	dists := make([]Distribution, dst_band_count)
+	switch {
+	case opt.applied != nil:
+	case opt.Mode == "decorrelation":
+		opt.progress("Computing covariance")
+		cov, err = ComputeCovariance(src_bands, &ndv_def, w, h, &opt.ScanOptions)
+		if err != nil {
+			return err
+		}
+		for band_idx := 0; band_idx < dst_band_count; band_idx++ {
+			log.Printf("band %d: min=%f, max=%f, mean=%f, stddev=%f, valid_count=%d\n", band_idx+1,
+				cov.Min[band_idx], cov.Max[band_idx], cov.Mean[band_idx], math.Sqrt(cov.Cov[band_idx][band_idx]), cov.Count)
+		}
+	case opt.Stats == StatsTDigest:
+		opt.progress("Computing t-digest")
+		digests, err := ComputeTDigest(src_bands, &ndv_def, w, h, opt.Compression, &opt.ScanOptions)
+		if err != nil {
+			return err
+		}
+		for band_idx, td := range digests {
+			log.Printf("band %d: min=%f, max=%f, valid_count=%d\n", band_idx+1, td.Min(), td.Max(), td.Count())
+			dists[band_idx] = td
+		}
+		if opt.Link == LinkAll {
+			linked := NewTDigest(opt.Compression)
+			for band_idx := range digests {
+				linked.Merge(digests[band_idx])
+				dists[band_idx] = linked
+			}
+			log.Printf("all bands: min=%f, max=%f, valid_count=%d\n", linked.Min(), linked.Max(), linked.Count())
+		}
+	case len(opt.StatsFns) > 0:
+		if opt.mosaic != nil {
+			histograms, err = opt.mosaic.band_histograms(bandlist)
+		} else {
+			histograms, err = mosaic_histograms(opt, bandlist, opt_ndv_def)
+		}
+		if err != nil {
+			return err
+		}
+		// logged, dumped and linked like those of the source
+		fallthrough
+	default:
+		cache := new_histogram_cache(opt, src_bands, bandlist, &ndv_def)
+		if cache != nil {
+			histograms = cache.load()
+		}
+		if histograms == nil {
+			binnings, err := histogram_binnings(opt, src_bands, &ndv_def, w, h)
+			if err != nil {
+				return err
+			}
+			opt.progress("Computing histogram")
+
+			histograms, err = ComputeHistogram(src_bands, &ndv_def, w, h, binnings, &opt.ScanOptions)
+			if err != nil {
+				return err
+			}
+			if cache != nil {
+				if err := cache.save(histograms); err != nil {
+					return err
+				}
+			}
+		}
+		for band_idx := 0; band_idx < dst_band_count; band_idx++ {
+			hg := &histograms[band_idx]
+			log.Printf("band %d: min=%f, max=%f, mean=%f, stddev=%f, valid_count=%d, ndv_count=%d\n", band_idx+1, hg.Min, hg.Max, hg.Mean, hg.Stddev, hg.DataCount, hg.NdvCount)
+		}
+		if opt.DumpHistogram {
+			return dump_histograms(opt, bandlist, histograms)
+		}
+		if opt.Link != LinkNone {
+			var linked Histogram
+			if opt.Link == LinkLuminance {
+				weights, err := luma_weights(opt, dst_band_count)
+				if err != nil {
+					return err
+				}
+				opt.progress("Computing luminance histogram")
+				linked, err = ComputeLuminanceHistogram(src_bands, &ndv_def, w, h, weights, histograms[0].Binning, &opt.ScanOptions)
+				if err != nil {
+					return err
+				}
+				log.Printf("luminance: min=%f, max=%f, mean=%f, stddev=%f, valid_count=%d\n", linked.Min, linked.Max, linked.Mean, linked.Stddev, linked.DataCount)
+			} else {
+				linked, err = merge_histograms(histograms)
+				if err != nil {
+					return err
+				}
+				log.Printf("all bands: min=%f, max=%f, mean=%f, stddev=%f, valid_count=%d\n", linked.Min, linked.Max, linked.Mean, linked.Stddev, linked.DataCount)
+			}
+			// every band is stretched alike from here on
+			for band_idx := range histograms {
+				histograms[band_idx] = linked
+			}
+		}
+	}
+
+	// CLAHE levels depend on the pixel position and are computed per tile
+	// while writing, see clahe.  The decorrelated bands have mean 0 and
+	// variance 1 and go through the linear path, like -linear-stretch.
+	// The other modes return one Transform per band.
+	var (
+		cl         *clahe
+		dc         *decorrelation
+		transforms []Transform
+	)
+	switch {
+	case opt.applied != nil:
+		transforms = opt.applied.transforms()
+		if dp := opt.applied.Decorrelation; dp != nil {
+			dc = &decorrelation{mean: dp.Mean, matrix: dp.Matrix}
+		}
+	case opt.Mode == "clahe":
+		cl = new_clahe(opt, src_bands, histograms, w, h)
+	case opt.Mode == "decorrelation":
+		dc = new_decorrelation(cov)
+		transforms = make([]Transform, dst_band_count)
+		for band_idx := range transforms {
+			transforms[band_idx].Scale = opt.DstStddev
+			transforms[band_idx].Offset = -opt.DstAvg / opt.DstStddev
+		}
+	default:
+		stretcher, _ := LookupStretcher(opt.Mode)
+		ctx := &StretchContext{Options: opt, Bands: bandlist, NdvDef: opt_ndv_def}
+		if histograms != nil {
+			transforms, err = stretcher.Stretch(ctx, histograms)
+		} else {
+			transforms, err = stretcher.(DistributionStretcher).StretchDistributions(ctx, dists)
+		}
+		if err != nil {
+			return err
+		}
+		if len(transforms) != dst_band_count {
+			return fmt.Errorf("%w: mode %s returned %d transforms for %d bands", ErrBadArgs, opt.Mode, len(transforms), dst_band_count)
+		}
+	}
+	// Bands with a transform table map every bin of table_binnings to an
+	// output level, the others use lin_scales and lin_offsets.
+	var (
+		output_range   = opt.OutputRange
+		xform_table    = make([][]float64, dst_band_count)
+		table_binnings = make([]Binning, dst_band_count)
+		lin_scales     = make([]float64, dst_band_count)
+		lin_offsets    = make([]float64, dst_band_count)
+	)
+	for band_idx := range table_binnings {
+		switch {
+		case opt.applied != nil && opt.applied.Bands[band_idx].Binning != nil:
+			table_binnings[band_idx] = *opt.applied.Bands[band_idx].Binning
+		case histograms != nil:
+			table_binnings[band_idx] = histograms[band_idx].Binning
+		}
+	}
+	for band_idx, tr := range transforms {
+		if tr.Table == nil {
+			lin_scales[band_idx] = tr.Scale
+			lin_offsets[band_idx] = tr.Offset
+			continue
+		}
+		if len(tr.Table) != table_binnings[band_idx].Nbins {
+			return fmt.Errorf("%w: mode %s returned a table that does not match the histogram of band %d", ErrBadArgs, opt.Mode, band_idx+1)
+		}
+		if opt.Transfer != TransferLinear {
+			return fmt.Errorf("%w: transfer functions only apply to the linear modes", ErrBadArgs)
+		}
+		xform_table[band_idx] = tr.Table
+	}
+	if len(opt.SaveParams) > 0 {
+		params := new_params(opt, bandlist, lin_scales, lin_offsets, xform_table, table_binnings, histograms, dists, cov, dc)
+		if err := SaveParams(opt.SaveParams, params); err != nil {
+			return err
+		}
+	}
+
+	out_band_count := dst_band_count
+	if opt.Mask == MaskAlpha {
+		out_band_count++
+	}
+	dst_ds, err := create_output(dst_driver, opt.DstFn, w, h, out_band_count, opt.OutputType, opt.CreationOptions)
+	if err != nil {
+		return err
+	}
+	defer dst_ds.Close()
+	if err := copyGeoCode(&dst_ds.Dataset, &src_ds, opt); err != nil {
+		return err
+	}
+	if err := copyMetadata(&dst_ds.Dataset, &src_ds, bandlist, opt); err != nil {
+		return err
+	}
+	for band_idx := 0; band_idx < dst_band_count; band_idx++ {
+		dst_bands = append(dst_bands, dst_ds.RasterBand(band_idx+1))
+	}
+
+	// Nodata pixels are marked either by the reserved OutNdv value or by an
+	// alpha/mask band, in which case valid pixels may use the full range.
+	var mask_band gdal.RasterBand
+	squeeze_ndv := opt.Mask == MaskNdv
+	switch opt.Mask {
+	case MaskNdv:
+		if !ndv_def.Empty() {
+			for _, band := range dst_bands {
+				if err := band.SetNoDataValue(opt.OutNdv); err != nil {
+					return err
+				}
+			}
+		}
+	case MaskAlpha:
+		mask_band = dst_ds.RasterBand(out_band_count)
+		if err := mask_band.SetColorInterp(gdal.CI_AlphaBand); err != nil {
+			return err
+		}
+	case MaskInternal:
+		if err := dst_ds.CreateMaskBand(gmf_per_dataset); err != nil {
+			return err
+		}
+		mask_band = dst_bands[0].GetMaskBand()
+	}
+
+	// Output values are computed as levels 0..output_range-1.  Float
+	// outputs are then normalised to [0,1], so the no-data value is
+	// compared in level units.
+	out_scale := 1.0
+	float_out := is_float_type(opt.OutputType)
+	if float_out {
+		out_scale = 1 / float64(output_range-1)
+	}
+	ndv_level := opt.OutNdv / out_scale
+	if squeeze_ndv {
+		if !ndv_def.Empty() {
+			for j := range xform_table {
+				for i := 0; i < len(xform_table[j]); i++ {
+					xform_table[j][i] = avoid_ndv(xform_table[j][i], ndv_level, output_range)
+				}
+			}
+		}
+	}
+
+	// linear_level is the output level of x for the linear modes,
+	// including the transfer curve.
+	curve := transfer_curve(opt)
+	top := float64(output_range - 1)
+	linear_level := func(band_idx int, x float64) float64 {
+		out_dbl := (x - lin_offsets[band_idx]) * lin_scales[band_idx]
+		if curve != nil {
+			out_dbl = curve(math.Min(math.Max(out_dbl/top, 0), 1)) * top
+		}
+		var v float64
+		if out_dbl < 0 {
+			v = 0
+		} else if out_dbl > top {
+			v = top
+		} else if float_out {
+			v = out_dbl
+		} else {
+			v = math.Trunc(out_dbl)
+		}
+		if squeeze_ndv {
+			v = avoid_ndv(v, ndv_level, output_range)
+		}
+		return v
+	}
+	// a curve is costly per pixel, so integer bands get it tabulated
+	if curve != nil && dc == nil {
+		for band_idx := range xform_table {
+			binning := table_binnings[band_idx]
+			if xform_table[band_idx] != nil || !exact_binning(src_bands[band_idx].RasterDataType(), binning) {
+				continue
+			}
+			table := make([]float64, binning.Nbins)
+			for i := range table {
+				table[i] = linear_level(band_idx, binning.FromBin(i))
+			}
+			xform_table[band_idx] = table
+		}
+	}
+
+	opt.progress("Computing output")
+
+	var mask_valid float64
+	switch opt.Mask {
+	case MaskAlpha:
+		mask_valid = float64(output_range-1) * out_scale
+	case MaskInternal:
+		mask_valid = 255
+	}
+
+	transform := func(rd *block_reader, ob *out_block) error {
+		for band_idx := 0; band_idx < dst_band_count; band_idx++ {
+			p_in := &rd.buf_in[band_idx]
+			p_out := &ob.bufs[band_idx]
+			p_ndv := &rd.ndv_mask
+			if cl != nil {
+				for i := 0; i < rd.n; i++ {
+					if (*p_ndv)[i] != 0 {
+						(*p_out)[i] = opt.OutNdv
+						continue
+					}
+					v, err := cl.level(band_idx, ob.blk, i, (*p_in)[i])
+					if err != nil {
+						return err
+					}
+					if !float_out {
+						v = math.Round(v)
+					}
+					if squeeze_ndv {
+						v = avoid_ndv(v, ndv_level, output_range)
+					}
+					(*p_out)[i] = v * out_scale
+				}
+			} else if dc != nil {
+				for i := 0; i < rd.n; i++ {
+					if (*p_ndv)[i] != 0 {
+						(*p_out)[i] = opt.OutNdv
+					} else {
+						(*p_out)[i] = linear_level(band_idx, dc.band_value(band_idx, rd, i)) * out_scale
+					}
+				}
+			} else if xform_table[band_idx] != nil {
+				xfrom := &xform_table[band_idx]
+				binning := table_binnings[band_idx]
+				for i := 0; i < rd.n; i++ {
+					if (*p_ndv)[i] != 0 {
+						(*p_out)[i] = opt.OutNdv
+					} else {
+						bin, err := binning.ToBin((*p_in)[i])
+						if err != nil {
+							return err
+						}
+						(*p_out)[i] = (*xfrom)[bin] * out_scale
+					}
+				}
+			} else {
+				for i := 0; i < rd.n; i++ {
+					if (*p_ndv)[i] != 0 {
+						(*p_out)[i] = opt.OutNdv
+					} else {
+						(*p_out)[i] = linear_level(band_idx, (*p_in)[i]) * out_scale
+					}
+				}
+			}
+		}
+		if ob.mask != nil {
+			for i := 0; i < rd.n; i++ {
+				if rd.ndv_mask[i] != 0 {
+					ob.mask[i] = 0
+				} else {
+					ob.mask[i] = mask_valid
+				}
+			}
+		}
+		return nil
+	}
+	write := func(ob *out_block) error {
+		blk := ob.blk
+		for band_idx := 0; band_idx < dst_band_count; band_idx++ {
+			if err := dst_bands[band_idx].IO(gdal.Write, blk.off_x, blk.off_y, blk.size_x, blk.size_y, ob.bufs[band_idx], blk.size_x, blk.size_y, 0, 0); err != nil {
+				return err
+			}
+		}
+		if ob.mask != nil {
+			if err := mask_band.IO(gdal.Write, blk.off_x, blk.off_y, blk.size_x, blk.size_y, ob.mask, blk.size_x, blk.size_y, 0, 0); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	workers := scan_workers(&opt.ScanOptions)
+	if cl != nil {
+		err = cl.transform_blocks(src_bands, &ndv_def, w, h, workers, dst_band_count, opt.Mask != MaskNdv, transform, write)
+	} else {
+		err = transform_blocks(src_bands, &ndv_def, w, h, workers, dst_band_count, opt.Mask != MaskNdv, transform, write)
+	}
+	if err != nil {
+		return err
+	}
+	return dst_ds.Commit()
+}
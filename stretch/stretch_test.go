@@ -0,0 +1,469 @@
+package stretch
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/lukeroth/gdal"
+)
+
+// level_moments returns the mean, stddev and share of every level of the
+// pixels of hg mapped through table.
+func level_moments(hg *Histogram, table []float64, output_range int) (mean, stddev float64, shares []float64) {
+	shares = make([]float64, output_range)
+	for i, cnt := range hg.Counts {
+		shares[int(table[i])] += float64(cnt) / float64(hg.DataCount)
+	}
+	for level, share := range shares {
+		mean += float64(level) * share
+	}
+	for level, share := range shares {
+		stddev += (float64(level) - mean) * (float64(level) - mean) * share
+	}
+	return mean, math.Sqrt(stddev), shares
+}
+
+func TestInvertHistogramGaussian(t *testing.T) {
+	sources := []struct {
+		name  string
+		count func(i int) uint
+	}{
+		{"flat", func(i int) uint { return 16 }},
+		{"ramp", func(i int) uint { return uint(i) }},
+		{"dark", func(i int) uint { return uint(65536 - i) }},
+	}
+	targets := []struct{ avg, stddev float64 }{
+		{127.5, 40},
+		{100, 20},
+		{160, 30},
+		{127.5, 0},
+	}
+	for _, src := range sources {
+		hg := Histogram{Binning: Binning{Nbins: 65536, Scale: 1}, Counts: make([]uint, 65536)}
+		for i := range hg.Counts {
+			hg.Counts[i] = src.count(i)
+		}
+		hg.update_stats()
+		for _, tc := range targets {
+			target := gen_gaussian(tc.avg, tc.stddev, 256)
+			table := invert_histogram(&hg, target, 256)
+			mean, stddev, shares := level_moments(&hg, table, 256)
+
+			want_mean, want_stddev := tc.avg, tc.stddev
+			if tc.stddev == 0 {
+				// flat over all levels
+				want_stddev = math.Sqrt((256*256 - 1) / 12.0)
+			}
+			if math.Abs(mean-want_mean) > 1 || math.Abs(stddev-want_stddev) > 1 {
+				t.Errorf("%s to %g+/-%g: got %g+/-%g", src.name, tc.avg, tc.stddev, mean, stddev)
+			}
+			var distance float64
+			for level := range shares {
+				distance += math.Abs(shares[level]-target[level]) / 2
+			}
+			if distance > 0.005 {
+				t.Errorf("%s to %g+/-%g: levels are %g off the target shape", src.name, tc.avg, tc.stddev, distance)
+			}
+		}
+	}
+}
+
+func TestHisteqAvg(t *testing.T) {
+	cases := []struct {
+		avg  float64
+		set  bool
+		want float64
+	}{
+		{0, false, 127.5},
+		{0, true, 0},
+		{60, true, 60},
+	}
+	for _, tc := range cases {
+		opt := &Options{SrcFn: "in.tif", DstFn: "out.tif", Mode: "histeq", DstAvg: tc.avg, DstAvgSet: tc.set, DstStddev: 40}
+		if err := opt.handle(); err != nil {
+			t.Fatal(err)
+		}
+		if opt.DstAvg != tc.want {
+			t.Errorf("-histeq-avg %g (set %v): got %g, want %g", tc.avg, tc.set, opt.DstAvg, tc.want)
+		}
+	}
+}
+
+func TestHisteq(t *testing.T) {
+	r := rand.New(rand.NewSource(5))
+	sources := []string{
+		test_raster(t, "heq16", 400, 300, 1, gdal.UInt16, func(b, x, y int) float64 { return math.Floor(r.ExpFloat64() * 500) }),
+		test_raster(t, "heqf", 400, 300, 1, gdal.Float32, func(b, x, y int) float64 { return r.Float64()*r.Float64() - 3 }),
+	}
+	cases := []struct {
+		avg    float64
+		set    bool
+		stddev float64
+		// of the output levels
+		mean, want_stddev float64
+	}{
+		{0, false, 40, 127.5, 40},
+		{90, true, 25, 90, 25},
+		{0, false, 0, 127.5, math.Sqrt((256*256 - 1) / 12.0)},
+	}
+	dir := t.TempDir()
+	for _, src_fn := range sources {
+		for _, tc := range cases {
+			opt := Options{SrcFn: src_fn, DstFn: filepath.Join(dir, "out.tif"), Mode: "histeq", DstAvg: tc.avg, DstAvgSet: tc.set, DstStddev: tc.stddev}
+			if err := Run(&opt); err != nil {
+				t.Fatal(err)
+			}
+			mean, stddev := moments(read_test_raster(t, opt.DstFn)[0], -1)
+			if math.Abs(mean-tc.mean) > 1 || math.Abs(stddev-tc.want_stddev) > 1 {
+				t.Errorf("%s to %g+/-%g: got %g+/-%g", filepath.Base(src_fn), tc.mean, tc.want_stddev, mean, stddev)
+			}
+		}
+	}
+
+	opt := Options{SrcFn: sources[0], DstFn: filepath.Join(dir, "out.tif"), Mode: "histeq", DstAvg: 300, DstAvgSet: true, DstStddev: 3}
+	if err := Run(&opt); !errors.Is(err, ErrBadArgs) {
+		t.Errorf("-histeq-avg 300: got %v, want %v", err, ErrBadArgs)
+	}
+}
+
+func TestBands(t *testing.T) {
+	src_fn := test_raster(t, "bands", 64, 48, 3, gdal.Byte, func(b, x, y int) float64 {
+		return [3]float64{float64(x), float64(y), float64(x + y)}[b]
+	})
+	dir := t.TempDir()
+	run := func(bands []int, ndv [][2]float64) ([][]float64, error) {
+		opt := Options{SrcFn: src_fn, DstFn: filepath.Join(dir, "out.tif"), Mode: "percentile", FromPercentile: []float64{0}, ToPercentile: []float64{1}, Bands: bands, Ndv: ndv}
+		if err := Run(&opt); err != nil {
+			return nil, err
+		}
+		return read_test_raster(t, opt.DstFn), nil
+	}
+
+	var single [][]float64
+	for b := 1; b <= 3; b++ {
+		out, err := run([]int{b}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(out) != 1 {
+			t.Fatalf("-b %d: got %d bands, want 1", b, len(out))
+		}
+		single = append(single, out[0])
+	}
+	all, err := run(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(all, single) {
+		t.Error("no -b: bands differ from the bands stretched one by one")
+	}
+	for _, bands := range [][]int{{3, 1}, {2, 2, 1}} {
+		out, err := run(bands, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(out) != len(bands) {
+			t.Fatalf("-b %v: got %d bands", bands, len(out))
+		}
+		for i, b := range bands {
+			if !reflect.DeepEqual(out[i], single[b-1]) {
+				t.Errorf("-b %v: output band %d is not source band %d", bands, i+1, b)
+			}
+		}
+	}
+
+	for _, bands := range [][]int{{0}, {4}, {1, 5}} {
+		if _, err := run(bands, nil); !errors.Is(err, ErrBandOutOfRange) {
+			t.Errorf("-b %v: got %v, want %v", bands, err, ErrBandOutOfRange)
+		}
+	}
+
+	// one no-data range for all bands or one per selected band
+	ndv := [][2]float64{{0, 0}, {0, 0}}
+	if _, err := run([]int{3, 1}, ndv); err != nil {
+		t.Errorf("2 ranges for -b 3 -b 1: %v", err)
+	}
+	if _, err := run(nil, ndv); !errors.Is(err, ErrBadArgs) {
+		t.Errorf("2 ranges for 3 bands: got %v, want %v", err, ErrBadArgs)
+	}
+	if _, err := run(nil, ndv[:1]); err != nil {
+		t.Errorf("1 range for 3 bands: %v", err)
+	}
+}
+
+const test_wkt = `GEOGCS["WGS 84",DATUM["WGS_1984",SPHEROID["WGS 84",6378137,298.257223563]],PRIMEM["Greenwich",0],UNIT["degree",0.0174532925199433]]`
+
+func TestCopyMetadata(t *testing.T) {
+	src_fn := test_raster(t, "md", 64, 48, 3, gdal.Byte, func(b, x, y int) float64 { return float64(x + y + b) })
+	ds, err := gdal.Open(src_fn, gdal.Update)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gt := [6]float64{500000, 10, 0, 4100000, 0, -10}
+	if err := ds.SetGeoTransform(gt); err != nil {
+		t.Fatal(err)
+	}
+	if err := ds.SetProjection(test_wkt); err != nil {
+		t.Fatal(err)
+	}
+	ds.SetMetadataItem("AREA", "test", "")
+	ds.SetMetadataItem("CLOUDCOVER", "5", "IMAGERY")
+	for b, ci := range []gdal.ColorInterp{gdal.CI_RedBand, gdal.CI_GreenBand, gdal.CI_BlueBand} {
+		band := ds.RasterBand(b + 1)
+		band.SetMetadataItem("WAVELENGTH", fmt.Sprint(650-b*100), "")
+		band.SetMetadataItem("STATISTICS_MEAN", "3", "")
+		if err := band.SetColorInterp(ci); err != nil {
+			t.Fatal(err)
+		}
+	}
+	src_wkt := ds.Projection()
+	ds.Close()
+
+	dst_fn := filepath.Join(t.TempDir(), "out.tif")
+	for _, off := range []bool{false, true} {
+		opt := Options{SrcFn: src_fn, DstFn: dst_fn, Mode: "stddev", DstAvg: 127, DstStddev: 40, Bands: []int{3, 1},
+			NoGeoTransform: off, NoProjection: off, NoMetadata: off, NoImagery: off, NoBandMetadata: off, NoColorInterp: off}
+		if err := Run(&opt); err != nil {
+			t.Fatal(err)
+		}
+		out, err := gdal.Open(dst_fn, gdal.ReadOnly)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := out.GeoTransform() == gt; got == off {
+			t.Errorf("-nogt %v: geotransform %v", off, out.GeoTransform())
+		}
+		if got := out.Projection() == src_wkt; got == off {
+			t.Errorf("-nosrs %v: projection %q", off, out.Projection())
+		}
+		if got := out.MetadataItem("AREA", "") == "test"; got == off {
+			t.Errorf("-nomd %v: AREA=%q", off, out.MetadataItem("AREA", ""))
+		}
+		if got := out.MetadataItem("CLOUDCOVER", "IMAGERY") == "5"; got == off {
+			t.Errorf("-noimagery %v: CLOUDCOVER=%q", off, out.MetadataItem("CLOUDCOVER", "IMAGERY"))
+		}
+		// from source bands 3 and 1
+		for b, want := range []struct {
+			wavelength string
+			ci         gdal.ColorInterp
+		}{{"450", gdal.CI_BlueBand}, {"650", gdal.CI_RedBand}} {
+			band := out.RasterBand(b + 1)
+			if got := band.MetadataItem("WAVELENGTH", "") == want.wavelength; got == off {
+				t.Errorf("-nobandmd %v: band %d WAVELENGTH=%q", off, b+1, band.MetadataItem("WAVELENGTH", ""))
+			}
+			if v := band.MetadataItem("STATISTICS_MEAN", ""); v != "" {
+				t.Errorf("band %d: stale STATISTICS_MEAN=%s copied", b+1, v)
+			}
+			if got := band.ColorInterp() == want.ci; got == off {
+				t.Errorf("-nocolorinterp %v: band %d colour interpretation %s", off, b+1, band.ColorInterp().Name())
+			}
+		}
+		out.Close()
+	}
+}
+
+func TestCopyGCPs(t *testing.T) {
+	dir := t.TempDir()
+	data_fn := test_raster(t, "data", 64, 48, 1, gdal.Byte, func(b, x, y int) float64 { return float64(x + y) })
+	// GCPs can only be set through a VRT here
+	src_fn := filepath.Join(dir, "gcps.vrt")
+	vrt := `<VRTDataset rasterXSize="64" rasterYSize="48">
+  <GCPList Projection="EPSG:4326">
+    <GCP Id="1" Pixel="0" Line="0" X="10" Y="50"/>
+    <GCP Id="2" Pixel="64" Line="0" X="11" Y="50"/>
+    <GCP Id="3" Pixel="0" Line="48" X="10" Y="49"/>
+  </GCPList>
+  <VRTRasterBand dataType="Byte" band="1">
+    <SimpleSource>
+      <SourceFilename relativeToVRT="0">` + data_fn + `</SourceFilename>
+      <SourceBand>1</SourceBand>
+    </SimpleSource>
+  </VRTRasterBand>
+</VRTDataset>
+`
+	if err := os.WriteFile(src_fn, []byte(vrt), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dst_fn := filepath.Join(dir, "out.tif")
+	for _, tc := range []struct {
+		no_gcps bool
+		want    int
+	}{{false, 3}, {true, 0}} {
+		opt := Options{SrcFn: src_fn, DstFn: dst_fn, Mode: "stddev", DstAvg: 127, DstStddev: 40, NoGCPs: tc.no_gcps}
+		if err := Run(&opt); err != nil {
+			t.Fatal(err)
+		}
+		out, err := gdal.Open(dst_fn, gdal.ReadOnly)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := out.GDALGetGCPCount(); n != tc.want {
+			t.Errorf("-nogcp %v: %d GCPs, want %d", tc.no_gcps, n, tc.want)
+		}
+		out.Close()
+	}
+}
+
+func TestComputeMinmax(t *testing.T) {
+	fn := test_raster(t, "minmax", 64, 32, 2, gdal.Float32, func(b, x, y int) float64 {
+		switch {
+		case x == 5:
+			return math.Inf(1)
+		case x == 6:
+			return math.Inf(-1)
+		case x == 7:
+			return math.NaN()
+		}
+		return float64(x+y) - 10*float64(b)
+	})
+	ds, err := gdal.Open(fn, gdal.ReadOnly)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+	minmax, err := ComputeMinmax([]gdal.RasterBand{ds.RasterBand(1), ds.RasterBand(2)}, &NdvDef{}, 64, 32, &ScanOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// left out, the infinite and NaN values
+	want := [][2]float64{{0, 94}, {-10, 84}}
+	if !reflect.DeepEqual(minmax, want) {
+		t.Errorf("got %v, want %v", minmax, want)
+	}
+}
+
+func TestQuantile(t *testing.T) {
+	two_values := Histogram{Binning: Binning{Nbins: 256, Scale: 1}, Counts: make([]uint, 256)}
+	two_values.Counts[10], two_values.Counts[20] = 4, 4
+	two_values.Min, two_values.Max = 10, 20
+	two_values.update_stats()
+	flat := Histogram{Binning: LinearBinning(0, 1, 101), Counts: make([]uint, 101), Max: 1}
+	for i := range flat.Counts {
+		flat.Counts[i] = 1
+	}
+	flat.update_stats()
+	cases := []struct {
+		name string
+		hg   *Histogram
+		q    float64
+		want float64
+	}{
+		// within the half bins up to Min and Max
+		{"two values", &two_values, 0, 10},
+		{"two values", &two_values, 0.25, 10.25},
+		{"two values", &two_values, 0.5, 10.5},
+		{"two values", &two_values, 0.75, 19.75},
+		{"two values", &two_values, 1, 20},
+		{"flat", &flat, 0, 0},
+		{"flat", &flat, 0.5, 0.5},
+		// rank 90.9 of 101 values lies 0.9 into the bin 0.895..0.905
+		{"flat", &flat, 0.9, 0.904},
+		{"flat", &flat, 1, 1},
+	}
+	for _, tc := range cases {
+		got, err := tc.hg.Quantile(tc.q)
+		if err != nil || math.Abs(got-tc.want) > 1e-9 {
+			t.Errorf("%s: quantile %g is %g, %v, want %g", tc.name, tc.q, got, err, tc.want)
+		}
+	}
+	empty := Histogram{Binning: Binning{Nbins: 256, Scale: 1}, Counts: make([]uint, 256)}
+	if _, err := empty.Quantile(0.5); err != ErrNoWindow {
+		t.Errorf("empty histogram: got %v, want %v", err, ErrNoWindow)
+	}
+}
+
+func TestScaleFromPercentile(t *testing.T) {
+	byte_hg := func(count func(v int) uint) *Histogram {
+		hg := &Histogram{Binning: Binning{Nbins: 256, Scale: 1}, Counts: make([]uint, 256)}
+		first := true
+		for v := range hg.Counts {
+			if hg.Counts[v] = count(v); hg.Counts[v] > 0 {
+				if first {
+					hg.Min, first = float64(v), false
+				}
+				hg.Max = float64(v)
+			}
+		}
+		hg.update_stats()
+		return hg
+	}
+	cases := []struct {
+		name                  string
+		hg                    *Histogram
+		output_range          int
+		from, to              float64
+		want_from, want_to    float64
+		want_scale, want_offs float64
+	}{
+		{"full range", byte_hg(func(v int) uint { return 1 }), 256, 0, 1, 0, 255, 1, 0},
+		{"cuts", byte_hg(func(v int) uint { return 1 }), 256, 0.1, 0.9, 25.1, 229.9, 255 / 204.8, 25.1},
+		{"10-bit output", byte_hg(func(v int) uint { return 1 }), 1024, 0, 1, 0, 255, 1023.0 / 255, 0},
+		{"constant", byte_hg(func(v int) uint {
+			if v == 7 {
+				return 9
+			}
+			return 0
+		}), 256, 0.1, 0.9, 7, 7, 0, 7},
+	}
+	for _, tc := range cases {
+		var scale, offset float64
+		from, to, err := get_scale_from_percentile(tc.hg, tc.output_range, tc.from, tc.to, &scale, &offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if math.Abs(from-tc.want_from) > 1e-9 || math.Abs(to-tc.want_to) > 1e-9 ||
+			math.Abs(scale-tc.want_scale) > 1e-9 || math.Abs(offset-tc.want_offs) > 1e-9 {
+			t.Errorf("%s: cuts %g..%g, scale %g, offset %g; want %g..%g, %g, %g", tc.name, from, to, scale, offset, tc.want_from, tc.want_to, tc.want_scale, tc.want_offs)
+		}
+	}
+}
+
+func TestPercentileCuts(t *testing.T) {
+	r := rand.New(rand.NewSource(4))
+	w, h := 300, 200
+	src_fn := test_raster(t, "pct", w, h, 3, gdal.Float32, func(b, x, y int) float64 { return r.NormFloat64()*10 + float64(b)*100 })
+	dst_fn := filepath.Join(t.TempDir(), "out.tif")
+	from := []float64{0.01, 0.05, 0.1}
+	for _, stats := range []StatsEngine{StatsHistogram, StatsTDigest} {
+		for _, bins := range []FloatBinningMode{FloatBinsLinear, FloatBinsLog} {
+			opt := Options{SrcFn: src_fn, DstFn: dst_fn, Mode: "percentile", Stats: stats, FloatBinning: bins,
+				FromPercentile: from, ToPercentile: []float64{0.99}}
+			if err := Run(&opt); err != nil {
+				t.Fatal(err)
+			}
+			out := read_test_raster(t, dst_fn)
+			for b := range out {
+				// level 0 is kept for the output NoData
+				var low, high int
+				for _, v := range out[b] {
+					if v <= 1 {
+						low++
+					}
+					if v == 255 {
+						high++
+					}
+				}
+				low_share, high_share := float64(low)/float64(w*h), float64(high)/float64(w*h)
+				if math.Abs(low_share-from[b]) > 0.01 || math.Abs(high_share-0.01) > 0.005 {
+					t.Errorf("stats %d, bins %d, band %d: %g at the bottom and %g at the top, want %g and 0.01", stats, bins, b+1, low_share, high_share, from[b])
+				}
+			}
+		}
+	}
+
+	opt := Options{SrcFn: src_fn, DstFn: dst_fn, Mode: "percentile", FromPercentile: []float64{0.1, 0.2}, ToPercentile: []float64{0.9}}
+	if err := Run(&opt); !errors.Is(err, ErrBadArgs) {
+		t.Errorf("2 cuts for 3 bands: got %v, want %v", err, ErrBadArgs)
+	}
+	const_fn := test_raster(t, "const", 50, 50, 1, gdal.Byte, func(b, x, y int) float64 { return 7 })
+	opt = Options{SrcFn: const_fn, DstFn: dst_fn, Mode: "percentile", FromPercentile: []float64{0.1}, ToPercentile: []float64{0.9}}
+	if err := Run(&opt); err != nil {
+		t.Errorf("constant band: %v", err)
+	}
+}
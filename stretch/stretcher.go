@@ -0,0 +1,273 @@
+package stretch
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+)
+
+// Transform maps the values of one band onto the output levels
+// 0..OutputRange-1.  If Table is set, histogram bin i maps to level
+// Table[i]; otherwise a value v maps to (v-Offset)*Scale, followed by
+// Options.Transfer.
+type Transform struct {
+	Scale, Offset float64
+	Table         []float64
+}
+
+// StretchContext is what a Stretcher may need besides the statistics.
+type StretchContext struct {
+	Options *Options
+	// Bands are the source band ids in output order.
+	Bands []int
+	// NdvDef is the no-data definition of the options, without the
+	// NoData values of the source bands.
+	NdvDef NdvDef
+}
+
+// Stretcher computes one Transform per band from the band histograms,
+// which are all the same linked histogram if Options.Link is set.
+type Stretcher interface {
+	Stretch(ctx *StretchContext, histograms []Histogram) ([]Transform, error)
+}
+
+// DistributionStretcher is a Stretcher that also works from t-digests,
+// as used with StatsTDigest.  It can only return linear transforms, since
+// a t-digest has no bins.
+type DistributionStretcher interface {
+	Stretcher
+	StretchDistributions(ctx *StretchContext, dists []Distribution) ([]Transform, error)
+}
+
+// OptionsChecker is implemented by Stretchers that validate and default
+// their options before any raster is read.
+type OptionsChecker interface {
+	CheckOptions(opt *Options) error
+}
+
+var (
+	stretchers_mu sync.RWMutex
+	stretchers    = map[string]Stretcher{}
+)
+
+// builtin_modes are the Options.Mode names Run handles itself, since their
+// output levels are not one Transform per band.
+var builtin_modes = map[string]bool{
+	"clahe":         true,
+	"decorrelation": true,
+}
+
+// RegisterStretcher makes s available as Options.Mode name.  It panics if
+// the name is already taken.
+func RegisterStretcher(name string, s Stretcher) {
+	stretchers_mu.Lock()
+	defer stretchers_mu.Unlock()
+	if _, ok := stretchers[name]; ok || builtin_modes[name] {
+		panic("stretch: RegisterStretcher called twice for " + name)
+	}
+	stretchers[name] = s
+}
+
+func LookupStretcher(name string) (Stretcher, bool) {
+	stretchers_mu.RLock()
+	defer stretchers_mu.RUnlock()
+	s, ok := stretchers[name]
+	return s, ok
+}
+
+// Stretchers returns the registered names, sorted.
+func Stretchers() []string {
+	stretchers_mu.RLock()
+	defer stretchers_mu.RUnlock()
+	names := make([]string, 0, len(stretchers))
+	for name := range stretchers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func init() {
+	RegisterStretcher("stddev", stddev_stretcher{})
+	RegisterStretcher("percentile", percentile_stretcher{})
+	RegisterStretcher("minmax", minmax_stretcher{})
+	RegisterStretcher("histeq", histeq_stretcher{})
+	RegisterStretcher("match", match_stretcher{})
+}
+
+func histogram_dists(histograms []Histogram) []Distribution {
+	dists := make([]Distribution, len(histograms))
+	for band_idx := range histograms {
+		dists[band_idx] = &histograms[band_idx]
+	}
+	return dists
+}
+
+// stddev_stretcher maps the band mean to DstAvg and one band standard
+// deviation to DstStddev levels.
+type stddev_stretcher struct{}
+
+func (stddev_stretcher) CheckOptions(opt *Options) error {
+	if opt.DstAvg < 0 || opt.DstStddev < 0 {
+		return fmt.Errorf("%w: negative -linear-stretch target", ErrBadArgs)
+	}
+	return nil
+}
+
+func (stddev_stretcher) Stretch(ctx *StretchContext, histograms []Histogram) ([]Transform, error) {
+	opt := ctx.Options
+	transforms := make([]Transform, len(histograms))
+	for band_idx := range histograms {
+		hg := &histograms[band_idx]
+		tr := &transforms[band_idx]
+		if hg.Stddev == 0 {
+			tr.Scale = 0
+		} else {
+			tr.Scale = opt.DstStddev / hg.Stddev
+		}
+		tr.Offset = hg.Mean - opt.DstAvg/tr.Scale
+	}
+	return transforms, nil
+}
+
+// percentile_stretcher maps the FromPercentile..ToPercentile cuts onto the
+// output range.
+type percentile_stretcher struct{}
+
+func (percentile_stretcher) CheckOptions(opt *Options) error {
+	n_from, n_to := len(opt.FromPercentile), len(opt.ToPercentile)
+	if n_from == 0 || n_to == 0 || (n_from != n_to && n_from != 1 && n_to != 1) {
+		return fmt.Errorf("%w: got %d lower and %d upper percentiles", ErrBadArgs, n_from, n_to)
+	}
+	for i := 0; i < n_from || i < n_to; i++ {
+		from, to := opt.percentile_range(i)
+		if !(0 <= from && from < to && to <= 1) {
+			return fmt.Errorf("%w: percentile range must satisfy 0 <= from < to <= 1", ErrBadArgs)
+		}
+	}
+	return nil
+}
+
+func (self percentile_stretcher) Stretch(ctx *StretchContext, histograms []Histogram) ([]Transform, error) {
+	return self.StretchDistributions(ctx, histogram_dists(histograms))
+}
+
+func (percentile_stretcher) StretchDistributions(ctx *StretchContext, dists []Distribution) ([]Transform, error) {
+	opt := ctx.Options
+	for _, pct := range [][]float64{opt.FromPercentile, opt.ToPercentile} {
+		if len(pct) > 1 && len(pct) != len(dists) {
+			return nil, fmt.Errorf("%w: got %d percentiles for %d bands", ErrBadArgs, len(pct), len(dists))
+		}
+	}
+	transforms := make([]Transform, len(dists))
+	for band_idx, dist := range dists {
+		tr := &transforms[band_idx]
+		from, to := opt.percentile_range(band_idx)
+		from_val, to_val, err := get_scale_from_percentile(dist, opt.OutputRange, from, to, &tr.Scale, &tr.Offset)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("band %d: percentiles %g..%g cut at %f..%f\n", band_idx+1, from, to, from_val, to_val)
+	}
+	return transforms, nil
+}
+
+// minmax_stretcher maps the band minimum and maximum onto the output range.
+type minmax_stretcher struct{}
+
+func (self minmax_stretcher) Stretch(ctx *StretchContext, histograms []Histogram) ([]Transform, error) {
+	return self.StretchDistributions(ctx, histogram_dists(histograms))
+}
+
+func (minmax_stretcher) StretchDistributions(ctx *StretchContext, dists []Distribution) ([]Transform, error) {
+	transforms := make([]Transform, len(dists))
+	for band_idx, dist := range dists {
+		tr := &transforms[band_idx]
+		min, max, err := get_scale_from_percentile(dist, ctx.Options.OutputRange, 0, 1, &tr.Scale, &tr.Offset)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("band %d: stretching %f..%f\n", band_idx+1, min, max)
+	}
+	return transforms, nil
+}
+
+func check_table_options(opt *Options) error {
+	if opt.Transfer != TransferLinear {
+		return fmt.Errorf("%w: transfer functions only apply to the linear modes", ErrBadArgs)
+	}
+	return nil
+}
+
+// histeq_stretcher maps every band onto the target distribution of
+// Options.Target.
+type histeq_stretcher struct{}
+
+func (histeq_stretcher) CheckOptions(opt *Options) error {
+	if err := check_table_options(opt); err != nil {
+		return err
+	}
+	if !opt.DstAvgSet {
+		opt.DstAvg = float64(opt.OutputRange-1) / 2
+	}
+	if opt.DstStddev < 0 || opt.DstAvg < 0 || opt.DstAvg > float64(opt.OutputRange-1) {
+		return fmt.Errorf("%w: -histeq target must have a non-negative stddev and a mean within 0..%d", ErrBadArgs, opt.OutputRange-1)
+	}
+	switch opt.Target {
+	case TargetRayleigh, TargetExponential:
+		if opt.DstAvg == 0 {
+			return fmt.Errorf("%w: -histeq target needs a positive mean", ErrBadArgs)
+		}
+	case TargetLogNormal:
+		if opt.DstAvg == 0 || opt.DstStddev == 0 {
+			return fmt.Errorf("%w: log-normal -histeq target needs a positive mean and stddev", ErrBadArgs)
+		}
+	case TargetFile:
+		if len(opt.TargetFn) == 0 {
+			return fmt.Errorf("%w: missing -histeq target file", ErrBadArgs)
+		}
+	}
+	// fail on a bad target file before reading the raster
+	_, err := gen_target(opt, opt.OutputRange)
+	return err
+}
+
+func (histeq_stretcher) Stretch(ctx *StretchContext, histograms []Histogram) ([]Transform, error) {
+	target, err := gen_target(ctx.Options, ctx.Options.OutputRange)
+	if err != nil {
+		return nil, err
+	}
+	transforms := make([]Transform, len(histograms))
+	for band_idx := range histograms {
+		transforms[band_idx].Table = invert_histogram(&histograms[band_idx], target, ctx.Options.OutputRange)
+	}
+	return transforms, nil
+}
+
+// match_stretcher maps every band onto the distribution of the same band
+// of Options.RefFn.
+type match_stretcher struct{}
+
+func (match_stretcher) CheckOptions(opt *Options) error {
+	if err := check_table_options(opt); err != nil {
+		return err
+	}
+	if len(opt.RefFn) == 0 {
+		return fmt.Errorf("%w: missing -match reference", ErrBadArgs)
+	}
+	return nil
+}
+
+func (match_stretcher) Stretch(ctx *StretchContext, histograms []Histogram) ([]Transform, error) {
+	ctx.Options.progress("Computing reference histogram")
+	targets, err := reference_targets(ctx.Options, ctx.NdvDef, ctx.Bands)
+	if err != nil {
+		return nil, err
+	}
+	transforms := make([]Transform, len(histograms))
+	for band_idx := range histograms {
+		transforms[band_idx].Table = invert_histogram(&histograms[band_idx], targets[band_idx], ctx.Options.OutputRange)
+	}
+	return transforms, nil
+}
@@ -0,0 +1,230 @@
+package stretch
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// TargetShape selects the distribution -histeq maps the pixels onto.  The
+// shapes are described by DstAvg and DstStddev in output levels; the one
+// parameter shapes only use DstAvg.
+type TargetShape int
+
+const (
+	// TargetGaussian is a normal distribution, flat if DstStddev is 0.
+	TargetGaussian TargetShape = iota
+	// TargetUniform is classic histogram equalization.
+	TargetUniform
+	// TargetRayleigh has its mean at DstAvg.
+	TargetRayleigh
+	// TargetExponential decays from level 0 with its mean at DstAvg.
+	TargetExponential
+	// TargetLogNormal has mean DstAvg and standard deviation DstStddev.
+	TargetLogNormal
+	// TargetFile reads the distribution from Options.TargetFn.
+	TargetFile
+)
+
+var target_shape_names = map[string]TargetShape{
+	"gaussian":    TargetGaussian,
+	"uniform":     TargetUniform,
+	"rayleigh":    TargetRayleigh,
+	"exponential": TargetExponential,
+	"lognormal":   TargetLogNormal,
+}
+
+// ParseTargetShape maps a -histeq-target name to its shape.
+func ParseTargetShape(name string) (TargetShape, error) {
+	shape, ok := target_shape_names[strings.ToLower(name)]
+	if !ok {
+		return 0, fmt.Errorf("%w: unknown target distribution %s", ErrBadTarget, name)
+	}
+	return shape, nil
+}
+
+func gen_uniform(bin_count int) []float64 {
+	return gen_gaussian(0, 0, bin_count)
+}
+
+// gen_pdf samples pdf at every level and normalises the result.
+func gen_pdf(bin_count int, pdf func(x float64) float64) ([]float64, error) {
+	arr := make([]float64, bin_count)
+	var total float64 = 0
+	for i := 0; i < bin_count; i++ {
+		arr[i] = pdf(float64(i))
+		if arr[i] < 0 || math.IsNaN(arr[i]) || math.IsInf(arr[i], 0) {
+			return nil, fmt.Errorf("%w: density %g at level %d", ErrBadTarget, arr[i], i)
+		}
+		total += arr[i]
+	}
+	if total == 0 {
+		return nil, fmt.Errorf("%w: no weight within the output range", ErrBadTarget)
+	}
+	for i := 0; i < bin_count; i++ {
+		arr[i] /= total
+	}
+	return arr, nil
+}
+
+func gen_rayleigh(mean float64, bin_count int) ([]float64, error) {
+	sigma := mean / math.Sqrt(math.Pi/2)
+	return gen_pdf(bin_count, func(x float64) float64 {
+		return x / (sigma * sigma) * math.Exp(-x*x/(2*sigma*sigma))
+	})
+}
+
+func gen_exponential(mean float64, bin_count int) ([]float64, error) {
+	return gen_pdf(bin_count, func(x float64) float64 {
+		return math.Exp(-x / mean)
+	})
+}
+
+func gen_lognormal(mean, stddev float64, bin_count int) ([]float64, error) {
+	sigma2 := math.Log(1 + stddev*stddev/(mean*mean))
+	mu := math.Log(mean) - sigma2/2
+	return gen_pdf(bin_count, func(x float64) float64 {
+		if x == 0 {
+			return 0
+		}
+		d := math.Log(x) - mu
+		return math.Exp(-d*d/(2*sigma2)) / x
+	})
+}
+
+// target_pdf is a PDF read from a file: either weights spread evenly over
+// the output range or [level, weight] points.
+type target_pdf struct {
+	weights []float64
+	points  [][2]float64
+}
+
+// load_target_pdf reads a PDF from a CSV or JSON file.  A CSV file holds a
+// weight per row, or level,weight rows; a header row is skipped.  A JSON
+// file holds an array of weights or of [level, weight] pairs.
+func load_target_pdf(fn string) (*target_pdf, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	pdf := &target_pdf{}
+	if strings.EqualFold(filepath.Ext(fn), ".json") {
+		var raw []json.RawMessage
+		if err := json.NewDecoder(f).Decode(&raw); err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", ErrBadTarget, fn, err)
+		}
+		for _, item := range raw {
+			var w float64
+			var p []float64
+			if json.Unmarshal(item, &w) == nil {
+				pdf.weights = append(pdf.weights, w)
+			} else if json.Unmarshal(item, &p) == nil && len(p) == 2 {
+				pdf.points = append(pdf.points, [2]float64{p[0], p[1]})
+			} else {
+				return nil, fmt.Errorf("%w: %s: expected a weight or a [level, weight] pair, got %s", ErrBadTarget, fn, item)
+			}
+		}
+	} else {
+		rd := csv.NewReader(f)
+		rd.FieldsPerRecord = -1
+		rd.TrimLeadingSpace = true
+		for row := 0; ; row++ {
+			record, err := rd.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("%w: %s: %v", ErrBadTarget, fn, err)
+			}
+			vals := make([]float64, len(record))
+			for i, field := range record {
+				vals[i], err = strconv.ParseFloat(strings.TrimSpace(field), 64)
+				if err != nil {
+					break
+				}
+			}
+			if err != nil {
+				if row == 0 {
+					continue
+				}
+				return nil, fmt.Errorf("%w: %s line %d: %v", ErrBadTarget, fn, row+1, err)
+			}
+			switch len(vals) {
+			case 1:
+				pdf.weights = append(pdf.weights, vals[0])
+			case 2:
+				pdf.points = append(pdf.points, [2]float64{vals[0], vals[1]})
+			default:
+				return nil, fmt.Errorf("%w: %s line %d: expected 1 or 2 columns", ErrBadTarget, fn, row+1)
+			}
+		}
+	}
+
+	if len(pdf.weights) > 0 && len(pdf.points) > 0 {
+		return nil, fmt.Errorf("%w: %s mixes weights with level,weight pairs", ErrBadTarget, fn)
+	}
+	if len(pdf.weights) == 1 || len(pdf.points) == 1 {
+		return nil, fmt.Errorf("%w: %s needs at least two points", ErrBadTarget, fn)
+	}
+	if len(pdf.weights) == 0 && len(pdf.points) == 0 {
+		return nil, fmt.Errorf("%w: %s is empty", ErrBadTarget, fn)
+	}
+	return pdf, nil
+}
+
+// interpolate_pdf samples the piecewise linear PDF at every level.  Levels
+// outside the points get no weight.
+func interpolate_pdf(pdf *target_pdf, bin_count int) ([]float64, error) {
+	pts := make([][2]float64, len(pdf.points))
+	copy(pts, pdf.points)
+	for i, w := range pdf.weights {
+		pts = append(pts, [2]float64{float64(i*(bin_count-1)) / float64(len(pdf.weights)-1), w})
+	}
+	sort.Slice(pts, func(i, j int) bool { return pts[i][0] < pts[j][0] })
+	return gen_pdf(bin_count, func(x float64) float64 {
+		k := sort.Search(len(pts), func(i int) bool { return pts[i][0] >= x })
+		switch {
+		case k == len(pts):
+			return 0
+		case pts[k][0] == x:
+			return pts[k][1]
+		case k == 0:
+			return 0
+		}
+		a, b := pts[k-1], pts[k]
+		return a[1] + (b[1]-a[1])*(x-a[0])/(b[0]-a[0])
+	})
+}
+
+// gen_target builds the normalised target histogram of -histeq over
+// output_range levels.
+func gen_target(opt *Options, output_range int) ([]float64, error) {
+	switch opt.Target {
+	case TargetGaussian:
+		return gen_gaussian(opt.DstAvg, opt.DstStddev, output_range), nil
+	case TargetUniform:
+		return gen_uniform(output_range), nil
+	case TargetRayleigh:
+		return gen_rayleigh(opt.DstAvg, output_range)
+	case TargetExponential:
+		return gen_exponential(opt.DstAvg, output_range)
+	case TargetLogNormal:
+		return gen_lognormal(opt.DstAvg, opt.DstStddev, output_range)
+	case TargetFile:
+		pdf, err := load_target_pdf(opt.TargetFn)
+		if err != nil {
+			return nil, err
+		}
+		return interpolate_pdf(pdf, output_range)
+	}
+	return nil, fmt.Errorf("%w: unknown target distribution %d", ErrBadTarget, opt.Target)
+}
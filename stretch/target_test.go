@@ -0,0 +1,139 @@
+package stretch
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/lukeroth/gdal"
+)
+
+// write_target writes a target distribution file into dir.
+func write_target(t *testing.T, dir, name, data string) string {
+	t.Helper()
+	fn := filepath.Join(dir, name)
+	if err := os.WriteFile(fn, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return fn
+}
+
+// pdf_moments returns the mean and stddev of the levels weighted by pdf.
+func pdf_moments(pdf []float64) (mean, stddev float64) {
+	for level, p := range pdf {
+		mean += float64(level) * p
+	}
+	for level, p := range pdf {
+		stddev += (float64(level) - mean) * (float64(level) - mean) * p
+	}
+	return mean, math.Sqrt(stddev)
+}
+
+func TestParseTargetShape(t *testing.T) {
+	for name, want := range map[string]TargetShape{"gaussian": TargetGaussian, "Uniform": TargetUniform, "LOGNORMAL": TargetLogNormal} {
+		if got, err := ParseTargetShape(name); err != nil || got != want {
+			t.Errorf("%s: got %d, %v, want %d", name, got, err, want)
+		}
+	}
+	if _, err := ParseTargetShape("file"); !errors.Is(err, ErrBadTarget) {
+		t.Errorf("file: got %v, want %v", err, ErrBadTarget)
+	}
+}
+
+func TestGenTarget(t *testing.T) {
+	dir := t.TempDir()
+	cases := []struct {
+		name         string
+		opt          Options
+		mean, stddev float64
+	}{
+		{"gaussian", Options{DstAvg: 100, DstStddev: 20}, 100, 20},
+		{"uniform", Options{Target: TargetUniform}, 127.5, math.Sqrt((256*256 - 1) / 12.0)},
+		{"rayleigh", Options{Target: TargetRayleigh, DstAvg: 60}, 60, 60 * math.Sqrt(4/math.Pi-1)},
+		// cut off at the last level
+		{"exponential", Options{Target: TargetExponential, DstAvg: 40}, 39.08, 38.61},
+		{"lognormal", Options{Target: TargetLogNormal, DstAvg: 100, DstStddev: 30}, 100, 30},
+		// weights spread over the output range, the header skipped
+		{"triangle", Options{Target: TargetFile, TargetFn: write_target(t, dir, "tri.csv", "weight\n0\n1\n0\n")}, 127.5, 255 / math.Sqrt(24)},
+		{"pairs", Options{Target: TargetFile, TargetFn: write_target(t, dir, "flat.json", "[[50,1],[150,1]]")}, 100, math.Sqrt((101*101 - 1) / 12.0)},
+		{"level,weight", Options{Target: TargetFile, TargetFn: write_target(t, dir, "flat.csv", "50,1\n150,1\n")}, 100, math.Sqrt((101*101 - 1) / 12.0)},
+	}
+	for _, tc := range cases {
+		pdf, err := gen_target(&tc.opt, 256)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		var total float64
+		for _, p := range pdf {
+			total += p
+		}
+		mean, stddev := pdf_moments(pdf)
+		if math.Abs(total-1) > 1e-9 || math.Abs(mean-tc.mean) > 0.5 || math.Abs(stddev-tc.stddev) > 0.5 {
+			t.Errorf("%s: got %g+/-%g summing to %g, want %g+/-%g", tc.name, mean, stddev, total, tc.mean, tc.stddev)
+		}
+	}
+}
+
+func TestLoadTargetPdf(t *testing.T) {
+	dir := t.TempDir()
+	cases := []struct{ name, data string }{
+		{"one.json", "[1]"},
+		{"empty.csv", ""},
+		{"mixed.csv", "1\n2,3\n"},
+		{"columns.csv", "1,2,3\n4,5,6\n"},
+		{"text.csv", "1\nx\n"},
+		{"object.json", `{"weights": [1, 2]}`},
+		{"triple.json", "[[1, 2, 3], [4, 5, 6]]"},
+		{"zero.json", "[0, 0, 0]"},
+		{"negative.json", "[1, -1, 1]"},
+		{"outside.json", "[[300, 1], [400, 1]]"},
+	}
+	for _, tc := range cases {
+		opt := Options{Target: TargetFile, TargetFn: write_target(t, dir, tc.name, tc.data)}
+		if _, err := gen_target(&opt, 256); !errors.Is(err, ErrBadTarget) {
+			t.Errorf("%s: got %v, want %v", tc.name, err, ErrBadTarget)
+		}
+	}
+}
+
+func TestHisteqTargets(t *testing.T) {
+	r := rand.New(rand.NewSource(5))
+	src_fn := test_raster(t, "heq", 400, 300, 1, gdal.Float32, func(b, x, y int) float64 { return r.Float64()*r.Float64() - 3 })
+	dir := t.TempDir()
+	cases := []struct {
+		name         string
+		opt          Options
+		mean, stddev float64
+	}{
+		{"rayleigh", Options{Target: TargetRayleigh, DstAvg: 60, DstAvgSet: true}, 60, 60 * math.Sqrt(4/math.Pi-1)},
+		{"lognormal", Options{Target: TargetLogNormal, DstAvg: 100, DstAvgSet: true, DstStddev: 30}, 100, 30},
+		{"triangle", Options{Target: TargetFile, TargetFn: write_target(t, dir, "tri.csv", "0\n1\n0\n")}, 127.5, 255 / math.Sqrt(24)},
+	}
+	for _, tc := range cases {
+		opt := tc.opt
+		opt.SrcFn, opt.DstFn, opt.Mode = src_fn, filepath.Join(dir, "out.tif"), "histeq"
+		if err := Run(&opt); err != nil {
+			t.Fatal(err)
+		}
+		mean, stddev := moments(read_test_raster(t, opt.DstFn)[0], -1)
+		if math.Abs(mean-tc.mean) > 1 || math.Abs(stddev-tc.stddev) > 1 {
+			t.Errorf("%s: got %g+/-%g, want %g+/-%g", tc.name, mean, stddev, tc.mean, tc.stddev)
+		}
+	}
+
+	bad := []Options{
+		{Target: TargetLogNormal, DstAvg: 100, DstAvgSet: true},
+		{Target: TargetExponential, DstAvg: 0, DstAvgSet: true},
+		{Target: TargetFile},
+	}
+	for _, opt := range bad {
+		opt.SrcFn, opt.DstFn, opt.Mode = src_fn, filepath.Join(dir, "out.tif"), "histeq"
+		if err := Run(&opt); !errors.Is(err, ErrBadArgs) {
+			t.Errorf("target %d: got %v, want %v", opt.Target, err, ErrBadArgs)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package stretch
+
+import (
+	"encoding/json"
+	"math"
+	"sort"
+
+	"github.com/lukeroth/gdal"
+)
+
+// Distribution summarises the valid pixel values of a band.  Both
+// Histogram and TDigest implement it.
+type Distribution interface {
+	// Count is the number of values summarised.
+	Count() uint
+	// Quantile returns the value below which a fraction q of the values
+	// fall, 0 <= q <= 1.
+	Quantile(q float64) (float64, error)
+}
+
+// StatsEngine selects how the band statistics are accumulated.
+type StatsEngine int
+
+const (
+	// StatsHistogram counts the pixels in a Histogram.
+	StatsHistogram StatsEngine = iota
+	// StatsTDigest summarises the pixels in a TDigest, which needs no
+	// value range and only supports -percentile-range and -minmax.
+	StatsTDigest
+)
+
+// DefaultCompression keeps a TDigest to about a thousand centroids, which
+// puts the rank error at the 0.1% and 99.9% quantiles near 1e-5.
+const DefaultCompression = 500
+
+type centroid struct {
+	Mean   float64 `json:"mean"`
+	Weight float64 `json:"weight"`
+}
+
+// TDigest is a merging t-digest (Dunning & Ertl, "Computing extremely
+// accurate quantiles using t-digests").  Unlike Histogram it needs no value
+// range up front and keeps a bounded number of centroids.  The arcsine
+// scale function keeps the centroids near q=0 and q=1 small, so tail
+// quantiles such as 0.001 and 0.999 are the most accurate ones.
+type TDigest struct {
+	compression float64
+	centroids   []centroid
+	buffer      []centroid
+	count       float64
+	min, max    float64
+}
+
+func NewTDigest(compression float64) *TDigest {
+	if compression <= 0 {
+		compression = DefaultCompression
+	}
+	return &TDigest{compression: compression, min: math.Inf(1), max: math.Inf(-1)}
+}
+
+func (self *TDigest) Add(v float64) {
+	self.add(centroid{v, 1})
+	if v < self.min {
+		self.min = v
+	}
+	if v > self.max {
+		self.max = v
+	}
+}
+
+func (self *TDigest) add(c centroid) {
+	self.buffer = append(self.buffer, c)
+	self.count += c.Weight
+	if len(self.buffer) >= int(5*self.compression) {
+		self.compress()
+	}
+}
+
+// Merge adds the values summarised by other.
+func (self *TDigest) Merge(other *TDigest) {
+	for _, c := range other.centroids {
+		self.add(c)
+	}
+	for _, c := range other.buffer {
+		self.add(c)
+	}
+	self.min = math.Min(self.min, other.min)
+	self.max = math.Max(self.max, other.max)
+}
+
+func (self *TDigest) k(q float64) float64 {
+	return self.compression / (2 * math.Pi) * math.Asin(2*q-1)
+}
+
+func (self *TDigest) k_inv(k float64) float64 {
+	if k >= self.compression/4 {
+		return 1
+	}
+	return (math.Sin(k*2*math.Pi/self.compression) + 1) / 2
+}
+
+// compress merges the buffered values into the centroids, keeping every
+// centroid within one unit of the scale function.
+func (self *TDigest) compress() {
+	if len(self.buffer) == 0 {
+		return
+	}
+	all := append(self.centroids, self.buffer...)
+	sort.Slice(all, func(i, j int) bool { return all[i].Mean < all[j].Mean })
+
+	merged := make([]centroid, 0, int(2*self.compression))
+	cur := all[0]
+	var w_before float64
+	q_limit := self.k_inv(self.k(0) + 1)
+	for _, c := range all[1:] {
+		if (w_before+cur.Weight+c.Weight)/self.count <= q_limit {
+			cur.Mean += (c.Mean - cur.Mean) * c.Weight / (cur.Weight + c.Weight)
+			cur.Weight += c.Weight
+			continue
+		}
+		merged = append(merged, cur)
+		w_before += cur.Weight
+		q_limit = self.k_inv(self.k(w_before/self.count) + 1)
+		cur = c
+	}
+	merged = append(merged, cur)
+	self.centroids = merged
+	self.buffer = nil
+}
+
+func (self *TDigest) Count() uint {
+	return uint(self.count)
+}
+
+func (self *TDigest) Min() float64 {
+	return self.min
+}
+
+func (self *TDigest) Max() float64 {
+	return self.max
+}
+
+// Quantile interpolates between centroid means, and between the outer
+// centroids and the exact min and max.
+func (self *TDigest) Quantile(q float64) (float64, error) {
+	self.compress()
+	n := len(self.centroids)
+	if n == 0 {
+		return 0, ErrNoWindow
+	}
+	if q <= 0 {
+		return self.min, nil
+	}
+	if q >= 1 {
+		return self.max, nil
+	}
+	cs := self.centroids
+	if n == 1 {
+		return cs[0].Mean, nil
+	}
+	t := q * self.count
+
+	if t < cs[0].Weight/2 {
+		return self.min + (cs[0].Mean-self.min)*t/(cs[0].Weight/2), nil
+	}
+	cum := cs[0].Weight / 2
+	for i := 0; i < n-1; i++ {
+		dw := (cs[i].Weight + cs[i+1].Weight) / 2
+		if cum+dw > t {
+			z := (t - cum) / dw
+			return cs[i].Mean + z*(cs[i+1].Mean-cs[i].Mean), nil
+		}
+		cum += dw
+	}
+	last := cs[n-1]
+	z := (t - cum) / (last.Weight / 2)
+	return last.Mean + z*(self.max-last.Mean), nil
+}
+
+type tdigest_json struct {
+	Compression float64    `json:"compression"`
+	Count       float64    `json:"count"`
+	Min         float64    `json:"min"`
+	Max         float64    `json:"max"`
+	Centroids   []centroid `json:"centroids"`
+}
+
+func (self *TDigest) MarshalJSON() ([]byte, error) {
+	self.compress()
+	tj := tdigest_json{self.compression, self.count, self.min, self.max, self.centroids}
+	if self.count == 0 {
+		// JSON has no infinities
+		tj.Min, tj.Max = 0, 0
+	}
+	return json.Marshal(tj)
+}
+
+func (self *TDigest) UnmarshalJSON(data []byte) error {
+	var tj tdigest_json
+	if err := json.Unmarshal(data, &tj); err != nil {
+		return err
+	}
+	*self = TDigest{compression: tj.Compression, centroids: tj.Centroids, count: tj.Count, min: tj.Min, max: tj.Max}
+	if self.compression <= 0 {
+		self.compression = DefaultCompression
+	}
+	if self.count == 0 {
+		self.min, self.max = math.Inf(1), math.Inf(-1)
+	}
+	return nil
+}
+
+// ComputeTDigest builds one TDigest per band from the valid pixels, as
+// ComputeHistogram does for histograms.
+func ComputeTDigest(src_bands []gdal.RasterBand, ndv_def *NdvDef, w, h int, compression float64, scan *ScanOptions) ([]*TDigest, error) {
+	band_count := len(src_bands)
+	digests := make([]*TDigest, band_count)
+	for band_idx := range digests {
+		digests[band_idx] = NewTDigest(compression)
+	}
+
+	// the centroids depend on the order the values come in, so every
+	// block gets its own digests and these are merged in block order
+	digest_block := func(blk block, rd *block_reader) (interface{}, error) {
+		part := make([]*TDigest, band_count)
+		for band_idx := range part {
+			td := NewTDigest(compression)
+			p := rd.buf_in[band_idx]
+			for i := 0; i < rd.n; i++ {
+				if rd.ndv_mask[i] == 0 {
+					td.Add(p[i])
+				}
+			}
+			part[band_idx] = td
+		}
+		return part, nil
+	}
+	merge := func(result interface{}) {
+		for band_idx, td := range result.([]*TDigest) {
+			digests[band_idx].Merge(td)
+		}
+	}
+	err := scan_blocks(src_bands, ndv_def, w, h, scan, in_block_order(digest_block, merge))
+	if err != nil {
+		return nil, err
+	}
+	return digests, nil
+}
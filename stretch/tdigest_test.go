@@ -0,0 +1,142 @@
+package stretch
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"math/rand"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/lukeroth/gdal"
+)
+
+func TestTDigestQuantile(t *testing.T) {
+	dists := []struct {
+		name string
+		gen  func(r *rand.Rand) float64
+	}{
+		{"exponential", func(r *rand.Rand) float64 { return r.ExpFloat64() * 100 }},
+		{"normal", func(r *rand.Rand) float64 { return r.NormFloat64()*10 + 3 }},
+		{"uniform", func(r *rand.Rand) float64 { return r.Float64() }},
+	}
+	const n = 200000
+	for _, dist := range dists {
+		r := rand.New(rand.NewSource(3))
+		vals := make([]float64, n)
+		for i := range vals {
+			vals[i] = dist.gen(r)
+		}
+		sorted := append([]float64(nil), vals...)
+		sort.Float64s(sorted)
+		for _, compression := range []float64{200, DefaultCompression, 1000} {
+			// merged from parts and through JSON, as the workers and the
+			// histogram cache do
+			parts := []*TDigest{NewTDigest(compression), NewTDigest(compression), NewTDigest(compression)}
+			for i, v := range vals {
+				parts[i%3].Add(v)
+			}
+			parts[0].Merge(parts[1])
+			parts[0].Merge(parts[2])
+			data, err := json.Marshal(parts[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			var td TDigest
+			if err := json.Unmarshal(data, &td); err != nil {
+				t.Fatal(err)
+			}
+			if td.Count() != n || td.Min() != sorted[0] || td.Max() != sorted[n-1] {
+				t.Errorf("%s, compression %g: %d values within %g..%g", dist.name, compression, td.Count(), td.Min(), td.Max())
+			}
+			for _, q := range []float64{0, 0.0001, 0.001, 0.01, 0.5, 0.99, 0.999, 0.9999, 1} {
+				got, err := td.Quantile(q)
+				if err != nil {
+					t.Fatal(err)
+				}
+				// the ranks of got, which is q if it is a value of vals
+				below := float64(sort.SearchFloat64s(sorted, got)) / n
+				upto := float64(sort.Search(n, func(i int) bool { return sorted[i] > got })) / n
+				rank_err := math.Max(0, math.Max(below-q, q-upto))
+				// half a centroid, which shrink towards the tails
+				max_err := math.Pi*math.Sqrt(q*(1-q))/compression + 1/float64(n)
+				if rank_err > max_err {
+					t.Errorf("%s, compression %g: quantile %g is %g off in rank, want within %g", dist.name, compression, q, rank_err, max_err)
+				}
+			}
+		}
+	}
+}
+
+func TestTDigestEmpty(t *testing.T) {
+	data, err := json.Marshal(NewTDigest(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var td TDigest
+	if err := json.Unmarshal(data, &td); err != nil {
+		t.Fatal(err)
+	}
+	if td.Count() != 0 || !math.IsInf(td.Min(), 1) || !math.IsInf(td.Max(), -1) {
+		t.Errorf("got %d values within %g..%g", td.Count(), td.Min(), td.Max())
+	}
+	if _, err := td.Quantile(0.5); err != ErrNoWindow {
+		t.Errorf("quantile: got %v, want %v", err, ErrNoWindow)
+	}
+}
+
+func TestTDigestWorkers(t *testing.T) {
+	r := rand.New(rand.NewSource(6))
+	w, h := 300, 200
+	src_fn := test_raster(t, "tdw", w, h, 2, gdal.Float32, func(b, x, y int) float64 { return r.ExpFloat64() * float64(b+1) })
+	ds, err := gdal.Open(src_fn, gdal.ReadOnly)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+	src_bands := []gdal.RasterBand{ds.RasterBand(1), ds.RasterBand(2)}
+	var results [][]byte
+	for _, workers := range []int{1, 4} {
+		digests, err := ComputeTDigest(src_bands, &NdvDef{}, w, h, 100, &ScanOptions{Workers: workers})
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := json.Marshal(digests)
+		if err != nil {
+			t.Fatal(err)
+		}
+		results = append(results, data)
+	}
+	if string(results[0]) != string(results[1]) {
+		t.Error("the digests differ between 1 and 4 workers")
+	}
+}
+
+func TestTDigestRun(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	src_fn := test_raster(t, "td", 200, 130, 2, gdal.Float32, func(b, x, y int) float64 { return r.NormFloat64()*10 + 3 })
+	dir := t.TempDir()
+	var outs [][][]float64
+	for _, stats := range []StatsEngine{StatsHistogram, StatsTDigest} {
+		opt := Options{SrcFn: src_fn, DstFn: filepath.Join(dir, "out.tif"), Stats: stats,
+			Mode: "percentile", FromPercentile: []float64{0.02}, ToPercentile: []float64{0.98}}
+		opt.Workers = 3
+		if err := Run(&opt); err != nil {
+			t.Fatal(err)
+		}
+		outs = append(outs, read_test_raster(t, opt.DstFn))
+	}
+	for b := range outs[0] {
+		for i := range outs[0][b] {
+			if math.Abs(outs[0][b][i]-outs[1][b][i]) > 1 {
+				t.Fatalf("band %d pixel %d: %g from the histogram, %g from the t-digest", b+1, i, outs[0][b][i], outs[1][b][i])
+			}
+		}
+	}
+
+	opt := Options{SrcFn: src_fn, DstFn: filepath.Join(dir, "out.tif"), Stats: StatsTDigest, Mode: "histeq", DstStddev: 40}
+	if err := Run(&opt); !errors.Is(err, ErrBadArgs) {
+		t.Errorf("-histeq from a t-digest: got %v, want %v", err, ErrBadArgs)
+	}
+}
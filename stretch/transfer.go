@@ -0,0 +1,89 @@
+package stretch
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/lukeroth/gdal"
+)
+
+// TransferFunc is a curve applied after the linear modes.  It maps the
+// linearly stretched values, normalised to [0,1], onto [0,1].
+type TransferFunc int
+
+const (
+	// TransferLinear leaves the linear stretch as it is.
+	TransferLinear TransferFunc = iota
+	// TransferGamma is x^(1/Gamma), brightening the dark end for Gamma > 1.
+	TransferGamma
+	// TransferLog is log(1+Gain*x)/log(1+Gain).
+	TransferLog
+	// TransferSqrt is sqrt(x).
+	TransferSqrt
+	// TransferSigmoid is a logistic curve of slope Gain centred on
+	// Midpoint, rescaled to pass through (0,0) and (1,1).
+	TransferSigmoid
+)
+
+const (
+	default_gain     = 10
+	default_midpoint = 0.5
+)
+
+var transfer_names = map[string]TransferFunc{
+	"linear":  TransferLinear,
+	"gamma":   TransferGamma,
+	"log":     TransferLog,
+	"sqrt":    TransferSqrt,
+	"sigmoid": TransferSigmoid,
+}
+
+// ParseTransferFunc maps a -transfer name to its curve.
+func ParseTransferFunc(name string) (TransferFunc, error) {
+	fn, ok := transfer_names[strings.ToLower(name)]
+	if !ok {
+		return 0, fmt.Errorf("%w: unknown transfer function %s", ErrBadArgs, name)
+	}
+	return fn, nil
+}
+
+// transfer_curve returns the curve selected by opt, or nil for
+// TransferLinear.
+func transfer_curve(opt *Options) func(x float64) float64 {
+	switch opt.Transfer {
+	case TransferGamma:
+		inv_gamma := 1 / opt.Gamma
+		return func(x float64) float64 {
+			return math.Pow(x, inv_gamma)
+		}
+	case TransferLog:
+		gain := opt.Gain
+		norm := math.Log1p(gain)
+		return func(x float64) float64 {
+			return math.Log1p(gain*x) / norm
+		}
+	case TransferSqrt:
+		return math.Sqrt
+	case TransferSigmoid:
+		gain, mid := opt.Gain, opt.Midpoint
+		s := func(x float64) float64 {
+			return 1 / (1 + math.Exp(-gain*(x-mid)))
+		}
+		s0, s1 := s(0), s(1)
+		return func(x float64) float64 {
+			return (s(x) - s0) / (s1 - s0)
+		}
+	}
+	return nil
+}
+
+// exact_binning reports whether every value of an integer band of type dt
+// has a bin of its own, so a transform can be tabulated per bin.
+func exact_binning(dt gdal.DataType, binning Binning) bool {
+	switch dt {
+	case gdal.Byte, gdal.UInt16, gdal.Int16:
+		return binning.LogBits == 0 && binning.Scale == 1 && binning.Offset == math.Trunc(binning.Offset)
+	}
+	return false
+}
@@ -0,0 +1,124 @@
+package stretch
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"path/filepath"
+	"testing"
+
+	"github.com/lukeroth/gdal"
+)
+
+func TestTransferCurve(t *testing.T) {
+	cases := []struct {
+		name string
+		opt  Options
+		// the curve at 0.25, 0.5 and 0.75
+		want [3]float64
+	}{
+		{"gamma", Options{Transfer: TransferGamma, Gamma: 2}, [3]float64{0.5, math.Sqrt(0.5), math.Sqrt(0.75)}},
+		{"log", Options{Transfer: TransferLog, Gain: 10}, [3]float64{math.Log(3.5) / math.Log(11), math.Log(6) / math.Log(11), math.Log(8.5) / math.Log(11)}},
+		{"sqrt", Options{Transfer: TransferSqrt}, [3]float64{0.5, math.Sqrt(0.5), math.Sqrt(0.75)}},
+		// symmetric about the midpoint
+		{"sigmoid", Options{Transfer: TransferSigmoid, Gain: 8, Midpoint: 0.5}, [3]float64{0.1050, 0.5, 0.8950}},
+	}
+	for _, tc := range cases {
+		curve := transfer_curve(&tc.opt)
+		if curve(0) != 0 || math.Abs(curve(1)-1) > 1e-12 {
+			t.Errorf("%s: runs from %g to %g", tc.name, curve(0), curve(1))
+		}
+		for i, x := range []float64{0.25, 0.5, 0.75} {
+			if math.Abs(curve(x)-tc.want[i]) > 1e-4 {
+				t.Errorf("%s at %g: got %g, want %g", tc.name, x, curve(x), tc.want[i])
+			}
+		}
+	}
+	if transfer_curve(&Options{}) != nil {
+		t.Error("linear transfer has a curve")
+	}
+	if _, err := ParseTransferFunc("cubic"); !errors.Is(err, ErrBadArgs) {
+		t.Errorf("cubic: got %v, want %v", err, ErrBadArgs)
+	}
+}
+
+func TestTransferMidpoint(t *testing.T) {
+	cases := []struct {
+		mid  float64
+		set  bool
+		want float64
+	}{
+		{0, false, 0.5},
+		{0, true, 0},
+		{0.3, true, 0.3},
+	}
+	for _, tc := range cases {
+		opt := &Options{SrcFn: "in.tif", DstFn: "out.tif", Mode: "minmax", Transfer: TransferSigmoid, Midpoint: tc.mid, MidpointSet: tc.set}
+		if err := opt.handle(); err != nil {
+			t.Fatal(err)
+		}
+		if opt.Midpoint != tc.want {
+			t.Errorf("-midpoint %g (set %v): got %g, want %g", tc.mid, tc.set, opt.Midpoint, tc.want)
+		}
+	}
+}
+
+func TestTransfer(t *testing.T) {
+	r := rand.New(rand.NewSource(6))
+	w, h := 150, 90
+	vals := make([]float64, w*h)
+	for i := range vals {
+		vals[i] = float64(10 + r.Intn(200))
+	}
+	// tabulated per value for the Byte source, computed per pixel for the
+	// Float32 one
+	sources := []string{
+		test_raster(t, "tr8", w, h, 1, gdal.Byte, func(b, x, y int) float64 { return vals[y*w+x] }),
+		test_raster(t, "trf", w, h, 1, gdal.Float32, func(b, x, y int) float64 { return vals[y*w+x] }),
+	}
+	dir := t.TempDir()
+	cases := []struct {
+		name string
+		opt  Options
+		// of the mean output level
+		lo, hi float64
+	}{
+		{"linear", Options{}, 120, 135},
+		{"gamma", Options{Transfer: TransferGamma, Gamma: 2.2}, 165, 185},
+		{"log", Options{Transfer: TransferLog}, 160, 185},
+		{"sqrt", Options{Transfer: TransferSqrt}, 160, 180},
+		{"sigmoid", Options{Transfer: TransferSigmoid, Gain: 8}, 120, 135},
+	}
+	for _, tc := range cases {
+		var outs [][]float64
+		for _, src_fn := range sources {
+			opt := tc.opt
+			opt.SrcFn, opt.DstFn, opt.Mode = src_fn, filepath.Join(dir, "out.tif"), "minmax"
+			if err := Run(&opt); err != nil {
+				t.Fatal(err)
+			}
+			outs = append(outs, read_test_raster(t, opt.DstFn)[0])
+		}
+		for i := range outs[0] {
+			if outs[0][i] != outs[1][i] {
+				t.Errorf("%s: pixel %d is %g from Byte, %g from Float32", tc.name, i, outs[0][i], outs[1][i])
+				break
+			}
+		}
+		if mean, _ := moments(outs[0], -1); mean < tc.lo || mean > tc.hi {
+			t.Errorf("%s: mean level %g, want %g..%g", tc.name, mean, tc.lo, tc.hi)
+		}
+	}
+
+	bad := []Options{
+		{Mode: "minmax", Transfer: TransferGamma},
+		{Mode: "minmax", Transfer: TransferSigmoid, Midpoint: 2, MidpointSet: true},
+		{Mode: "histeq", Transfer: TransferSqrt},
+	}
+	for _, opt := range bad {
+		opt.SrcFn, opt.DstFn = sources[0], filepath.Join(dir, "out.tif")
+		if err := Run(&opt); !errors.Is(err, ErrBadArgs) {
+			t.Errorf("transfer %d: got %v, want %v", opt.Transfer, err, ErrBadArgs)
+		}
+	}
+}